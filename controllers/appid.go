@@ -8,6 +8,7 @@ import (
 	"github.com/anchel/wechat-official-account-admin/lib/logger"
 	"github.com/anchel/wechat-official-account-admin/lib/types"
 	"github.com/anchel/wechat-official-account-admin/lib/utils"
+	"github.com/anchel/wechat-official-account-admin/modules/weixin"
 	"github.com/anchel/wechat-official-account-admin/mongodb"
 	"github.com/anchel/wechat-official-account-admin/routes"
 	appidservice "github.com/anchel/wechat-official-account-admin/services/appid-service"
@@ -179,6 +180,16 @@ func (ctl *AppIDController) Save(c *gin.Context) {
 
 	// 如果有id，就是更新
 	if form.ID != "" {
+		doc, err := mongodb.ModelWxAppid.FindByID(ctx, form.ID)
+		if err != nil {
+			ctl.returnFail(c, 500, err.Error())
+			return
+		}
+		if doc == nil {
+			ctl.returnFail(c, 400, "appid不存在")
+			return
+		}
+
 		update := bson.D{
 			{Key: "$set", Value: bson.D{
 				{Key: "app_type", Value: form.AppType},
@@ -194,6 +205,13 @@ func (ctl *AppIDController) Save(c *gin.Context) {
 			ctl.returnFail(c, 500, err.Error())
 			return
 		}
+
+		// 配置变了，清除所有节点上缓存的旧配置
+		err = weixin.InvalidateAppID(ctx, doc.AppID)
+		if err != nil {
+			logger.Error("weixin.InvalidateAppID fail", "error", err.Error())
+		}
+
 		ctl.returnOk(c, gin.H{"id": form.ID, "result": ret})
 		return
 	}
@@ -239,12 +257,25 @@ func (ctl *AppIDController) Delete(c *gin.Context) {
 		return
 	}
 
+	doc, err := mongodb.ModelWxAppid.FindByID(ctx, form.ID)
+	if err != nil {
+		ctl.returnFail(c, 500, err.Error())
+		return
+	}
+
 	ret, err := mongodb.ModelWxAppid.DeleteByID(ctx, form.ID)
 	if err != nil {
 		ctl.returnFail(c, 500, err.Error())
 		return
 	}
 
+	if doc != nil {
+		err = weixin.InvalidateAppID(ctx, doc.AppID)
+		if err != nil {
+			logger.Error("weixin.InvalidateAppID fail", "error", err.Error())
+		}
+	}
+
 	ctl.returnOk(c, gin.H{"id": form.ID, "result": ret})
 }
 
@@ -268,7 +299,7 @@ func (ctl *AppIDController) GetEnabled(c *gin.Context) {
 // 设置公众号功能的启用状态
 func (ctl *AppIDController) SetEnabled(c *gin.Context) {
 	var form struct {
-		ReplyType string `json:"reply_type" form:"reply_type" binding:"required"` // subscribe, keyword, message
+		ReplyType string `json:"reply_type" form:"reply_type" binding:"required"` // subscribe, keyword, message, media_download, keyword_match_all
 		Enabled   *bool  `json:"enabled" form:"enabled" binding:"required"`
 	}
 	if c.ShouldBindJSON(&form) != nil {
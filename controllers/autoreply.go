@@ -2,9 +2,15 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/anchel/wechat-official-account-admin/modules/weixin"
 	"github.com/anchel/wechat-official-account-admin/mongodb"
 	"github.com/anchel/wechat-official-account-admin/routes"
 	replyservice "github.com/anchel/wechat-official-account-admin/services/reply-service"
@@ -22,7 +28,18 @@ func init() {
 		}
 		r.GET("/autoreply/get", ctl.Get)
 		r.POST("/autoreply/save", ctl.Save)
+		r.POST("/autoreply/preview", ctl.Preview)
+		r.GET("/autoreply/hits", ctl.GetHits)
 		r.GET("/autoreply/delete", ctl.Delete)
+		r.GET("/autoreply/export", ctl.Export)
+		r.POST("/autoreply/import", ctl.Import)
+		r.GET("/autoreply/analyze", ctl.Analyze)
+		r.GET("/autoreply/draft/pending", ctl.PendingDrafts)
+		r.POST("/autoreply/draft/publish", ctl.PublishDrafts)
+		r.POST("/autoreply/draft/discard", ctl.DiscardDrafts)
+		r.GET("/autoreply/revision/list", ctl.ListRevisions)
+		r.GET("/autoreply/revision/diff", ctl.DiffRevisions)
+		r.POST("/autoreply/revision/restore", ctl.RestoreRevision)
 	})
 }
 
@@ -31,8 +48,10 @@ type AutoReplyController struct {
 }
 
 type KeywordDefIntem struct {
-	Keyword string `json:"keyword"`
-	Exact   bool   `json:"exact"`
+	Keyword    string `json:"keyword"`
+	Exact      bool   `json:"exact"`
+	Regex      bool   `json:"regex"`
+	IgnoreCase bool   `json:"ignore_case"`
 }
 
 type AutoReplyGetRespItem struct {
@@ -42,14 +61,23 @@ type AutoReplyGetRespItem struct {
 	RuleTitle   string                       `json:"rule_title"`
 	Keywords    []string                     `json:"keywords"`
 	KeywordsDef []*KeywordDefIntem           `json:"keywords_def"`
+	Priority    int                          `json:"priority"`
+	HasDraft    bool                         `json:"has_draft"` // 是否有未发布的草稿
+	Published   bool                         `json:"published"` // 是否发布过
 	CreatedAt   time.Time                    `json:"created_at"`
 }
 
-// 查询关注回复、关键词回复、消息回复
+/**
+ * 查询关注回复、关键词回复、消息回复，包括还没有发布过的规则
+ * draft 只决定返回哪个内容：为 true 时返回草稿的内容，没有草稿的返回正式内容
+ * 从未发布过的规则没有正式内容，总是返回草稿的内容，published 为 false
+ * search 匹配返回的内容中的规则名称和关键词
+ */
 func (ctl *AutoReplyController) Get(c *gin.Context) {
 	var form struct {
 		ReplyType string `json:"reply_type" form:"reply_type"` // subscribe, keyword, message
 		Search    string `json:"search" form:"search"`
+		Draft     bool   `json:"draft" form:"draft"`
 	}
 	if c.ShouldBindQuery(&form) != nil {
 		ctl.returnFail(c, 400, "参数错误")
@@ -67,15 +95,19 @@ func (ctl *AutoReplyController) Get(c *gin.Context) {
 		return
 	}
 
-	findOptions := options.Find()
-	filter := bson.D{{Key: "appid", Value: appid}, {Key: "reply_type", Value: form.ReplyType}}
+	var searchRegexp *regexp.Regexp
 	if form.Search != "" {
-		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
-			bson.D{{Key: "rule_title", Value: bson.D{{Key: "$regex", Value: form.Search}}}},
-			bson.D{{Key: "keywords", Value: bson.D{{Key: "$regex", Value: form.Search}}}},
-		}})
+		searchRegexp, err = regexp.Compile(form.Search)
+		if err != nil {
+			ctl.returnFail(c, 400, "search 参数错误")
+			return
+		}
 	}
 
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "priority", Value: -1}, {Key: "created_at", Value: 1}})
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "reply_type", Value: form.ReplyType}}
+
 	docs, err := mongodb.ModelWeixinAutoReply.FindMany(c, filter, findOptions)
 	if err != nil {
 		log.Println("mongodb.ModelWeixinAutoReply.FindMany error", err)
@@ -85,6 +117,20 @@ func (ctl *AutoReplyController) Get(c *gin.Context) {
 
 	list := []AutoReplyGetRespItem{}
 	for _, doc := range docs {
+		hasDraft := doc.DraftData != ""
+		published := doc.ReplyData != ""
+		if form.Draft || !published {
+			next, err := replyservice.ApplyAutoReplyDraft(doc)
+			if err != nil {
+				ctl.returnFail(c, 500, "解析draftdata失败:"+doc.ID.Hex())
+				return
+			}
+			doc = next
+		}
+		if searchRegexp != nil && !searchRegexp.MatchString(doc.RuleTitle) && !lo.ContainsBy(doc.Keywords, searchRegexp.MatchString) {
+			continue
+		}
+
 		replyData, err := replyservice.ParseAutoReplyData(doc.ReplyData)
 		if err != nil {
 			ctl.returnFail(c, 500, "解析replydata失败:"+doc.ID.Hex())
@@ -97,6 +143,9 @@ func (ctl *AutoReplyController) Get(c *gin.Context) {
 			ReplyData: replyData,
 			RuleTitle: doc.RuleTitle,
 			Keywords:  doc.Keywords,
+			Priority:  doc.Priority,
+			HasDraft:  hasDraft,
+			Published: published,
 			CreatedAt: doc.CreatedAt,
 		}
 		if doc.KeywordsDef != "" {
@@ -121,10 +170,12 @@ type AutoReplySaveForm struct {
 	RuleTitle   string             `json:"rule_title" form:"rule_title"`
 	Keywords    []string           `json:"keywords" form:"keywords"`
 	KeywordsDef []*KeywordDefIntem `json:"keywords_def" form:"keywords_def"`
+	Priority    int                `json:"priority" form:"priority"`
+
+	Draft bool `json:"draft" form:"draft"` // 为 true 时只保存为草稿，发布后才生效，否则直接生效
 }
 
 // 保存关注回复、关键词回复、消息回复
-// 这个和菜单点击有些区别。菜单点击有草稿。而这三种类型没有草稿
 func (ctl *AutoReplyController) Save(c *gin.Context) {
 	var form AutoReplySaveForm
 	if c.ShouldBindJSON(&form) != nil {
@@ -132,75 +183,131 @@ func (ctl *AutoReplyController) Save(c *gin.Context) {
 		return
 	}
 
-	if !lo.Contains([]string{"subscribe", "keyword", "message"}, form.ReplyType) {
+	if !lo.Contains(replyservice.DraftReplyTypes, form.ReplyType) {
 		ctl.returnFail(c, 400, "参数错误")
 		return
 	}
 
-	_, appid, err := ctl.newContext(c)
+	ctx, appid, err := ctl.newContext(c)
 	if err != nil {
 		ctl.returnFail(c, 1, err.Error())
 		return
 	}
 
-	replyDataStr, err := json.Marshal(form.ReplyData)
-	if err != nil {
-		ctl.returnFail(c, 500, "转换replydata失败")
+	if err := form.ReplyData.Validate(); err != nil {
+		ctl.returnFail(c, 400, "生效时间错误:"+err.Error())
 		return
 	}
-	keywordsDefStr, err := json.Marshal(form.KeywordsDef)
-	if err != nil {
-		ctl.returnFail(c, 500, "转换keywordsdef失败")
-		return
+
+	// 正则关键词先检查能否编译
+	for _, def := range form.KeywordsDef {
+		if !def.Regex {
+			continue
+		}
+		_, err := weixinservice.CompileKeywordRegex(&weixinservice.KeywordDef{Keyword: def.Keyword, IgnoreCase: def.IgnoreCase})
+		if err != nil {
+			ctl.returnFail(c, 400, "正则表达式错误:"+def.Keyword)
+			return
+		}
 	}
 
-	update := bson.D{{Key: "$set", Value: bson.D{{Key: "reply_data", Value: string(replyDataStr)}}}}
+	draft := &replyservice.AutoReplyDraft{ReplyData: form.ReplyData}
 	if form.ReplyType == "keyword" {
-		update = append(update, bson.E{Key: "$set", Value: bson.D{{Key: "rule_title", Value: form.RuleTitle}}})
-		update = append(update, bson.E{Key: "$set", Value: bson.D{{Key: "keywords", Value: form.Keywords}}})
-		update = append(update, bson.E{Key: "$set", Value: bson.D{{Key: "keywords_def", Value: string(keywordsDefStr)}}})
+		draft.RuleTitle = form.RuleTitle
+		draft.Keywords = form.Keywords
+		draft.Priority = form.Priority
+		draft.KeywordsDef = lo.Map(form.KeywordsDef, func(def *KeywordDefIntem, _ int) *weixinservice.KeywordDef {
+			return &weixinservice.KeywordDef{Keyword: def.Keyword, Exact: def.Exact, Regex: def.Regex, IgnoreCase: def.IgnoreCase}
+		})
 	}
 
-	// 如果有ID，就是更新
-	if form.ID != "" {
-		_, err := mongodb.ModelWeixinAutoReply.UpdateByID(c, form.ID, update)
-		if err != nil {
-			ctl.returnFail(c, 500, err.Error())
-			return
-		}
-		ctl.returnOk(c, gin.H{"id": form.ID})
+	// 每次保存都记录一个版本
+	var id string
+	userID, username, _, _ := ctl.getCurrentUser(c)
+	if form.Draft {
+		id, err = replyservice.SaveAutoReplyDraftWithRevision(ctx, appid, form.ID, form.ReplyType, draft, userID, username)
+	} else {
+		id, err = replyservice.SaveAndPublishAutoReply(ctx, appid, form.ID, form.ReplyType, draft, userID, username)
+	}
+	if err != nil {
+		ctl.returnFail(c, 500, err.Error())
 		return
 	}
+	if !form.Draft {
+		ctl.invalidateKeywordRules(c, appid, form.ReplyType)
+	}
 
-	// 如果是关注回复或者消息回复，只能有一条
-	if form.ReplyType == "message" || form.ReplyType == "subscribe" {
-		filter := bson.D{{Key: "appid", Value: appid}, {Key: "reply_type", Value: form.ReplyType}}
-		doc, err := mongodb.ModelWeixinAutoReply.FindOneAndUpdate(c, filter, update, true)
+	// 关键词冲突只作为提示，不影响保存
+	var warnings *weixinservice.KeywordAnalysis
+	if form.ReplyType == string(weixinservice.AutoReplyTypeKeyword) {
+		rules, err := replyservice.GetRulesWithDrafts(ctx, appid)
 		if err != nil {
-			ctl.returnFail(c, 500, err.Error())
-			return
+			log.Println("Error GetRulesWithDrafts", appid, err)
+		} else if analysis, err := weixinservice.AnalyzeAppKeywordRules(ctx, appid, rules); err != nil {
+			log.Println("Error AnalyzeAppKeywordRules", appid, err)
+		} else {
+			warnings = analysis.ForRule(id)
 		}
-		ctl.returnOk(c, gin.H{"id": doc.ID.Hex()})
+	}
+
+	ctl.returnOk(c, gin.H{"id": id, "warnings": warnings})
+}
+
+// 预览回复内容，替换模板变量后的结果
+func (ctl *AutoReplyController) Preview(c *gin.Context) {
+	var form struct {
+		OpenID    string                       `json:"openid" form:"openid" binding:"required"`
+		Keyword   string                       `json:"keyword" form:"keyword"`
+		ReplyData *weixinservice.AutoReplyData `json:"reply_data" form:"reply_data" binding:"required"`
+	}
+	if c.ShouldBindJSON(&form) != nil {
+		ctl.returnFail(c, 400, "参数错误")
 		return
 	}
 
-	// 关键词回复可以有多条，所以不带ID的，都是新增
-	doc := mongodb.EntityWeixinAutoReply{
-		AppID:     appid,
-		ReplyType: form.ReplyType,
-		ReplyData: string(replyDataStr),
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
 
-		RuleTitle:   form.RuleTitle,
-		Keywords:    form.Keywords,
-		KeywordsDef: string(keywordsDefStr),
+	// 预览当前生效的全部消息，不做随机选择
+	active := form.ReplyData.ActiveData(time.Now())
+	if active == nil {
+		ctl.returnOk(c, gin.H{"active": false, "list": []*weixinservice.AutoReplyMessage{}})
+		return
 	}
-	id, err := mongodb.ModelWeixinAutoReply.InsertOne(c, &doc)
+
+	vars := weixinservice.BuildTemplateVars(ctx, appid, form.OpenID, nil, form.Keyword, active.MsgList)
+	list := weixinservice.RenderReplyMessages(active.MsgList, vars)
+
+	ctl.returnOk(c, gin.H{"active": true, "list": list})
+}
+
+// 查询规则中每条消息发出的次数
+// rule_key 的格式见 weixinservice.ReplyTarget
+func (ctl *AutoReplyController) GetHits(c *gin.Context) {
+	var form struct {
+		RuleKey string `json:"rule_key" form:"rule_key" binding:"required"`
+	}
+	if c.ShouldBindQuery(&form) != nil {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	hits, err := weixinservice.GetReplyHits(ctx, appid, form.RuleKey)
 	if err != nil {
 		ctl.returnFail(c, 500, err.Error())
 		return
 	}
 
-	ctl.returnOk(c, gin.H{"id": id})
+	ctl.returnOk(c, gin.H{"rule_key": form.RuleKey, "hits": hits})
 }
 
 // 删除关注回复、关键词回复、消息回复
@@ -211,11 +318,21 @@ func (ctl *AutoReplyController) Delete(c *gin.Context) {
 		return
 	}
 
+	_, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	// 删除前记录一个版本，之后还可以恢复
+	ctl.recordRevision(c, id, replyservice.RevisionActionDelete)
+
 	ret, err := mongodb.ModelWeixinAutoReply.DeleteByID(c, id)
 	if err != nil {
 		ctl.returnFail(c, 500, err.Error())
 		return
 	}
+	ctl.invalidateKeywordRules(c, appid, string(weixinservice.AutoReplyTypeKeyword))
 
 	ctl.returnOk(c, gin.H{id: id, "result": ret})
 }
@@ -254,3 +371,311 @@ func (ctl *AutoReplyController) SetEnabled(c *gin.Context) {
 		"updated": ret.ModifiedCount,
 	})
 }
+
+// 关键词规则变化后，让所有节点重新编译关键词匹配器
+func (ctl *AutoReplyController) invalidateKeywordRules(c *gin.Context, appid string, replyType string) {
+	if replyType != string(weixinservice.AutoReplyTypeKeyword) {
+		return
+	}
+	err := weixin.InvalidateKeywordRules(c, appid)
+	if err != nil {
+		log.Println("weixin.InvalidateKeywordRules error", err)
+	}
+}
+
+// 导出所有自动回复规则，format 为 json 或 yaml
+func (ctl *AutoReplyController) Export(c *gin.Context) {
+	var form struct {
+		Format string `json:"format" form:"format" binding:"omitempty,oneof=json yaml"`
+	}
+	if c.ShouldBindQuery(&form) != nil {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+	if form.Format == "" {
+		form.Format = replyservice.ReplyRulesFormatJSON
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	doc, err := replyservice.ExportReplyRules(ctx, appid)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	bs, err := replyservice.EncodeReplyRules(doc, form.Format)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	contentType := "application/json; charset=utf-8"
+	if form.Format == replyservice.ReplyRulesFormatYAML {
+		contentType = "application/yaml; charset=utf-8"
+	}
+	c.Header("Content-Disposition", "attachment; filename=autoreply-"+appid+"."+form.Format)
+	c.Data(200, contentType, bs)
+}
+
+// 导入自动回复规则，上传导出的文件
+// mode 为 merge 或 replace，dry_run 时只返回报告，不做修改
+func (ctl *AutoReplyController) Import(c *gin.Context) {
+	var form struct {
+		Mode   string `json:"mode" form:"mode" binding:"required,oneof=merge replace"`
+		DryRun bool   `json:"dry_run" form:"dry_run"`
+		Format string `json:"format" form:"format" binding:"omitempty,oneof=json yaml"` // 不传时按文件后缀判断
+	}
+	if c.ShouldBind(&form) != nil {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		ctl.returnFail(c, 400, "请上传文件")
+		return
+	}
+	if form.Format == "" {
+		form.Format = replyservice.ReplyRulesFormatJSON
+		ext := strings.ToLower(filepath.Ext(file.Filename))
+		if ext == ".yaml" || ext == ".yml" {
+			form.Format = replyservice.ReplyRulesFormatYAML
+		}
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	f, err := file.Open()
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	doc, err := replyservice.DecodeReplyRules(data, form.Format)
+	if err != nil {
+		ctl.returnFail(c, 400, "文件格式错误:"+err.Error())
+		return
+	}
+
+	userID, username, _, _ := ctl.getCurrentUser(c)
+	report, err := replyservice.ImportReplyRules(ctx, appid, doc, form.Mode, form.DryRun, userID, username)
+	// 中途失败时可能已经修改了一部分规则，同样需要重新编译
+	if !form.DryRun {
+		ctl.invalidateKeywordRules(c, appid, string(weixinservice.AutoReplyTypeKeyword))
+	}
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, report)
+}
+
+// 规则保存后记录历史版本，失败时只记录日志，不影响保存
+func (ctl *AutoReplyController) recordRevision(c *gin.Context, ruleID string, action string) {
+	doc, err := mongodb.ModelWeixinAutoReply.FindByID(c, ruleID)
+	if err != nil || doc == nil {
+		log.Println("recordRevision FindByID error", ruleID, err)
+		return
+	}
+	userID, username, _, _ := ctl.getCurrentUser(c)
+	_, err = replyservice.RecordRevision(c, doc, action, userID, username)
+	if err != nil {
+		log.Println("replyservice.RecordRevision error", ruleID, err)
+	}
+}
+
+// 规则的历史版本列表
+func (ctl *AutoReplyController) ListRevisions(c *gin.Context) {
+	var form struct {
+		RuleID string `json:"rule_id" form:"rule_id" binding:"required"`
+	}
+	if c.ShouldBindQuery(&form) != nil {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	docs, err := replyservice.ListRevisions(ctx, appid, form.RuleID)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"list": docs})
+}
+
+// 比较两个历史版本，from 到 to 的变化
+func (ctl *AutoReplyController) DiffRevisions(c *gin.Context) {
+	var form struct {
+		RuleID string `json:"rule_id" form:"rule_id" binding:"required"`
+		From   int    `json:"from" form:"from" binding:"required"`
+		To     int    `json:"to" form:"to" binding:"required"`
+	}
+	if c.ShouldBindQuery(&form) != nil {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	from, err := replyservice.GetRevision(ctx, appid, form.RuleID, form.From)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	to, err := replyservice.GetRevision(ctx, appid, form.RuleID, form.To)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	diff, err := replyservice.DiffRevisions(from, to)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"from": from, "to": to, "diff": diff})
+}
+
+// 把规则恢复为某个历史版本
+func (ctl *AutoReplyController) RestoreRevision(c *gin.Context) {
+	var form struct {
+		RuleID   string `json:"rule_id" form:"rule_id" binding:"required"`
+		Revision int    `json:"revision" form:"revision" binding:"required"`
+	}
+	if c.ShouldBindJSON(&form) != nil {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	userID, username, _, _ := ctl.getCurrentUser(c)
+	rule, err := replyservice.RestoreRevision(ctx, appid, form.RuleID, form.Revision, userID, username)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	ctl.invalidateKeywordRules(c, appid, rule.ReplyType)
+
+	ctl.returnOk(c, gin.H{"id": rule.ID.Hex()})
+}
+
+// 检查关键词规则的冲突、被覆盖的规则和匹配不到的关键词，draft=true 时检查草稿发布后的规则
+func (ctl *AutoReplyController) Analyze(c *gin.Context) {
+	var form struct {
+		Draft bool `form:"draft"`
+	}
+	if c.ShouldBindQuery(&form) != nil {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	var rules []*mongodb.EntityWeixinAutoReply
+	if form.Draft {
+		rules, err = replyservice.GetRulesWithDrafts(ctx, appid)
+		if ctl.checkError(c, err) != nil {
+			return
+		}
+	}
+	analysis, err := weixinservice.AnalyzeAppKeywordRules(ctx, appid, rules)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, analysis)
+}
+
+// 待发布的修改
+func (ctl *AutoReplyController) PendingDrafts(c *gin.Context) {
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	list, err := replyservice.ListPendingDrafts(ctx, appid)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"list": list})
+}
+
+// 发布草稿，不传 ids 时发布所有草稿，请求体可以为空
+func (ctl *AutoReplyController) PublishDrafts(c *gin.Context) {
+	var form struct {
+		IDs []string `json:"ids" form:"ids"`
+	}
+	if err := c.ShouldBindJSON(&form); err != nil && !errors.Is(err, io.EOF) {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	userID, username, _, _ := ctl.getCurrentUser(c)
+	docs, err := replyservice.PublishDrafts(ctx, appid, form.IDs, userID, username)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	if lo.ContainsBy(docs, func(doc *mongodb.EntityWeixinAutoReply) bool {
+		return doc.ReplyType == string(weixinservice.AutoReplyTypeKeyword)
+	}) {
+		ctl.invalidateKeywordRules(c, appid, string(weixinservice.AutoReplyTypeKeyword))
+	}
+
+	ctl.returnOk(c, gin.H{"published": len(docs)})
+}
+
+// 丢弃草稿，不传 ids 时丢弃所有草稿，请求体可以为空
+func (ctl *AutoReplyController) DiscardDrafts(c *gin.Context) {
+	var form struct {
+		IDs []string `json:"ids" form:"ids"`
+	}
+	if err := c.ShouldBindJSON(&form); err != nil && !errors.Is(err, io.EOF) {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	count, err := replyservice.DiscardDrafts(ctx, appid, form.IDs)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"discarded": count})
+}
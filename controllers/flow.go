@@ -0,0 +1,261 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	"github.com/anchel/wechat-official-account-admin/routes"
+	flowservice "github.com/anchel/wechat-official-account-admin/services/flow-service"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func init() {
+	routes.AddRouteInitFunc(func(r *gin.RouterGroup) {
+		ctl := &FlowController{
+			BaseController: &BaseController{},
+		}
+		r.GET("/flow/list", ctl.List)
+		r.POST("/flow/save", ctl.Save)
+		r.POST("/flow/delete", ctl.Delete)
+		r.GET("/flow/result/list", ctl.ListResults)
+		r.GET("/flow/result/export", ctl.ExportResults)
+	})
+}
+
+type FlowController struct {
+	*BaseController
+}
+
+type FlowListRespItem struct {
+	ID             string                  `json:"id"`
+	Name           string                  `json:"name"`
+	Triggers       []string                `json:"triggers"`
+	Steps          []*flowservice.FlowStep `json:"steps"`
+	TimeoutSeconds int                     `json:"timeout_seconds"`
+	CancelKeyword  string                  `json:"cancel_keyword"`
+	CancelText     string                  `json:"cancel_text"`
+	FinishText     string                  `json:"finish_text"`
+	Enabled        bool                    `json:"enabled"`
+	CreatedAt      time.Time               `json:"created_at"`
+}
+
+// 获取对话流程列表
+func (ctl *FlowController) List(c *gin.Context) {
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	filter := bson.D{{Key: "appid", Value: appid}}
+	docs, err := mongodb.ModelWxFlow.FindMany(ctx, filter, findOptions)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	list := []*FlowListRespItem{}
+	for _, doc := range docs {
+		steps, err := flowservice.ParseSteps(doc.Steps)
+		if err != nil {
+			ctl.returnFail(c, 500, "解析steps失败:"+doc.ID.Hex())
+			return
+		}
+		list = append(list, &FlowListRespItem{
+			ID:             doc.ID.Hex(),
+			Name:           doc.Name,
+			Triggers:       doc.Triggers,
+			Steps:          steps,
+			TimeoutSeconds: doc.TimeoutSeconds,
+			CancelKeyword:  doc.CancelKeyword,
+			CancelText:     doc.CancelText,
+			FinishText:     doc.FinishText,
+			Enabled:        doc.Enabled,
+			CreatedAt:      doc.CreatedAt,
+		})
+	}
+
+	ctl.returnOk(c, gin.H{"list": list})
+}
+
+// 保存对话流程
+func (ctl *FlowController) Save(c *gin.Context) {
+	var form struct {
+		ID             string                  `json:"id" form:"id"`
+		Name           string                  `json:"name" form:"name" binding:"required"`
+		Triggers       []string                `json:"triggers" form:"triggers"`
+		Steps          []*flowservice.FlowStep `json:"steps" form:"steps" binding:"required"`
+		TimeoutSeconds int                     `json:"timeout_seconds" form:"timeout_seconds"`
+		CancelKeyword  string                  `json:"cancel_keyword" form:"cancel_keyword"`
+		CancelText     string                  `json:"cancel_text" form:"cancel_text"`
+		FinishText     string                  `json:"finish_text" form:"finish_text"`
+		Enabled        bool                    `json:"enabled" form:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+	if err := flowservice.ValidateSteps(form.Steps); err != nil {
+		ctl.returnFail(c, 400, "步骤定义错误:"+err.Error())
+		return
+	}
+	if form.TimeoutSeconds < 0 {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+	if form.Triggers == nil {
+		form.Triggers = []string{}
+	}
+
+	stepsStr, err := json.Marshal(form.Steps)
+	if err != nil {
+		ctl.returnFail(c, 500, "转换steps失败")
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	// 如果有ID，就是更新
+	if form.ID != "" {
+		objectID, err := primitive.ObjectIDFromHex(form.ID)
+		if ctl.checkError(c, err) != nil {
+			return
+		}
+		filter := bson.D{{Key: "_id", Value: objectID}, {Key: "appid", Value: appid}}
+		update := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "name", Value: form.Name},
+			{Key: "triggers", Value: form.Triggers},
+			{Key: "steps", Value: string(stepsStr)},
+			{Key: "timeout_seconds", Value: form.TimeoutSeconds},
+			{Key: "cancel_keyword", Value: form.CancelKeyword},
+			{Key: "cancel_text", Value: form.CancelText},
+			{Key: "finish_text", Value: form.FinishText},
+			{Key: "enabled", Value: form.Enabled},
+		}}}
+		_, err = mongodb.ModelWxFlow.UpdateOne(ctx, filter, update)
+		if ctl.checkError(c, err) != nil {
+			return
+		}
+		ctl.returnOk(c, gin.H{"id": form.ID})
+		return
+	}
+
+	doc := &mongodb.EntityWxFlow{
+		AppID:          appid,
+		Name:           form.Name,
+		Triggers:       form.Triggers,
+		Steps:          string(stepsStr),
+		TimeoutSeconds: form.TimeoutSeconds,
+		CancelKeyword:  form.CancelKeyword,
+		CancelText:     form.CancelText,
+		FinishText:     form.FinishText,
+		Enabled:        form.Enabled,
+	}
+	id, err := mongodb.ModelWxFlow.InsertOne(ctx, doc)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"id": id})
+}
+
+// 删除对话流程，已经收集的结果保留
+func (ctl *FlowController) Delete(c *gin.Context) {
+	var form struct {
+		ID string `json:"id" form:"id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(form.ID)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	filter := bson.D{{Key: "_id", Value: objectID}, {Key: "appid", Value: appid}}
+	count, err := mongodb.ModelWxFlow.DeleteOne(ctx, filter)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"id": form.ID, "deleted": count})
+}
+
+// 获取流程收集到的结果
+func (ctl *FlowController) ListResults(c *gin.Context) {
+	var form struct {
+		FlowID string `json:"flow_id" form:"flow_id" binding:"required"`
+		Offset *int64 `json:"offset" form:"offset" binding:"required"`
+		Count  *int64 `json:"count" form:"count" binding:"required"`
+	}
+	if err := c.ShouldBindQuery(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSkip(*form.Offset)
+	findOptions.SetLimit(*form.Count)
+	findOptions.SetSort(bson.D{{Key: "created_at", Value: -1}})
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "flow_id", Value: form.FlowID}}
+
+	total, err := mongodb.ModelWxFlowResult.Count(ctx, filter)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	docs, err := mongodb.ModelWxFlowResult.FindMany(ctx, filter, findOptions)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"total": total, "list": docs})
+}
+
+// 导出流程收集到的结果为csv
+func (ctl *FlowController) ExportResults(c *gin.Context) {
+	var form struct {
+		FlowID string `json:"flow_id" form:"flow_id" binding:"required"`
+	}
+	if err := c.ShouldBindQuery(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	var buf bytes.Buffer
+	err = flowservice.ExportResultsCSV(ctx, appid, form.FlowID, &buf)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=flow-"+form.FlowID+".csv")
+	c.Data(200, "text/csv; charset=utf-8", buf.Bytes())
+}
@@ -0,0 +1,264 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/anchel/wechat-official-account-admin/modules/weixin"
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	"github.com/anchel/wechat-official-account-admin/routes"
+	forwardservice "github.com/anchel/wechat-official-account-admin/services/forward-service"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func init() {
+	routes.AddRouteInitFunc(func(r *gin.RouterGroup) {
+		ctl := &ForwardController{
+			BaseController: &BaseController{},
+		}
+		r.GET("/forward/target/list", ctl.ListTargets)
+		r.POST("/forward/target/save", ctl.SaveTarget)
+		r.POST("/forward/target/delete", ctl.DeleteTarget)
+		r.GET("/forward/log/list", ctl.ListLogs)
+	})
+}
+
+type ForwardController struct {
+	*BaseController
+}
+
+// 获取转发目标列表
+func (ctl *ForwardController) ListTargets(c *gin.Context) {
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	filter := bson.D{{Key: "appid", Value: appid}}
+	docs, err := mongodb.ModelWxForwardTarget.FindMany(ctx, filter, findOptions)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	for _, doc := range docs {
+		if doc.Secret != "" {
+			doc.Secret = forwardservice.SecretMask
+		}
+	}
+
+	// 外部回复的熔断状态
+	breakers := make(map[string]*forwardservice.BreakerState)
+	for _, doc := range docs {
+		if doc.UseAsFallback {
+			breakers[doc.ID.Hex()] = forwardservice.GetBreakerState(doc)
+		}
+	}
+
+	ctl.returnOk(c, gin.H{"list": docs, "breakers": breakers})
+}
+
+// 保存转发目标
+func (ctl *ForwardController) SaveTarget(c *gin.Context) {
+	var form struct {
+		ID         string   `json:"id" form:"id"`
+		Name       string   `json:"name" form:"name" binding:"required"`
+		Url        string   `json:"url" form:"url" binding:"required"`
+		Secret     string   `json:"secret" form:"secret"`
+		Events     []string `json:"events" form:"events"`
+		TimeoutMs  int      `json:"timeout_ms" form:"timeout_ms"`
+		MaxRetries int      `json:"max_retries" form:"max_retries"`
+		UseAsReply bool     `json:"use_as_reply" form:"use_as_reply"`
+		Enabled    bool     `json:"enabled" form:"enabled"`
+
+		UseAsFallback      bool `json:"use_as_fallback" form:"use_as_fallback"`
+		BreakerFailures    int  `json:"breaker_failures" form:"breaker_failures"`
+		BreakerCooldownSec int  `json:"breaker_cooldown_sec" form:"breaker_cooldown_sec"`
+	}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+
+	u, err := url.Parse(form.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		ctl.returnFail(c, 400, "url格式错误")
+		return
+	}
+	if form.TimeoutMs < 0 || form.MaxRetries < 0 || form.MaxRetries > 10 || form.BreakerFailures < 0 || form.BreakerCooldownSec < 0 {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+	// 请求内同步调用的，超时不能超过被动回复的限定时间
+	if (form.UseAsReply || form.UseAsFallback) && form.TimeoutMs > forwardservice.MaxReplyTimeoutMs {
+		ctl.returnFail(c, 400, fmt.Sprintf("作为回复时 timeout_ms 不能超过 %d", forwardservice.MaxReplyTimeoutMs))
+		return
+	}
+	if form.UseAsFallback && form.UseAsReply {
+		ctl.returnFail(c, 400, "外部回复不能同时作为转发回复")
+		return
+	}
+	if form.Events == nil {
+		form.Events = []string{}
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	// 每个公众号只能有一个启用的外部回复
+	if form.UseAsFallback && form.Enabled {
+		other, err := forwardservice.GetFallbackTarget(ctx, appid)
+		if ctl.checkError(c, err) != nil {
+			return
+		}
+		if other != nil && other.ID.Hex() != form.ID {
+			ctl.returnFail(c, 400, "已经有启用的外部回复:"+other.Name)
+			return
+		}
+	}
+
+	// 如果有ID，就是更新
+	if form.ID != "" {
+		objectID, err := primitive.ObjectIDFromHex(form.ID)
+		if ctl.checkError(c, err) != nil {
+			return
+		}
+		filter := bson.D{{Key: "_id", Value: objectID}, {Key: "appid", Value: appid}}
+		set := bson.D{
+			{Key: "name", Value: form.Name},
+			{Key: "url", Value: form.Url},
+			{Key: "events", Value: form.Events},
+			{Key: "timeout_ms", Value: form.TimeoutMs},
+			{Key: "max_retries", Value: form.MaxRetries},
+			{Key: "use_as_reply", Value: form.UseAsReply},
+			{Key: "enabled", Value: form.Enabled},
+			{Key: "use_as_fallback", Value: form.UseAsFallback},
+			{Key: "breaker_failures", Value: form.BreakerFailures},
+			{Key: "breaker_cooldown_sec", Value: form.BreakerCooldownSec},
+		}
+		// 列表中的 secret 是打码的，没有修改时保留原来的
+		if form.Secret != "" && form.Secret != forwardservice.SecretMask {
+			set = append(set, bson.E{Key: "secret", Value: form.Secret})
+		}
+		update := bson.D{{Key: "$set", Value: set}}
+		_, err = mongodb.ModelWxForwardTarget.UpdateOne(ctx, filter, update)
+		if ctl.checkError(c, err) != nil {
+			return
+		}
+		ctl.invalidateTargets(c, appid)
+		ctl.returnOk(c, gin.H{"id": form.ID})
+		return
+	}
+
+	doc := &mongodb.EntityWxForwardTarget{
+		AppID:      appid,
+		Name:       form.Name,
+		Url:        form.Url,
+		Secret:     form.Secret,
+		Events:     form.Events,
+		TimeoutMs:  form.TimeoutMs,
+		MaxRetries: form.MaxRetries,
+		UseAsReply: form.UseAsReply,
+		Enabled:    form.Enabled,
+
+		UseAsFallback:      form.UseAsFallback,
+		BreakerFailures:    form.BreakerFailures,
+		BreakerCooldownSec: form.BreakerCooldownSec,
+	}
+	id, err := mongodb.ModelWxForwardTarget.InsertOne(ctx, doc)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	ctl.invalidateTargets(c, appid)
+
+	ctl.returnOk(c, gin.H{"id": id})
+}
+
+// 删除转发目标
+func (ctl *ForwardController) DeleteTarget(c *gin.Context) {
+	var form struct {
+		ID string `json:"id" form:"id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		ctl.returnFail(c, 400, "参数错误")
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(form.ID)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	filter := bson.D{{Key: "_id", Value: objectID}, {Key: "appid", Value: appid}}
+	count, err := mongodb.ModelWxForwardTarget.DeleteOne(ctx, filter)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	ctl.invalidateTargets(c, appid)
+
+	ctl.returnOk(c, gin.H{"id": form.ID, "deleted": count})
+}
+
+// 转发目标变化后，让所有节点重新加载启用的目标
+func (ctl *ForwardController) invalidateTargets(c *gin.Context, appid string) {
+	err := weixin.InvalidateForwardTargets(c, appid)
+	if err != nil {
+		log.Println("weixin.InvalidateForwardTargets error", err)
+	}
+}
+
+// 获取投递记录
+func (ctl *ForwardController) ListLogs(c *gin.Context) {
+	var form struct {
+		TargetID string `json:"target_id" form:"target_id"`
+		Status   string `json:"status" form:"status"` // success, fail
+		Offset   *int64 `json:"offset" form:"offset" binding:"required"`
+		Count    *int64 `json:"count" form:"count" binding:"required"`
+	}
+	if err := c.ShouldBindQuery(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSkip(*form.Offset)
+	findOptions.SetLimit(*form.Count)
+	findOptions.SetSort(bson.D{{Key: "created_at", Value: -1}})
+	filter := bson.D{{Key: "appid", Value: appid}}
+	if form.TargetID != "" {
+		filter = append(filter, bson.E{Key: "target_id", Value: form.TargetID})
+	}
+	if form.Status != "" {
+		filter = append(filter, bson.E{Key: "status", Value: form.Status})
+	}
+
+	total, err := mongodb.ModelWxForwardLog.Count(ctx, filter)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	docs, err := mongodb.ModelWxForwardLog.FindMany(ctx, filter, findOptions)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"total": total, "list": docs})
+}
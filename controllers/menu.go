@@ -410,6 +410,19 @@ func (ctl *MenuController) getConditionalList(c *gin.Context) {
 	})
 }
 
+// 检查菜单点击回复的生效时间配置
+func validateMenuAutoReply(autoReply map[string]*weixinservice.AutoReplyData) error {
+	for _, rd := range autoReply {
+		if rd == nil {
+			continue
+		}
+		if err := rd.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type MenuSaveNormalForm struct {
 	Button    []*wxapi.MenuButtonItemApiFormat        `json:"button"`
 	AutoReply map[string]*weixinservice.AutoReplyData `json:"autoreply,omitempty"`
@@ -424,6 +437,10 @@ func (ctl *MenuController) saveNormal(c *gin.Context) {
 		ctl.returnFail(c, 1, "param error")
 		return
 	}
+	if err := validateMenuAutoReply(form.AutoReply); err != nil {
+		ctl.returnFail(c, 400, "生效时间错误:"+err.Error())
+		return
+	}
 
 	ctx, _, err := ctl.newContext(c)
 	if err != nil {
@@ -571,6 +588,10 @@ func (ctl *MenuController) saveConditionalMenu(c *gin.Context) {
 		ctl.returnFail(c, 1, "param error"+err.Error())
 		return
 	}
+	if err := validateMenuAutoReply(form.AutoReply); err != nil {
+		ctl.returnFail(c, 400, "生效时间错误:"+err.Error())
+		return
+	}
 
 	ctx, _, err := ctl.newContext(c)
 	if err != nil {
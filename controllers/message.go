@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	"github.com/anchel/wechat-official-account-admin/routes"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func init() {
+	routes.AddRouteInitFunc(func(r *gin.RouterGroup) {
+		ctl := &MessageController{
+			BaseController: &BaseController{},
+		}
+		r.GET("/message/conversation", ctl.Conversation)
+		r.GET("/message/search", ctl.Search)
+	})
+}
+
+type MessageController struct {
+	*BaseController
+}
+
+// 分页获取某个粉丝的消息记录，按时间倒序
+func (ctl *MessageController) Conversation(c *gin.Context) {
+	var form struct {
+		OpenID string `json:"openid" form:"openid" binding:"required"`
+		Offset *int64 `json:"offset" form:"offset" binding:"required"`
+		Count  *int64 `json:"count" form:"count" binding:"required"`
+	}
+	if err := c.ShouldBindQuery(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSkip(*form.Offset)
+	findOptions.SetLimit(*form.Count)
+	findOptions.SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}})
+	filter := bson.D{
+		{Key: "appid", Value: appid},
+		{Key: "openid", Value: form.OpenID},
+	}
+
+	total, err := mongodb.ModelWxMessage.Count(ctx, filter)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	docs, err := mongodb.ModelWxMessage.FindMany(ctx, filter, findOptions)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"total": total, "list": docs})
+}
+
+// 搜索的时间范围最多的天数
+const messageSearchMaxDays = 31
+
+/**
+ * 在当前公众号下搜索消息文本
+ * 包含匹配没法用索引，查询限制在一个时间范围内，走 appid+time 或者 appid+openid+time 的索引，只扫描范围内的消息
+ * 不用 text 索引，mongodb 的全文索引不支持中文分词
+ */
+func (ctl *MessageController) Search(c *gin.Context) {
+	var form struct {
+		Keyword   string `json:"keyword" form:"keyword" binding:"required"`
+		Direction string `json:"direction" form:"direction"`   // in, out，不传则都查
+		OpenID    string `json:"openid" form:"openid"`         // 不传则查所有粉丝
+		StartDate string `json:"start_date" form:"start_date"` // 2006-01-02，不传则为结束日期前7天
+		EndDate   string `json:"end_date" form:"end_date"`     // 2006-01-02，包含当天，不传则为今天
+		Offset    *int64 `json:"offset" form:"offset" binding:"required"`
+		Count     *int64 `json:"count" form:"count" binding:"required"`
+	}
+	if err := c.ShouldBindQuery(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	start, end, err := weixinservice.ParseStatsDateRange(form.StartDate, form.EndDate)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+	if end.Sub(start) > messageSearchMaxDays*24*time.Hour {
+		ctl.returnFail(c, 1, fmt.Sprintf("时间范围不能超过%d天", messageSearchMaxDays))
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSkip(*form.Offset)
+	findOptions.SetLimit(*form.Count)
+	findOptions.SetSort(bson.D{{Key: "time", Value: -1}})
+	filter := bson.D{{Key: "appid", Value: appid}}
+	if form.OpenID != "" {
+		filter = append(filter, bson.E{Key: "openid", Value: form.OpenID})
+	}
+	filter = append(filter,
+		bson.E{Key: "time", Value: bson.D{{Key: "$gte", Value: start}, {Key: "$lt", Value: end}}},
+		bson.E{Key: "content", Value: bson.D{{Key: "$regex", Value: regexp.QuoteMeta(form.Keyword)}}},
+	)
+	if form.Direction != "" {
+		filter = append(filter, bson.E{Key: "direction", Value: form.Direction})
+	}
+
+	total, err := mongodb.ModelWxMessage.Count(ctx, filter)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	docs, err := mongodb.ModelWxMessage.FindMany(ctx, filter, findOptions)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"total": total, "list": docs})
+}
@@ -1,9 +1,13 @@
 package controllers
 
 import (
+	"encoding/json"
+
 	"github.com/anchel/wechat-official-account-admin/modules/weixin"
 	"github.com/anchel/wechat-official-account-admin/mongodb"
 	"github.com/anchel/wechat-official-account-admin/routes"
+	replyservice "github.com/anchel/wechat-official-account-admin/services/reply-service"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
 	"github.com/anchel/wechat-official-account-admin/wxmp/wxapi"
 	"github.com/gin-gonic/gin"
 	"github.com/samber/lo"
@@ -18,6 +22,8 @@ func init() {
 		}
 		r.GET("/qrcode/list", ctl.List)
 		r.POST("/qrcode/add", ctl.Create)
+		r.GET("/qrcode/reply/get", ctl.GetReply)
+		r.POST("/qrcode/reply/save", ctl.SaveReply)
 	})
 }
 
@@ -81,6 +87,8 @@ func (ctl *QrcodeController) Create(c *gin.Context) {
 		SceneStr      string `json:"scene_str" form:"scene_str"`
 		SceneId       int    `json:"scene_id" form:"scene_id"`
 		ExpireSeconds int    `json:"expire_seconds" form:"expire_seconds"`
+
+		ReplyData *weixinservice.AutoReplyData `json:"reply_data" form:"reply_data"` // 扫码回复，可选
 	}
 	if err := c.ShouldBindJSON(&form); err != nil {
 		ctl.returnFail(c, 1, err.Error())
@@ -97,6 +105,20 @@ func (ctl *QrcodeController) Create(c *gin.Context) {
 		return
 	}
 
+	replyDataStr := ""
+	if form.ReplyData != nil {
+		if err := form.ReplyData.Validate(); err != nil {
+			ctl.returnFail(c, 400, "生效时间错误:"+err.Error())
+			return
+		}
+		bs, err := json.Marshal(form.ReplyData)
+		if err != nil {
+			ctl.returnFail(c, 500, "转换replydata失败")
+			return
+		}
+		replyDataStr = string(bs)
+	}
+
 	var ret *wxapi.CreateQrCodeResp
 	var err error
 
@@ -130,6 +152,7 @@ func (ctl *QrcodeController) Create(c *gin.Context) {
 		Ticket:        ret.Ticket,
 		ExpireSeconds: ret.ExpireSeconds,
 		Url:           ret.Url,
+		ReplyData:     replyDataStr,
 	}
 	id, err := mongodb.ModelWxQrcode.InsertOne(ctx, doc)
 	if ctl.checkError(c, err) != nil {
@@ -138,3 +161,83 @@ func (ctl *QrcodeController) Create(c *gin.Context) {
 
 	ctl.returnOk(c, gin.H{"id": id, "ticket": ret.Ticket, "url": ret.Url, "expire_seconds": ret.ExpireSeconds})
 }
+
+// 获取二维码的扫码回复
+func (ctl *QrcodeController) GetReply(c *gin.Context) {
+	var form struct {
+		ID string `json:"id" form:"id" binding:"required"`
+	}
+	if err := c.ShouldBindQuery(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	doc, err := mongodb.ModelWxQrcode.FindByID(ctx, form.ID)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	if doc == nil || doc.AppID != appid {
+		ctl.returnFail(c, 404, "二维码不存在")
+		return
+	}
+
+	replyData, err := replyservice.ParseAutoReplyData(doc.ReplyData)
+	if err != nil {
+		ctl.returnFail(c, 500, "解析replydata失败:"+doc.ID.Hex())
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"id": form.ID, "reply_data": replyData})
+}
+
+// 保存二维码的扫码回复，msg_list 为空表示使用关注回复
+func (ctl *QrcodeController) SaveReply(c *gin.Context) {
+	var form struct {
+		ID        string                       `json:"id" form:"id" binding:"required"`
+		ReplyData *weixinservice.AutoReplyData `json:"reply_data" form:"reply_data" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	doc, err := mongodb.ModelWxQrcode.FindByID(ctx, form.ID)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+	if doc == nil || doc.AppID != appid {
+		ctl.returnFail(c, 404, "二维码不存在")
+		return
+	}
+
+	if err := form.ReplyData.Validate(); err != nil {
+		ctl.returnFail(c, 400, "生效时间错误:"+err.Error())
+		return
+	}
+
+	replyDataStr, err := json.Marshal(form.ReplyData)
+	if err != nil {
+		ctl.returnFail(c, 500, "转换replydata失败")
+		return
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "reply_data", Value: string(replyDataStr)}}}}
+	_, err = mongodb.ModelWxQrcode.UpdateByID(ctx, form.ID, update)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"id": form.ID})
+}
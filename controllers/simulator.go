@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"github.com/anchel/wechat-official-account-admin/modules/weixin"
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	"github.com/anchel/wechat-official-account-admin/routes"
+	replyservice "github.com/anchel/wechat-official-account-admin/services/reply-service"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	routes.AddRouteInitFunc(func(r *gin.RouterGroup) {
+		ctl := &SimulatorController{
+			BaseController: &BaseController{},
+		}
+		r.POST("/simulator/send", ctl.Send)
+		r.POST("/simulator/explain", ctl.Explain)
+	})
+}
+
+type SimulatorController struct {
+	*BaseController
+}
+
+// 模拟微信服务器推送一条消息，返回回包和会发送的客服消息
+func (ctl *SimulatorController) Send(c *gin.Context) {
+	var form weixin.SimulateRequest
+	if err := c.ShouldBindJSON(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ret, err := weixin.Simulate(ctx, appid, &form)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, ret)
+}
+
+// 解释一条消息会命中哪条规则、为什么，以及最终的回复，不会发送消息
+func (ctl *SimulatorController) Explain(c *gin.Context) {
+	var form struct {
+		weixin.SimulateRequest
+		UseDraft bool `json:"use_draft" form:"use_draft"` // 按草稿发布后的规则解释
+	}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	var rules []*mongodb.EntityWeixinAutoReply
+	if form.UseDraft {
+		rules, err = replyservice.GetRulesWithDrafts(ctx, appid)
+		if ctl.checkError(c, err) != nil {
+			return
+		}
+	}
+
+	ret, err := weixin.Explain(ctx, appid, &form.SimulateRequest, rules)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, ret)
+}
@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"github.com/anchel/wechat-official-account-admin/routes"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	routes.AddRouteInitFunc(func(r *gin.RouterGroup) {
+		ctl := &StatsController{
+			BaseController: &BaseController{},
+		}
+		r.GET("/stats/reply/top", ctl.TopRules)
+		r.GET("/stats/reply/rule", ctl.RuleMessages)
+		r.GET("/stats/reply/unmatched", ctl.Unmatched)
+		r.GET("/stats/reply/trend", ctl.Trend)
+		r.GET("/stats/replay/rejects", ctl.ReplayRejects)
+	})
+}
+
+type StatsController struct {
+	*BaseController
+}
+
+type statsRangeForm struct {
+	StartDate string `json:"start_date" form:"start_date"` // 2006-01-02，不传则为结束日期前7天
+	EndDate   string `json:"end_date" form:"end_date"`     // 2006-01-02，包含当天，不传则为今天
+}
+
+func statsLimit(limit int) int {
+	if limit <= 0 {
+		return 20
+	}
+	if limit > 200 {
+		return 200
+	}
+	return limit
+}
+
+// 命中次数最多的规则
+func (ctl *StatsController) TopRules(c *gin.Context) {
+	var form struct {
+		statsRangeForm
+		ReplyType string `json:"reply_type" form:"reply_type"` // subscribe, keyword, message, menu_click，不传则不限
+		Limit     int    `json:"limit" form:"limit"`
+	}
+	if err := c.ShouldBindQuery(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	start, end, err := weixinservice.ParseStatsDateRange(form.StartDate, form.EndDate)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	list, err := weixinservice.GetTopReplyRules(ctx, appid, form.ReplyType, start, end, statsLimit(form.Limit))
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"list": list})
+}
+
+// 规则中每条消息的命中次数
+func (ctl *StatsController) RuleMessages(c *gin.Context) {
+	var form struct {
+		statsRangeForm
+		RuleKey string `json:"rule_key" form:"rule_key" binding:"required"`
+	}
+	if err := c.ShouldBindQuery(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	start, end, err := weixinservice.ParseStatsDateRange(form.StartDate, form.EndDate)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	list, err := weixinservice.GetReplyRuleMessageStats(ctx, appid, form.RuleKey, start, end)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"list": list})
+}
+
+// 没有匹配到关键词的文本，按出现次数倒序
+func (ctl *StatsController) Unmatched(c *gin.Context) {
+	var form struct {
+		statsRangeForm
+		Limit int `json:"limit" form:"limit"`
+	}
+	if err := c.ShouldBindQuery(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	start, end, err := weixinservice.ParseStatsDateRange(form.StartDate, form.EndDate)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	list, err := weixinservice.GetTopUnmatchedTexts(ctx, appid, start, end, statsLimit(form.Limit))
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"list": list})
+}
+
+// 命中次数的趋势
+func (ctl *StatsController) Trend(c *gin.Context) {
+	var form struct {
+		statsRangeForm
+		ReplyType string `json:"reply_type" form:"reply_type"`
+		RuleKey   string `json:"rule_key" form:"rule_key"`
+		Interval  string `json:"interval" form:"interval" binding:"omitempty,oneof=hour day"` // 默认 hour
+	}
+	if err := c.ShouldBindQuery(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	start, end, err := weixinservice.ParseStatsDateRange(form.StartDate, form.EndDate)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	list, err := weixinservice.GetReplyTrend(ctx, appid, form.ReplyType, form.RuleKey, start, end, form.Interval)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"list": list})
+}
+
+// 防重放拒绝的请求次数，按原因汇总
+func (ctl *StatsController) ReplayRejects(c *gin.Context) {
+	var form statsRangeForm
+	if err := c.ShouldBindQuery(&form); err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	start, end, err := weixinservice.ParseStatsDateRange(form.StartDate, form.EndDate)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	ctx, appid, err := ctl.newContext(c)
+	if err != nil {
+		ctl.returnFail(c, 1, err.Error())
+		return
+	}
+
+	list, err := weixinservice.GetReplayRejectStats(ctx, appid, start, end)
+	if ctl.checkError(c, err) != nil {
+		return
+	}
+
+	ctl.returnOk(c, gin.H{"list": list})
+}
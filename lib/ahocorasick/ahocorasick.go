@@ -0,0 +1,102 @@
+package ahocorasick
+
+/**
+ * Aho-Corasick 多模式串匹配
+ * 一次扫描文本，找出文本中包含的所有模式串，耗时和模式串的数量无关
+ */
+
+type node struct {
+	next   map[rune]int
+	fail   int
+	output []int // 在这个节点结束的模式串，包括 fail 链上的
+}
+
+type Matcher struct {
+	nodes    []node
+	patterns int
+}
+
+// 空的模式串会被忽略，返回的下标和传入的 patterns 对应
+func New(patterns []string) *Matcher {
+	m := &Matcher{
+		nodes:    []node{{next: map[rune]int{}}},
+		patterns: len(patterns),
+	}
+
+	for i, p := range patterns {
+		if p == "" {
+			continue
+		}
+		cur := 0
+		for _, r := range p {
+			nx, ok := m.nodes[cur].next[r]
+			if !ok {
+				m.nodes = append(m.nodes, node{next: map[rune]int{}})
+				nx = len(m.nodes) - 1
+				m.nodes[cur].next[r] = nx
+			}
+			cur = nx
+		}
+		m.nodes[cur].output = append(m.nodes[cur].output, i)
+	}
+
+	// 广度优先构造 fail 指针
+	queue := make([]int, 0, len(m.nodes))
+	for _, nx := range m.nodes[0].next {
+		queue = append(queue, nx)
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for r, nx := range m.nodes[cur].next {
+			f := m.nodes[cur].fail
+			for {
+				if t, ok := m.nodes[f].next[r]; ok && t != nx {
+					m.nodes[nx].fail = t
+					break
+				}
+				if f == 0 {
+					m.nodes[nx].fail = 0
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			fo := m.nodes[m.nodes[nx].fail].output
+			if len(fo) > 0 {
+				m.nodes[nx].output = append(m.nodes[nx].output, fo...)
+			}
+			queue = append(queue, nx)
+		}
+	}
+
+	return m
+}
+
+// 返回文本中出现过的模式串的下标，每个只返回一次，按第一次出现的位置排列
+func (m *Matcher) FindAll(text string) []int {
+	var ret []int
+	var seen map[int]bool
+	cur := 0
+	for _, r := range text {
+		for {
+			if nx, ok := m.nodes[cur].next[r]; ok {
+				cur = nx
+				break
+			}
+			if cur == 0 {
+				break
+			}
+			cur = m.nodes[cur].fail
+		}
+		for _, idx := range m.nodes[cur].output {
+			if seen == nil {
+				seen = make(map[int]bool)
+			}
+			if !seen[idx] {
+				seen[idx] = true
+				ret = append(ret, idx)
+			}
+		}
+	}
+	return ret
+}
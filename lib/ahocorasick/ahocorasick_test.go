@@ -0,0 +1,55 @@
+package ahocorasick
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindAll(t *testing.T) {
+	cases := []struct {
+		name     string
+		patterns []string
+		text     string
+		want     []int
+	}{
+		{"empty text", []string{"a"}, "", nil},
+		{"no patterns", nil, "abc", nil},
+		{"empty pattern ignored", []string{"", "b"}, "abc", []int{1}},
+		{"no match", []string{"xyz"}, "abc", nil},
+		{"overlapping", []string{"he", "she", "his", "hers"}, "ushers", []int{1, 0, 3}},
+		{"suffix via fail link", []string{"abcd", "bc"}, "abce", []int{1}},
+		{"nested", []string{"a", "ab", "abc"}, "abc", []int{0, 1, 2}},
+		{"repeated occurrence once", []string{"ab"}, "ababab", []int{0}},
+		{"duplicate patterns", []string{"ab", "ab"}, "xab", []int{0, 1}},
+		{"order by first occurrence", []string{"world", "hello"}, "hello world", []int{1, 0}},
+		{"chinese", []string{"你好", "好的", "谢谢"}, "你好的呀", []int{0, 1}},
+		{"case sensitive", []string{"Hello"}, "hello", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := New(c.patterns).FindAll(c.text)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("FindAll(%q) = %v, want %v", c.text, got, c.want)
+			}
+		})
+	}
+}
+
+// 和逐个 strings.Contains 的结果一致
+func TestFindAllMatchesContains(t *testing.T) {
+	patterns := []string{"a", "aa", "aab", "ba", "bab", "abab", "b", "c", "cab", "abc"}
+	texts := []string{"", "a", "aab", "babab", "cabcab", "ccc", "abcabcaab", "xyz"}
+	m := New(patterns)
+	for _, text := range texts {
+		got := make(map[int]bool)
+		for _, idx := range m.FindAll(text) {
+			got[idx] = true
+		}
+		for i, p := range patterns {
+			if want := strings.Contains(text, p); got[i] != want {
+				t.Errorf("FindAll(%q) pattern %q = %v, want %v", text, p, got[i], want)
+			}
+		}
+	}
+}
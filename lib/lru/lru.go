@@ -5,26 +5,43 @@ import (
 	"context"
 	"log"
 	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
+/**
+ * creator 在锁外执行，同一个 key 同时只执行一次，其他的等待同一个结果
+ * 避免 creator 调用外部接口时阻塞所有 key 的读取
+ */
+
 type CacheLRU[T any] struct {
 	maxCount int
+	ttl      time.Duration // 过期时间，0表示不过期
 	itemsMap sync.Map
 	list     *list.List
 	Lock     sync.Mutex
 
 	creator func(ctx context.Context, key string) (*T, error)
+	group   singleflight.Group
+	removed uint64 // Remove 的次数，创建期间有删除时不写入缓存，避免写入删除前的旧数据
 }
 
 // 多一层这个结构，是为了从list获得的元素取得key，然后再去map里面操作key
 type CacheLRUListItem[T any] struct {
 	Key         string
 	BusinessObj *T
+	CreatedAt   time.Time
 }
 
 func NewCacheLRU[T any](maxCount int, creator func(ctx context.Context, key string) (*T, error)) *CacheLRU[T] {
+	return NewCacheLRUWithTTL(maxCount, 0, creator)
+}
+
+func NewCacheLRUWithTTL[T any](maxCount int, ttl time.Duration, creator func(ctx context.Context, key string) (*T, error)) *CacheLRU[T] {
 	return &CacheLRU[T]{
 		maxCount: maxCount,
+		ttl:      ttl,
 		itemsMap: sync.Map{},
 		list:     list.New(),
 		Lock:     sync.Mutex{},
@@ -32,28 +49,78 @@ func NewCacheLRU[T any](maxCount int, creator func(ctx context.Context, key stri
 	}
 }
 
-func (c *CacheLRU[T]) Get(ctx context.Context, key string) (*T, error) {
+// 删除指定的key，下次 Get 时会重新创建
+func (c *CacheLRU[T]) Remove(key string) {
 	c.Lock.Lock()
 	defer c.Lock.Unlock()
 
-	elementPtr, ok := c.itemsMap.Load(key)
-	if ok {
-		// log.Println("found in map", key)
-		// log.Println("--------------------------------------------------")
-		element := elementPtr.(*list.Element)
-		c.list.Remove(element)
+	c.removed++
+	c.group.Forget(key)
+	c.remove(key)
+}
 
-		newElement := c.list.PushFront(element.Value)
-		c.itemsMap.Store(key, newElement)
+func (c *CacheLRU[T]) remove(key string) bool {
+	elementPtr, ok := c.itemsMap.Load(key)
+	if !ok {
+		return false
+	}
+	c.list.Remove(elementPtr.(*list.Element))
+	c.itemsMap.Delete(key)
+	return true
+}
 
-		lruItem, _ := element.Value.(*CacheLRUListItem[T])
-		return lruItem.BusinessObj, nil
+func (c *CacheLRU[T]) Get(ctx context.Context, key string) (*T, error) {
+	bo, removed, ok := c.load(key)
+	if ok {
+		return bo, nil
 	}
 
-	bo, err := c.creator(ctx, key)
+	v, err, _ := c.group.Do(key, func() (any, error) {
+		bo, err := c.creator(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		c.store(key, bo, removed)
+		return bo, nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return v.(*T), nil
+}
+
+// 查找没有过期的元素，同时返回当前的删除次数
+func (c *CacheLRU[T]) load(key string) (*T, uint64, bool) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	elementPtr, ok := c.itemsMap.Load(key)
+	if !ok {
+		return nil, c.removed, false
+	}
+	element := elementPtr.(*list.Element)
+	lruItem, _ := element.Value.(*CacheLRUListItem[T])
+
+	if c.ttl > 0 && time.Since(lruItem.CreatedAt) > c.ttl {
+		// 已过期，删除后重新创建
+		c.remove(key)
+		return nil, c.removed, false
+	}
+
+	c.list.Remove(element)
+	newElement := c.list.PushFront(element.Value)
+	c.itemsMap.Store(key, newElement)
+	return lruItem.BusinessObj, c.removed, true
+}
+
+func (c *CacheLRU[T]) store(key string, bo *T, removed uint64) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	if c.removed != removed {
+		return
+	}
+	c.remove(key)
 
 	// log.Println("not found in map", key)
 	// 如果没有找到，新建一个，然后插入进去
@@ -74,11 +141,10 @@ func (c *CacheLRU[T]) Get(ctx context.Context, key string) (*T, error) {
 	lruItem := &CacheLRUListItem[T]{
 		Key:         key,
 		BusinessObj: bo,
+		CreatedAt:   time.Now(),
 	}
 	newElement := c.list.PushFront(lruItem)
 	c.itemsMap.Store(key, newElement)
 	log.Println("lru create new one and insert front", key)
 	// log.Println("--------------------------------------------------")
-
-	return bo, nil
 }
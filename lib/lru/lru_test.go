@@ -0,0 +1,95 @@
+package lru
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetCreatesOncePerKey(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	c := NewCacheLRU(10, func(ctx context.Context, key string) (*string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &key, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.Get(context.Background(), "a")
+			if err != nil || *v != "a" {
+				t.Errorf("Get = %v, %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("creator called %d times, want 1", n)
+	}
+}
+
+func TestGetNotBlockedBySlowCreator(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	c := NewCacheLRU(10, func(ctx context.Context, key string) (*string, error) {
+		if key == "slow" {
+			<-release
+		}
+		return &key, nil
+	})
+
+	go c.Get(context.Background(), "slow")
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		c.Get(context.Background(), "fast")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Get blocked by another key's creator")
+	}
+}
+
+func TestRemoveDuringCreateSkipsStore(t *testing.T) {
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	c := NewCacheLRU(10, func(ctx context.Context, key string) (*int32, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 1 {
+			close(started)
+			<-release
+		}
+		return &n, nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		c.Get(context.Background(), "a")
+		close(done)
+	}()
+	<-started
+	c.Remove("a")
+	close(release)
+	<-done
+
+	v, err := c.Get(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *v != 2 {
+		t.Fatalf("got value from creator call %d, want 2", *v)
+	}
+}
@@ -0,0 +1,173 @@
+package weixin
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+)
+
+/**
+ * 异步回复
+ * 微信要求5秒内响应，开启后先在限定时间内计算被动回复，超时就先回 success，
+ * 剩余的消息交给后台队列，通过客服接口发送，失败会重试，并记录发送结果
+ *
+ * WX_ASYNC_REPLY=1 开启
+ * WX_REPLY_DEADLINE_MS 计算被动回复的限定时间，默认 4000 毫秒，同步回复时请求内调用外部接口也不能超过这个时间
+ */
+
+const (
+	customMessageQueueSize   = 1000
+	customMessageWorkerCount = 4
+	customMessageMaxAttempts = 3
+)
+
+var asyncReplyEnabled bool
+var replyDeadline = 4000 * time.Millisecond
+
+type customMessageJob struct {
+	AppID  string
+	OpenID string
+	Msg    *weixinservice.AutoReplyMessage
+	Source string
+}
+
+var customMessageQueue chan *customMessageJob
+
+func initAsyncReply() {
+	asyncReplyEnabled = os.Getenv("WX_ASYNC_REPLY") == "1"
+
+	if str := os.Getenv("WX_REPLY_DEADLINE_MS"); str != "" {
+		ms, err := strconv.Atoi(str)
+		if err != nil || ms <= 0 {
+			log.Println("initAsyncReply WX_REPLY_DEADLINE_MS invalid", str)
+		} else {
+			replyDeadline = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	customMessageQueue = make(chan *customMessageJob, customMessageQueueSize)
+	for i := 0; i < customMessageWorkerCount; i++ {
+		go customMessageWorker()
+	}
+	log.Println("initAsyncReply", "enabled", asyncReplyEnabled, "deadline", replyDeadline)
+}
+
+const replyContextKey = "reply_ctx"
+
+// 给请求加上 replyDeadline 的期限，请求内同步调用外部接口时用 replyContext 取出，剩余的时间不够就不调用
+func replyDeadlineMiddleware() msghandler.Middleware {
+	return func(next msghandler.MsgHandlerFunc) msghandler.MsgHandlerFunc {
+		return func(rc *msghandler.ReplyCtrl, msg msghandler.Message) {
+			ctx, cancel := context.WithTimeout(rc.GetGinContext().Request.Context(), replyDeadline)
+			defer cancel()
+			rc.Set(replyContextKey, ctx)
+			next(rc, msg)
+		}
+	}
+}
+
+func replyContext(rc *msghandler.ReplyCtrl) context.Context {
+	if v, ok := rc.Get(replyContextKey); ok {
+		return v.(context.Context)
+	}
+	return context.Background()
+}
+
+// 放入后台队列，通过客服接口发送
+func EnqueueCustomMessage(appid, openid string, msg *weixinservice.AutoReplyMessage, source string) bool {
+	job := &customMessageJob{
+		AppID:  appid,
+		OpenID: openid,
+		Msg:    msg,
+		Source: source,
+	}
+	select {
+	case customMessageQueue <- job:
+		return true
+	default:
+		log.Println("EnqueueCustomMessage queue is full", appid, openid, msg.MsgType)
+		saveCustomSendLog(job, 0, "queue is full")
+		return false
+	}
+}
+
+func customMessageWorker() {
+	for job := range customMessageQueue {
+		deliverCustomMessage(job)
+	}
+}
+
+func deliverCustomMessage(job *customMessageJob) {
+	data := BuildCustomMessage(job.Msg)
+	if data == nil {
+		saveCustomSendLog(job, 0, "unsupported msg_type")
+		return
+	}
+
+	var err error
+	attempts := 0
+	for attempts < customMessageMaxAttempts {
+		attempts++
+		err = sendCustomMessage(job.AppID, job.OpenID, data)
+		if err == nil {
+			break
+		}
+		log.Println("deliverCustomMessage error", job.AppID, job.OpenID, attempts, err)
+		if attempts < customMessageMaxAttempts {
+			// 1s 2s 4s ...
+			time.Sleep(time.Duration(1<<(attempts-1)) * time.Second)
+		}
+	}
+
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	} else {
+		saveOutboundMessage(job.AppID, job.OpenID, "custom", data)
+	}
+	saveCustomSendLog(job, attempts, errStr)
+}
+
+func sendCustomMessage(appid, openid string, data map[string]any) error {
+	ctx := context.Background()
+	wxApiClient, err := GetWxApiClient(ctx, appid)
+	if err != nil {
+		return err
+	}
+	return wxApiClient.SendCustomMessage(ctx, openid, data)
+}
+
+// 记录发送结果
+func saveCustomSendLog(job *customMessageJob, attempts int, errStr string) {
+	msgData, err := json.Marshal(job.Msg)
+	if err != nil {
+		log.Println("saveCustomSendLog json.Marshal error", err)
+	}
+
+	status := "success"
+	if errStr != "" {
+		status = "fail"
+	}
+
+	doc := &mongodb.EntityWxCustomSendLog{
+		AppID:    job.AppID,
+		OpenID:   job.OpenID,
+		MsgType:  job.Msg.MsgType,
+		MsgData:  string(msgData),
+		Status:   status,
+		Attempts: attempts,
+		Error:    errStr,
+		Source:   job.Source,
+	}
+	_, err = mongodb.ModelWxCustomSendLog.InsertOne(context.Background(), doc)
+	if err != nil {
+		log.Println("saveCustomSendLog InsertOne error", err)
+	}
+}
@@ -0,0 +1,123 @@
+package weixin
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	forwardservice "github.com/anchel/wechat-official-account-admin/services/forward-service"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+)
+
+/**
+ * 转发消息给业务系统
+ * 普通的转发目标放入后台队列，由固定数量的 worker 投递，失败会重试，队列满了直接丢弃并记录
+ * 设置了 use_as_reply 的目标在请求内同步调用一次，返回的内容作为被动回复，
+ * 没有返回内容或者调用失败，继续走后面的处理。同步调用的超时时间不超过请求剩余的时间
+ */
+
+const (
+	forwardQueueSize   = 1000
+	forwardWorkerCount = 4
+	forwardJobTimeout  = 2 * time.Minute // 一次投递包括重试的最长时间，避免一直失败的目标占住 worker
+)
+
+type forwardJob struct {
+	Target  *mongodb.EntityWxForwardTarget
+	Payload *forwardservice.ForwardPayload
+}
+
+var forwardQueue chan *forwardJob
+
+func initForwardQueue() {
+	forwardQueue = make(chan *forwardJob, forwardQueueSize)
+	for i := 0; i < forwardWorkerCount; i++ {
+		go forwardWorker()
+	}
+}
+
+// 放入后台队列投递
+func enqueueForward(target *mongodb.EntityWxForwardTarget, payload *forwardservice.ForwardPayload) bool {
+	select {
+	case forwardQueue <- &forwardJob{Target: target, Payload: payload}:
+		return true
+	default:
+		log.Println("enqueueForward queue is full", payload.AppID, target.Url)
+		forwardservice.RecordDropped(target, payload, "queue is full")
+		return false
+	}
+}
+
+func forwardWorker() {
+	for job := range forwardQueue {
+		ctx, cancel := context.WithTimeout(context.Background(), forwardJobTimeout)
+		_, err := forwardservice.Deliver(ctx, job.Target, job.Payload, job.Target.MaxRetries)
+		cancel()
+		if err != nil {
+			log.Println("forwardWorker Deliver error", job.Target.Url, err)
+		}
+	}
+}
+
+func forwardMiddleware() msghandler.Middleware {
+	return func(next msghandler.MsgHandlerFunc) msghandler.MsgHandlerFunc {
+		return func(rc *msghandler.ReplyCtrl, msg msghandler.Message) {
+			if msg == nil {
+				next(rc, msg)
+				return
+			}
+
+			appid := rc.GetMsgHandler().GetMpOptions().AppId
+			ctx := context.Background()
+
+			targets, err := forwardservice.GetEnabledTargets(ctx, appid)
+			if err != nil {
+				log.Println("forwardMiddleware GetEnabledTargets error", err)
+				next(rc, msg)
+				return
+			}
+
+			payload := forwardservice.NewForwardPayload(appid, msg)
+
+			var replyTarget *mongodb.EntityWxForwardTarget
+			for _, target := range targets {
+				// 外部回复只在关键词没有匹配到时调用
+				if target.UseAsFallback || !forwardservice.MatchTarget(target, payload) {
+					continue
+				}
+				if target.UseAsReply && replyTarget == nil {
+					replyTarget = target
+					continue
+				}
+				enqueueForward(target, payload)
+			}
+
+			if replyTarget != nil {
+				msgList := getForwardReplyMessages(replyContext(rc), replyTarget, payload)
+				if len(msgList) > 0 {
+					DoReply(rc, msgList, asyncReplyEnabled)
+					return
+				}
+			}
+
+			next(rc, msg)
+		}
+	}
+}
+
+// 同步调用，不重试，避免超过微信的5秒限制
+func getForwardReplyMessages(ctx context.Context, target *mongodb.EntityWxForwardTarget, payload *forwardservice.ForwardPayload) []*weixinservice.AutoReplyMessage {
+	body, err := forwardservice.DeliverForReply(ctx, target, payload)
+	if err != nil {
+		log.Println("getForwardReplyMessages Deliver error", target.Url, err)
+		return nil
+	}
+	msgList, err := forwardservice.ParseReplyMessages(body)
+	if err != nil {
+		log.Println("getForwardReplyMessages ParseReplyMessages error", target.Url, err)
+		return nil
+	}
+	return msgList
+}
@@ -0,0 +1,63 @@
+package weixin
+
+import (
+	"context"
+	"log"
+
+	forwardservice "github.com/anchel/wechat-official-account-admin/services/forward-service"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"github.com/redis/go-redis/v9"
+)
+
+/**
+ * 公众号配置修改或删除后，清除缓存的 MsgHandler 和 WxApi
+ * 关键词规则修改后，清除编译好的关键词匹配器
+ * 转发目标修改后，清除缓存的启用目标
+ * 通过 redis 的发布订阅通知到所有节点
+ */
+
+const appidInvalidateChannel = "woaa_appid_invalidate"
+const keywordInvalidateChannel = "woaa_keyword_invalidate"
+const forwardInvalidateChannel = "woaa_forward_invalidate"
+
+func invalidateLocal(appid string) {
+	log.Println("weixin invalidate appid cache", appid)
+	lruMsgHandler.Remove(appid)
+	lruWxApiClient.Remove(appid)
+}
+
+// 清除所有节点上这个公众号的缓存
+func InvalidateAppID(ctx context.Context, appid string) error {
+	invalidateLocal(appid)
+	return weixinRdb.Publish(ctx, appidInvalidateChannel, appid).Err()
+}
+
+// 清除所有节点上这个公众号的关键词匹配器
+func InvalidateKeywordRules(ctx context.Context, appid string) error {
+	weixinservice.InvalidateKeywordMatcher(appid)
+	return weixinRdb.Publish(ctx, keywordInvalidateChannel, appid).Err()
+}
+
+// 清除所有节点上这个公众号的转发目标
+func InvalidateForwardTargets(ctx context.Context, appid string) error {
+	forwardservice.InvalidateTargets(appid)
+	return weixinRdb.Publish(ctx, forwardInvalidateChannel, appid).Err()
+}
+
+func subscribeInvalidate(rdb *redis.Client) {
+	pubsub := rdb.Subscribe(context.Background(), appidInvalidateChannel, keywordInvalidateChannel, forwardInvalidateChannel)
+	go func() {
+		defer pubsub.Close()
+		// 断线后 go-redis 会自动重连并重新订阅
+		for msg := range pubsub.Channel() {
+			switch msg.Channel {
+			case appidInvalidateChannel:
+				invalidateLocal(msg.Payload)
+			case keywordInvalidateChannel:
+				weixinservice.InvalidateKeywordMatcher(msg.Payload)
+			case forwardInvalidateChannel:
+				forwardservice.InvalidateTargets(msg.Payload)
+			}
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package weixin
+
+import (
+	"context"
+	"log"
+
+	util "github.com/anchel/wechat-official-account-admin/lib/utils"
+	appidservice "github.com/anchel/wechat-official-account-admin/services/appid-service"
+	messageservice "github.com/anchel/wechat-official-account-admin/services/message-service"
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+)
+
+/**
+ * 粉丝发来的图片、语音、视频，在微信侧只保留3天
+ * 公众号开启自动下载后，收到消息就在后台下载到 files/wx-download-media 下，并关联到消息记录
+ */
+
+// 同时下载的数量，避免消息多的时候占满带宽
+var mediaDownloadSem = make(chan struct{}, 4)
+
+func downloadInboundMedia(appid, messageId string, msg msghandler.Message) {
+	mediaType, mediaId := messageservice.GetMessageMedia(msg)
+	if mediaId == "" {
+		return
+	}
+
+	ctx := context.Background()
+	enabled, err := appidservice.GetAppMediaDownloadEnabled(ctx, appid)
+	if err != nil {
+		log.Println("downloadInboundMedia GetAppMediaDownloadEnabled error", err)
+		return
+	}
+	if !enabled {
+		return
+	}
+
+	mediaDownloadSem <- struct{}{}
+	defer func() { <-mediaDownloadSem }()
+
+	filePath, err := saveInboundMedia(ctx, appid, mediaType, mediaId)
+	if err != nil {
+		log.Println("downloadInboundMedia error", appid, mediaId, err)
+		err = messageservice.SetMessageMediaFile(ctx, messageId, "fail", "")
+	} else {
+		err = messageservice.SetMessageMediaFile(ctx, messageId, "done", filePath)
+	}
+	if err != nil {
+		log.Println("downloadInboundMedia SetMessageMediaFile error", err)
+	}
+}
+
+// 下载临时素材并保存，返回文件的url路径
+func saveInboundMedia(ctx context.Context, appid, mediaType, mediaId string) (string, error) {
+	wxApiClient, err := GetWxApiClient(ctx, appid)
+	if err != nil {
+		return "", err
+	}
+
+	data, retMap, err := wxApiClient.DownloadTempMaterial(ctx, mediaId)
+	if err != nil {
+		return "", err
+	}
+
+	ext := retMap["extension"]
+	if ext == "" {
+		ext = util.GetExtByMediaType(mediaType)
+	}
+
+	distFilePath, filePath, err := util.GetWxDownloadMediaFilePath("inbound-", ext, mediaId)
+	if err != nil {
+		return "", err
+	}
+
+	err = util.SaveFile(distFilePath, data)
+	if err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
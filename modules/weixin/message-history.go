@@ -0,0 +1,49 @@
+package weixin
+
+import (
+	"context"
+	"log"
+
+	messageservice "github.com/anchel/wechat-official-account-admin/services/message-service"
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+)
+
+/**
+ * 保存消息记录
+ * 粉丝发来的消息和事件通过中间件保存，回复的消息通过 MsgHandler 的回调保存
+ * 写库都放到协程中，不占用给微信服务器回包的时间
+ */
+
+func messageHistoryMiddleware() msghandler.Middleware {
+	return func(next msghandler.MsgHandlerFunc) msghandler.MsgHandlerFunc {
+		return func(rc *msghandler.ReplyCtrl, msg msghandler.Message) {
+			if msg != nil {
+				appid := rc.GetMsgHandler().GetMpOptions().AppId
+				go func() {
+					id, err := messageservice.SaveInboundMessage(context.Background(), appid, msg)
+					if err != nil {
+						log.Println("messageHistoryMiddleware SaveInboundMessage error", err)
+						return
+					}
+					downloadInboundMedia(appid, id, msg)
+				}()
+			}
+			next(rc, msg)
+		}
+	}
+}
+
+func messageHistoryReplyHook(rc *msghandler.ReplyCtrl, replyMode string, data any) {
+	appid := rc.GetMsgHandler().GetMpOptions().AppId
+	openid := rc.GetMsg().GetFromUserName()
+	saveOutboundMessage(appid, openid, replyMode, data)
+}
+
+func saveOutboundMessage(appid, openid, replyMode string, data any) {
+	go func() {
+		_, err := messageservice.SaveOutboundMessage(context.Background(), appid, openid, replyMode, data)
+		if err != nil {
+			log.Println("saveOutboundMessage error", err)
+		}
+	}()
+}
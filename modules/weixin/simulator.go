@@ -0,0 +1,207 @@
+package weixin
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"github.com/anchel/wechat-official-account-admin/wxmp/common"
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+	"github.com/gin-gonic/gin"
+)
+
+/**
+ * 模拟器
+ * 构造一条带签名（可选加密）的消息，走和真实推送一样的 MsgHandler.Serve 流程，
+ * 返回给微信服务器的回包，以及会通过客服接口发送的消息，但不会真的调用微信接口
+ */
+
+const simulatorContextKey = "wx_simulator"
+
+const SimulatorOpenID = "simulator_openid"
+
+var simulatorMsgHandlerFunc msghandler.MsgHandlerFunc
+
+// 当前请求是否来自模拟器
+func IsSimulator(rc *msghandler.ReplyCtrl) bool {
+	return rc.GetGinContext().GetBool(simulatorContextKey)
+}
+
+type SimulateRequest struct {
+	OpenID   string `json:"openid" form:"openid"`
+	Format   string `json:"format" form:"format"` // xml, json。默认xml
+	Encrypt  bool   `json:"encrypt" form:"encrypt"`
+	MsgType  string `json:"msg_type" form:"msg_type" binding:"required"` // text image voice video shortvideo event
+	Content  string `json:"content" form:"content"`
+	MediaId  string `json:"media_id" form:"media_id"`
+	PicUrl   string `json:"pic_url" form:"pic_url"`
+	Event    string `json:"event" form:"event"`
+	EventKey string `json:"event_key" form:"event_key"`
+}
+
+type SimulateResult struct {
+	RequestBody      string           `json:"request_body"`
+	ReplyStatus      int              `json:"reply_status"`
+	ReplyContentType string           `json:"reply_content_type"`
+	ReplyBody        string           `json:"reply_body"`
+	ReplyPlain       string           `json:"reply_plain"` // 加密时是解密后的回包，否则和 reply_body 一样
+	CustomMessages   []map[string]any `json:"custom_messages"`
+}
+
+func buildSimulateMessage(appid string, req *SimulateRequest) (msghandler.Message, error) {
+	now := time.Now().Unix()
+	msgId := time.Now().UnixNano()
+	switch req.MsgType {
+	case "text":
+		return &msghandler.MessageText{ToUserName: appid, FromUserName: req.OpenID, CreateTime: now, MsgType: "text", Content: req.Content, MsgId: msgId}, nil
+	case "image":
+		return &msghandler.MessageImage{ToUserName: appid, FromUserName: req.OpenID, CreateTime: now, MsgType: "image", PicUrl: req.PicUrl, MediaId: req.MediaId, MsgId: msgId}, nil
+	case "voice":
+		return &msghandler.MessageVoice{ToUserName: appid, FromUserName: req.OpenID, CreateTime: now, MsgType: "voice", MediaId: req.MediaId, MsgId: msgId}, nil
+	case "video":
+		return &msghandler.MessageVideo{ToUserName: appid, FromUserName: req.OpenID, CreateTime: now, MsgType: "video", MediaId: req.MediaId, MsgId: msgId}, nil
+	case "shortvideo":
+		return &msghandler.MessageShortVideo{ToUserName: appid, FromUserName: req.OpenID, CreateTime: now, MsgType: "shortvideo", MediaId: req.MediaId, MsgId: msgId}, nil
+	case "event":
+		if req.Event == "" {
+			return nil, errors.New("event is required")
+		}
+		return &msghandler.MessageEvent{ToUserName: appid, FromUserName: req.OpenID, CreateTime: now, MsgType: "event", Event: req.Event, EventKey: req.EventKey}, nil
+	}
+	return nil, errors.New("msg_type not supported")
+}
+
+func marshalByFormat(format string, v any) ([]byte, error) {
+	if format == "json" {
+		return json.Marshal(v)
+	}
+	return xml.Marshal(v)
+}
+
+func Simulate(ctx context.Context, appid string, req *SimulateRequest) (*SimulateResult, error) {
+	if req.OpenID == "" {
+		req.OpenID = SimulatorOpenID
+	}
+	if req.Format != "json" {
+		req.Format = "xml"
+	}
+
+	options, err := GetMpOptions(ctx, appid)
+	if err != nil {
+		return nil, err
+	}
+	if req.Encrypt && options.AesKey == "" {
+		return nil, errors.New("encoding_aes_key is empty")
+	}
+
+	msg, err := buildSimulateMessage(appid, req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := marshalByFormat(req.Format, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := fmt.Sprint(time.Now().Unix())
+	nonce := fmt.Sprint(rand.Int63())
+	query := url.Values{}
+	query.Set("timestamp", timestamp)
+	query.Set("nonce", nonce)
+	query.Set("openid", req.OpenID)
+	query.Set("signature", common.GenerateSignature(options.Token, timestamp, nonce))
+
+	if req.Encrypt {
+		encrypted, err := common.AesEncryptWechat(options.AesKey, options.AppId, body)
+		if err != nil {
+			return nil, err
+		}
+		body, err = marshalByFormat(req.Format, &msghandler.EncryptMessage{ToUserName: appid, Encrypt: encrypted})
+		if err != nil {
+			return nil, err
+		}
+		query.Set("encrypt_type", "aes")
+		query.Set("msg_signature", common.GenerateSignature(options.Token, timestamp, nonce, encrypted))
+	}
+
+	httpReq, err := http.NewRequest("POST", fmt.Sprint("/wxmp/", appid, "/handler?", query.Encode()), strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	if req.Format == "json" {
+		httpReq.Header.Set("Content-Type", "application/json")
+	} else {
+		httpReq.Header.Set("Content-Type", "text/xml")
+	}
+
+	result := &SimulateResult{
+		RequestBody:    string(body),
+		CustomMessages: make([]map[string]any, 0),
+	}
+
+	// 客服消息只记录，不发送
+	var lock sync.Mutex
+	handler := msghandler.NewMsgHandler(options, nil)
+	handler.SetHandler(simulatorMsgHandlerFunc)
+	handler.SetCustomSender(func(rc *msghandler.ReplyCtrl, data map[string]any) error {
+		lock.Lock()
+		defer lock.Unlock()
+		result.CustomMessages = append(result.CustomMessages, data)
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httpReq
+	c.Set(simulatorContextKey, true)
+	handler.Serve(c)
+
+	result.ReplyStatus = w.Code
+	result.ReplyContentType = w.Header().Get("Content-Type")
+	result.ReplyBody = w.Body.String()
+	result.ReplyPlain = result.ReplyBody
+
+	if req.Encrypt && result.ReplyBody != "success" {
+		var encryptReply msghandler.EncryptReplyMessage
+		if req.Format == "json" {
+			err = json.Unmarshal(w.Body.Bytes(), &encryptReply)
+		} else {
+			err = xml.Unmarshal(w.Body.Bytes(), &encryptReply)
+		}
+		if err == nil && encryptReply.Encrypt != "" {
+			plain, _, err := common.AesDecryptWechat(options.AesKey, encryptReply.Encrypt)
+			if err != nil {
+				return nil, err
+			}
+			result.ReplyPlain = string(plain)
+		}
+	}
+
+	return result, nil
+}
+
+/**
+ * 解释模拟的消息会命中哪条规则，不走 MsgHandler，不会发送消息，也不处理关注等事件
+ * @param rules 为nil时使用已发布的规则，传入草稿发布后的规则可以预先检查草稿
+ */
+func Explain(ctx context.Context, appid string, req *SimulateRequest, rules []*mongodb.EntityWeixinAutoReply) (*weixinservice.ExplainResult, error) {
+	if req.OpenID == "" {
+		req.OpenID = SimulatorOpenID
+	}
+	msg, err := buildSimulateMessage(appid, req)
+	if err != nil {
+		return nil, err
+	}
+	return weixinservice.ExplainReply(ctx, appid, msg, rules)
+}
@@ -0,0 +1,70 @@
+package weixin
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/lib/lru"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"github.com/anchel/wechat-official-account-admin/wxmp/wxapi"
+)
+
+/**
+ * 从微信接口获取粉丝的备注和标签，给自动回复的模板变量用
+ * 粉丝信息和标签列表缓存一段时间，避免每条回复都调用微信接口，后台修改备注和标签后最多延迟 templateVarsCacheTTL 生效
+ */
+
+const templateVarsCacheTTL = 5 * time.Minute
+
+// key 为 appid:openid
+var lruTemplateUserInfo = lru.NewCacheLRUWithTTL[wxapi.UserInfo](10000, templateVarsCacheTTL, func(ctx context.Context, key string) (*wxapi.UserInfo, error) {
+	appid, openid, _ := strings.Cut(key, ":")
+	wxApiClient, err := GetWxApiClient(ctx, appid)
+	if err != nil {
+		return nil, err
+	}
+	return wxApiClient.GetUserInfo(ctx, openid)
+})
+
+// key 为 appid，值为标签id对应的名称
+var lruTemplateTagNames = lru.NewCacheLRUWithTTL[map[int]string](100, templateVarsCacheTTL, func(ctx context.Context, appid string) (*map[int]string, error) {
+	wxApiClient, err := GetWxApiClient(ctx, appid)
+	if err != nil {
+		return nil, err
+	}
+	tagList, err := wxApiClient.GetTagList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tagNames := make(map[int]string)
+	for _, tag := range tagList {
+		tagNames[tag.Id] = tag.Name
+	}
+	return &tagNames, nil
+})
+
+func templateVarsProvider(ctx context.Context, appid, openid string, vars weixinservice.TemplateVars) error {
+	info, err := lruTemplateUserInfo.Get(ctx, appid+":"+openid)
+	if err != nil {
+		return err
+	}
+	vars["remark"] = info.Remark
+
+	if len(info.TagIdList) <= 0 {
+		vars["tags"] = ""
+		return nil
+	}
+	tagNames, err := lruTemplateTagNames.Get(ctx, appid)
+	if err != nil {
+		return err
+	}
+	var tags []string
+	for _, id := range info.TagIdList {
+		if name, ok := (*tagNames)[id]; ok {
+			tags = append(tags, name)
+		}
+	}
+	vars["tags"] = strings.Join(tags, "、")
+	return nil
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"errors"
 	"log"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/anchel/wechat-official-account-admin/lib/lru"
 	appidservice "github.com/anchel/wechat-official-account-admin/services/appid-service"
+	flowservice "github.com/anchel/wechat-official-account-admin/services/flow-service"
+	forwardservice "github.com/anchel/wechat-official-account-admin/services/forward-service"
 	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
 	mpoptions "github.com/anchel/wechat-official-account-admin/wxmp/mp-options"
 	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
@@ -21,19 +26,100 @@ var lruWxApiClient *lru.CacheLRU[wxapi.WxApi]
 
 const max_count = 2
 
+// 缓存的过期时间，避免没收到失效通知时一直使用旧的配置
+const cache_ttl = 10 * time.Minute
+
+var weixinRdb *redis.Client
+
+type MsgRouteInitFunc func(*msghandler.Router)
+
+var msgRouteInitFuncs []MsgRouteInitFunc
+
+// 注册自定义的消息路由和中间件，需要在 InitWeixin 之前调用，例如在 init 中
+func AddMsgRouteInitFunc(f MsgRouteInitFunc) {
+	msgRouteInitFuncs = append(msgRouteInitFuncs, f)
+}
+
+// simulate 为 true 时是给模拟器用的，不排重、不限流、不保存消息记录
+func newMsgRouter(rdb *redis.Client, simulate bool) *msghandler.Router {
+	router := msghandler.NewRouter()
+	router.Use(msghandler.RecoveryMiddleware(), msghandler.LoggingMiddleware(), replyDeadlineMiddleware())
+	if !simulate {
+		router.Use(msghandler.DedupMiddleware(msghandler.NewRedisDeduplicator(rdb)), messageHistoryMiddleware())
+	}
+
+	// 每个用户每分钟最多处理的消息数，不配置则不限流
+	if str := os.Getenv("WX_RATE_LIMIT_PER_MINUTE"); str != "" && !simulate {
+		limit, err := strconv.Atoi(str)
+		if err != nil || limit <= 0 {
+			log.Println("newMsgRouter WX_RATE_LIMIT_PER_MINUTE invalid", str)
+		} else {
+			router.Use(msghandler.RateLimitMiddleware(msghandler.NewRedisRateLimiter(rdb, int64(limit), time.Minute)))
+		}
+	}
+
+	// 转发给业务系统，放在限流之后
+	if !simulate {
+		router.Use(forwardMiddleware())
+	}
+
+	// 没有被自定义路由处理的，走自动回复
+	router.Fallback(MsgHandlerFunc)
+
+	for _, f := range msgRouteInitFuncs {
+		f(router)
+	}
+	return router
+}
+
+// 允许的时间偏差，默认300秒，配置为0则不做防重放校验
+func newReplayGuard(rdb *redis.Client) *msghandler.ReplayGuard {
+	window := 300
+	if str := os.Getenv("WX_REPLAY_WINDOW_SECONDS"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			log.Println("newReplayGuard WX_REPLAY_WINDOW_SECONDS invalid", str)
+		} else {
+			window = n
+		}
+	}
+	if window == 0 {
+		return nil
+	}
+	guard := msghandler.NewReplayGuard(time.Duration(window)*time.Second, msghandler.NewRedisNonceStore(rdb))
+	guard.SetRejectHook(weixinservice.RecordReplayReject)
+	return guard
+}
+
 func InitWeixin(rdb *redis.Client) error {
+	weixinRdb = rdb
 
-	lruMsgHandler = lru.NewCacheLRU[msghandler.MsgHandler](max_count, func(ctx context.Context, appid string) (*msghandler.MsgHandler, error) {
+	initAsyncReply()
+	initForwardQueue()
+	weixinservice.SetTemplateVarsProvider(templateVarsProvider)
+	weixinservice.SetFallbackResponder(forwardservice.FallbackResponder)
+	weixinservice.InitReplySelector(rdb)
+	flowservice.Init(rdb)
+
+	replayGuard := newReplayGuard(rdb)
+	msgHandlerFunc := newMsgRouter(rdb, false).Handler()
+	simulatorMsgHandlerFunc = newMsgRouter(rdb, true).Handler()
+
+	lruMsgHandler = lru.NewCacheLRUWithTTL[msghandler.MsgHandler](max_count, cache_ttl, func(ctx context.Context, appid string) (*msghandler.MsgHandler, error) {
 		options, err := GetMpOptions(ctx, appid)
 		if err != nil {
 			return nil, err
 		}
 		wxMsgHandler := msghandler.NewMsgHandler(options, wxapi.NewWxApi(options, rdb))
-		wxMsgHandler.SetHandler(MsgHandlerFunc)
+		wxMsgHandler.SetHandler(msgHandlerFunc)
+		wxMsgHandler.SetReplyHook(messageHistoryReplyHook)
+		if replayGuard != nil {
+			wxMsgHandler.SetReplayGuard(replayGuard)
+		}
 		return wxMsgHandler, nil
 	})
 
-	lruWxApiClient = lru.NewCacheLRU[wxapi.WxApi](max_count, func(ctx context.Context, appid string) (*wxapi.WxApi, error) {
+	lruWxApiClient = lru.NewCacheLRUWithTTL[wxapi.WxApi](max_count, cache_ttl, func(ctx context.Context, appid string) (*wxapi.WxApi, error) {
 		options, err := GetMpOptions(ctx, appid)
 		if err != nil {
 			return nil, err
@@ -41,6 +127,8 @@ func InitWeixin(rdb *redis.Client) error {
 		return wxapi.NewWxApi(options, rdb), nil
 	})
 
+	subscribeInvalidate(rdb)
+
 	return nil
 }
 
@@ -91,42 +179,104 @@ func MsgHandlerFunc(rc *msghandler.ReplyCtrl, msg msghandler.Message) {
 	msgType := msg.GetMsgType() // text image voice video shortvideo location link event
 	log.Println(" MsgHandlerFunc msgType", msgType)
 
-	if msgType == "event" {
-		msgEvent := msg.(*msghandler.MessageEvent)
+	appid := rc.GetMsgHandler().GetMpOptions().AppId
+	simulate := IsSimulator(rc)
+
+	// 模拟器直接同步处理，客服消息由模拟器拦截
+	if !asyncReplyEnabled || simulate {
+		msgList, err := GetReplyMessages(replyContext(rc), appid, msg, simulate)
+		if err != nil {
+			rc.GetGinContext().JSON(200, err)
+			return
+		}
+		DoReply(rc, msgList, false)
+		return
+	}
+
+	// 异步模式，限定时间内没算出回复，就先回 success，后面的交给后台队列
+	type replyResult struct {
+		msgList []*weixinservice.AutoReplyMessage
+		err     error
+	}
+	ch := make(chan *replyResult, 1)
+	go func() {
+		// 超时后剩余的消息还要通过客服接口发送，不能用请求的期限
+		msgList, err := GetReplyMessages(context.Background(), appid, msg, false)
+		ch <- &replyResult{msgList: msgList, err: err}
+	}()
+
+	select {
+	case ret := <-ch:
+		if ret.err != nil {
+			rc.GetGinContext().JSON(200, ret.err)
+			return
+		}
+		DoReply(rc, ret.msgList, true)
+	case <-time.After(replyDeadline):
+		log.Println("MsgHandlerFunc reply deadline exceeded, fallback to custom message", appid)
+		rc.GetGinContext().String(200, "success")
+
+		openid := msg.GetFromUserName()
+		go func() {
+			ret := <-ch
+			if ret.err != nil {
+				log.Println("MsgHandlerFunc GetReplyMessages error", ret.err)
+				return
+			}
+			for _, m := range ret.msgList {
+				EnqueueCustomMessage(appid, openid, m, "async_reply")
+			}
+		}()
+	}
+}
+
+// 处理事件，并获取需要回复的消息列表
+// dryRun 为 true 时只获取回复，不处理事件，例如不记录关注状态
+// ctx 带有被动回复的期限，同步调用外部接口时用
+func GetReplyMessages(ctx context.Context, appid string, msg msghandler.Message, dryRun bool) ([]*weixinservice.AutoReplyMessage, error) {
+	// 在对话流程中的粉丝，消息优先交给流程处理
+	if !dryRun {
+		msgList, handled, err := flowservice.HandleMessage(ctx, appid, msg)
+		if err != nil {
+			log.Println("flowservice.HandleMessage error", err)
+		}
+		if handled {
+			return msgList, nil
+		}
+	}
+
+	if msg.GetMsgType() == "event" && !dryRun {
+		msgEvent := msghandler.GetMessageEvent(msg)
 		if msgEvent.Event == "subscribe" || msgEvent.Event == "unsubscribe" { // 关注/取消关注
-			err := weixinservice.DoWxUserSubscribe(rc.GetMsgHandler().GetMpOptions().AppId, msgEvent)
+			err := weixinservice.DoWxUserSubscribe(appid, msgEvent)
 			if err != nil {
-				rc.GetGinContext().JSON(200, err)
-				return
+				return nil, err
 			}
-		} else if msgEvent.Event == "SCAN" { // 扫码
+		} else if msgEvent.Event == "SCAN" { // 已关注的用户扫码，回复在 weixinservice 里处理
 			log.Println("event 扫码事件", msgEvent.EventKey)
-			// todo
 		} else {
 			log.Println("event 其他事件", msgEvent.Event, msgEvent.EventKey)
 		}
 	}
 
-	msgList, err := weixinservice.GetReplyMessages(rc.GetMsgHandler().GetMpOptions().AppId, msg)
-	if err != nil {
-		rc.GetGinContext().JSON(200, err)
-		return
-	}
+	return weixinservice.GetReplyMessages(ctx, appid, msg, dryRun, nil)
+}
 
+// 第一条消息且是支持的类型，就用被动回复的形式。其他情况用客服接口发送的形式
+// async 为 true 时，客服消息放到后台队列发送
+func DoReply(rc *msghandler.ReplyCtrl, msgList []*weixinservice.AutoReplyMessage, async bool) {
 	hasReply := false
 
-	if len(msgList) > 0 {
-
-		// 第一条消息且是支持的类型，就用被动回复的形式。其他情况用主动发送消息的形式
-		for idx, msg := range msgList {
-			if idx == 0 && lo.Contains([]string{"text", "image", "voice", "video", "music", "news"}, msg.MsgType) {
-				ReplyMessage(rc, msg)
-				hasReply = true
-			} else {
-				err := SendMessage(rc, msg)
-				if err != nil {
-					log.Println("SendMessage error", idx, err)
-				}
+	for idx, msg := range msgList {
+		if idx == 0 && lo.Contains([]string{"text", "image", "voice", "video", "music", "news"}, msg.MsgType) {
+			ReplyMessage(rc, msg)
+			hasReply = true
+		} else if async {
+			EnqueueCustomMessage(rc.GetMsgHandler().GetMpOptions().AppId, rc.GetMsg().GetFromUserName(), msg, "async_reply")
+		} else {
+			err := SendMessage(rc, msg)
+			if err != nil {
+				log.Println("SendMessage error", idx, err)
 			}
 		}
 	}
@@ -165,18 +315,26 @@ func ReplyMessage(rc *msghandler.ReplyCtrl, msg *weixinservice.AutoReplyMessage)
 
 // 主动发送消息
 func SendMessage(rc *msghandler.ReplyCtrl, msg *weixinservice.AutoReplyMessage) error {
-	var err error
+	data := BuildCustomMessage(msg)
+	if data == nil {
+		return nil
+	}
+	return rc.SendCustom(data)
+}
+
+// 构造客服消息的请求体，不支持的类型返回nil
+func BuildCustomMessage(msg *weixinservice.AutoReplyMessage) map[string]any {
 	switch msg.MsgType {
 	case "text":
-		err = rc.SendText(msg.Content)
+		return msghandler.NewCustomText(msg.Content)
 	case "image":
-		err = rc.SendImage(msg.MediaId)
+		return msghandler.NewCustomImage(msg.MediaId)
 	case "voice":
-		err = rc.SendVoice(msg.MediaId)
+		return msghandler.NewCustomVoice(msg.MediaId)
 	case "video":
-		err = rc.SendVideo(msg.MediaId, "thumb_media_id", msg.Title, msg.Description) // todo
+		return msghandler.NewCustomVideo(msg.MediaId, "thumb_media_id", msg.Title, msg.Description) // todo
 	case "music":
-		err = rc.SendMusic(msg.Title, msg.Description, msg.MusicUrl, msg.HQMusicUrl, msg.ThumbMediaId)
+		return msghandler.NewCustomMusic(msg.Title, msg.Description, msg.MusicUrl, msg.HQMusicUrl, msg.ThumbMediaId)
 	case "news":
 		articles := make([]*msghandler.SendMessageArticle, len(msg.Articles))
 		for i, article := range msg.Articles {
@@ -187,15 +345,15 @@ func SendMessage(rc *msghandler.ReplyCtrl, msg *weixinservice.AutoReplyMessage)
 				Url:         article.Url,
 			}
 		}
-		err = rc.SendNews(articles)
+		return msghandler.NewCustomNews(articles)
 	case "mpnews":
-		err = rc.SendMpNews(msg.MediaId)
+		return msghandler.NewCustomMpNews(msg.MediaId)
 	case "mpnewsarticle":
-		err = rc.SendMpNewsArticle(msg.ArticleId)
+		return msghandler.NewCustomMpNewsArticle(msg.ArticleId)
 	case "wxcard":
-		err = rc.SendWxCard(msg.CardId)
+		return msghandler.NewCustomWxCard(msg.CardId)
 	case "miniprogrampage":
-		err = rc.SendMiniProgramPage(msg.Title, msg.AppId, msg.PagePath, msg.ThumbMediaId)
+		return msghandler.NewCustomMiniProgramPage(msg.Title, msg.AppId, msg.PagePath, msg.ThumbMediaId)
 	}
-	return err
+	return nil
 }
@@ -177,6 +177,24 @@ func (mu *ModelBase[T, PT]) Count(ctx context.Context, filter bson.D) (int64, er
 	return count, nil
 }
 
+// 聚合查询，结果解码到 results，会在最前面加上未删除的过滤
+func (mu *ModelBase[T, PT]) Aggregate(ctx context.Context, pipeline mongo.Pipeline, results any) error {
+	collection, err := mongoClient.GetCollection(mu.CollectionName)
+	if err != nil {
+		return err
+	}
+
+	pipeline = append(mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "deleted_at", Value: bson.D{{Key: "$exists", Value: false}}}}}},
+	}, pipeline...)
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+
+	return cursor.All(ctx, results)
+}
+
 // 插入单个文档
 func (mu *ModelBase[T, PT]) InsertOne(ctx context.Context, doc PT) (string, error) {
 
@@ -29,6 +29,9 @@ type EntityWxAppid struct {
 	EnabledAutoReplyKeyword   bool `json:"enabled_auto_reply_keyword" bson:"enabled_auto_reply_keyword"`     // 是否启用关键词回复
 	EnabledAutoReplyMessage   bool `json:"enabled_auto_reply_message" bson:"enabled_auto_reply_message"`     // 是否启用消息回复
 	EnabledAutoReplySubscribe bool `json:"enabled_auto_reply_subscribe" bson:"enabled_auto_reply_subscribe"` // 是否启用关注回复
+
+	EnabledMediaDownload bool `json:"enabled_media_download" bson:"enabled_media_download"` // 是否自动下载粉丝发来的图片、语音、视频
+	KeywordMatchAll      bool `json:"keyword_match_all" bson:"keyword_match_all"`           // 关键词回复是否合并所有匹配到的规则
 }
 
 // 实现 ModelEntier 接口
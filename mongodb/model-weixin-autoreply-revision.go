@@ -0,0 +1,86 @@
+package mongodb
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 自动回复规则的历史版本，每次保存时写入一条，不再修改
+type EntityWxAutoReplyRevision struct {
+	EntityBase `bson:",inline"`
+
+	ID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+
+	AppID    string `json:"appid" bson:"appid"`
+	RuleID   string `json:"rule_id" bson:"rule_id"`
+	Revision int    `json:"revision" bson:"revision"` // 从1开始递增
+	Action   string `json:"action" bson:"action"`     // save, save_draft, publish, delete, restore, import
+
+	UserID   string `json:"user_id" bson:"user_id"`
+	Username string `json:"username" bson:"username"`
+
+	// 保存后的规则内容
+	ReplyType   string   `json:"reply_type" bson:"reply_type"`
+	ReplyData   string   `json:"reply_data" bson:"reply_data"`
+	RuleTitle   string   `json:"rule_title" bson:"rule_title"`
+	Keywords    []string `json:"keywords" bson:"keywords"`
+	KeywordsDef string   `json:"keywords_def" bson:"keywords_def"`
+	Priority    int      `json:"priority" bson:"priority"`
+
+	Diff string `json:"diff" bson:"diff"` // 和上一个版本的差异，json字符串
+}
+
+// 实现 ModelEntier 接口
+func (e *EntityWxAutoReplyRevision) GetCreatedAt() time.Time {
+	return e.CreatedAt
+}
+
+func (e *EntityWxAutoReplyRevision) SetCreatedAt(t time.Time) {
+	e.CreatedAt = t
+}
+
+var ModelWxAutoReplyRevision *ModelBase[EntityWxAutoReplyRevision, *EntityWxAutoReplyRevision]
+
+func init() {
+	AddModelInitFunc(func(client *MongoClient) error {
+		log.Println("init mongodb model wx autoreply revisions")
+
+		collectionName := "wx-autoreply-revisions"
+
+		ModelWxAutoReplyRevision = NewModelBase[EntityWxAutoReplyRevision, *EntityWxAutoReplyRevision](collectionName)
+
+		// 检查索引是否存在
+		collection, err := mongoClient.GetCollection(collectionName)
+		if err != nil {
+			log.Println("Error mongoClient.GetCollection")
+			return err
+		}
+		indexs, err := GetCollectionIndexs(context.Background(), collection)
+		if err != nil {
+			log.Println("Error GetCollectionIndexs")
+			return err
+		}
+		if !CheckCollectionCompoundIndexExists(indexs, []string{"appid", "rule_id", "revision"}, true) {
+			_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+				Keys: bson.D{
+					{Key: "appid", Value: 1},
+					{Key: "rule_id", Value: 1},
+					{Key: "revision", Value: 1},
+				},
+				Options: options.Index().SetUnique(true),
+			})
+			if err != nil {
+				log.Println("Error CreateOne")
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -28,6 +28,7 @@ type EntityWeixinAutoReply struct {
 	RuleTitle   string   `json:"rule_title" bson:"rule_title"`     // reply_type=keyword时有效
 	Keywords    []string `json:"keywords" bson:"keywords"`         // reply_type=keyword时有效
 	KeywordsDef string   `json:"keywords_def" bson:"keywords_def"` // reply_type=keyword时有效
+	Priority    int      `json:"priority" bson:"priority"`         // reply_type=keyword时有效，越大越先匹配
 }
 
 func (e *EntityWeixinAutoReply) GetCreatedAt() time.Time {
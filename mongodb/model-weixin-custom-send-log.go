@@ -0,0 +1,77 @@
+package mongodb
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 后台通过客服接口发送消息的记录
+type EntityWxCustomSendLog struct {
+	EntityBase `bson:",inline"`
+
+	ID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+
+	AppID  string `json:"appid" bson:"appid"`
+	OpenID string `json:"openid" bson:"openid"`
+
+	MsgType  string `json:"msg_type" bson:"msg_type"`
+	MsgData  string `json:"msg_data" bson:"msg_data"` // 发送的消息内容，json字符串
+	Status   string `json:"status" bson:"status"`     // success, fail
+	Attempts int    `json:"attempts" bson:"attempts"` // 尝试次数
+	Error    string `json:"error" bson:"error"`       // 最后一次失败的原因
+	Source   string `json:"source" bson:"source"`     // 来源，例如 async_reply
+}
+
+// 实现 ModelEntier 接口
+func (e *EntityWxCustomSendLog) GetCreatedAt() time.Time {
+	return e.CreatedAt
+}
+
+func (e *EntityWxCustomSendLog) SetCreatedAt(t time.Time) {
+	e.CreatedAt = t
+}
+
+var ModelWxCustomSendLog *ModelBase[EntityWxCustomSendLog, *EntityWxCustomSendLog]
+
+func init() {
+	AddModelInitFunc(func(client *MongoClient) error {
+		log.Println("init mongodb model wx custom send log")
+
+		collectionName := "wx-custom-send-logs"
+
+		ModelWxCustomSendLog = NewModelBase[EntityWxCustomSendLog, *EntityWxCustomSendLog](collectionName)
+
+		// 检查索引是否存在
+		collection, err := mongoClient.GetCollection(collectionName)
+		if err != nil {
+			log.Println("Error mongoClient.GetCollection")
+			return err
+		}
+		indexs, err := GetCollectionIndexs(context.Background(), collection)
+		if err != nil {
+			log.Println("Error GetCollectionIndexs")
+			return err
+		}
+		if !CheckCollectionCompoundIndexExists(indexs, []string{"appid", "created_at"}, false) {
+			_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+				Keys: bson.D{
+					{Key: "appid", Value: 1},
+					{Key: "created_at", Value: 1},
+				},
+				Options: options.Index().SetUnique(false),
+			})
+			if err != nil {
+				log.Println("Error CreateOne")
+				return err
+			}
+		}
+
+		return nil
+	})
+}
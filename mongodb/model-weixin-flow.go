@@ -0,0 +1,138 @@
+package mongodb
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 多步骤的对话流程，例如报名、问卷
+type EntityWxFlow struct {
+	EntityBase `bson:",inline"`
+
+	ID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+
+	AppID string `json:"appid" bson:"appid"`
+
+	Name           string   `json:"name" bson:"name"`
+	Triggers       []string `json:"triggers" bson:"triggers"`               // 粉丝发送的文本完全等于其中一个时开始流程
+	Steps          string   `json:"steps" bson:"steps"`                     // 步骤定义，json字符串
+	TimeoutSeconds int      `json:"timeout_seconds" bson:"timeout_seconds"` // 每一步等待输入的默认超时时间
+	CancelKeyword  string   `json:"cancel_keyword" bson:"cancel_keyword"`   // 流程中发送这个关键词时退出流程
+	CancelText     string   `json:"cancel_text" bson:"cancel_text"`         // 退出时的回复
+	FinishText     string   `json:"finish_text" bson:"finish_text"`         // 完成时的回复
+	Enabled        bool     `json:"enabled" bson:"enabled"`
+}
+
+// 实现 ModelEntier 接口
+func (e *EntityWxFlow) GetCreatedAt() time.Time {
+	return e.CreatedAt
+}
+
+func (e *EntityWxFlow) SetCreatedAt(t time.Time) {
+	e.CreatedAt = t
+}
+
+// 流程收集到的结果，完成时保存
+type EntityWxFlowResult struct {
+	EntityBase `bson:",inline"`
+
+	ID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+
+	AppID  string `json:"appid" bson:"appid"`
+	FlowID string `json:"flow_id" bson:"flow_id"`
+	OpenID string `json:"openid" bson:"openid"`
+
+	Answers    map[string]string `json:"answers" bson:"answers"` // key 为步骤的ID
+	StartedAt  time.Time         `json:"started_at" bson:"started_at"`
+	FinishedAt time.Time         `json:"finished_at" bson:"finished_at"`
+}
+
+// 实现 ModelEntier 接口
+func (e *EntityWxFlowResult) GetCreatedAt() time.Time {
+	return e.CreatedAt
+}
+
+func (e *EntityWxFlowResult) SetCreatedAt(t time.Time) {
+	e.CreatedAt = t
+}
+
+var ModelWxFlow *ModelBase[EntityWxFlow, *EntityWxFlow]
+var ModelWxFlowResult *ModelBase[EntityWxFlowResult, *EntityWxFlowResult]
+
+func init() {
+	AddModelInitFunc(func(client *MongoClient) error {
+		log.Println("init mongodb model wx flows")
+
+		collectionName := "wx-flows"
+
+		ModelWxFlow = NewModelBase[EntityWxFlow, *EntityWxFlow](collectionName)
+
+		// 检查索引是否存在
+		collection, err := mongoClient.GetCollection(collectionName)
+		if err != nil {
+			log.Println("Error mongoClient.GetCollection")
+			return err
+		}
+		indexs, err := GetCollectionIndexs(context.Background(), collection)
+		if err != nil {
+			log.Println("Error GetCollectionIndexs")
+			return err
+		}
+		if !CheckCollectionIndexExists(indexs, "appid", false) {
+			_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+				Keys: bson.M{
+					"appid": 1,
+				},
+				Options: options.Index().SetUnique(false),
+			})
+			if err != nil {
+				log.Println("Error CreateOne")
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	AddModelInitFunc(func(client *MongoClient) error {
+		log.Println("init mongodb model wx flow results")
+
+		collectionName := "wx-flow-results"
+
+		ModelWxFlowResult = NewModelBase[EntityWxFlowResult, *EntityWxFlowResult](collectionName)
+
+		// 检查索引是否存在
+		collection, err := mongoClient.GetCollection(collectionName)
+		if err != nil {
+			log.Println("Error mongoClient.GetCollection")
+			return err
+		}
+		indexs, err := GetCollectionIndexs(context.Background(), collection)
+		if err != nil {
+			log.Println("Error GetCollectionIndexs")
+			return err
+		}
+		if !CheckCollectionCompoundIndexExists(indexs, []string{"appid", "flow_id", "created_at"}, false) {
+			_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+				Keys: bson.D{
+					{Key: "appid", Value: 1},
+					{Key: "flow_id", Value: 1},
+					{Key: "created_at", Value: 1},
+				},
+				Options: options.Index().SetUnique(false),
+			})
+			if err != nil {
+				log.Println("Error CreateOne")
+				return err
+			}
+		}
+
+		return nil
+	})
+}
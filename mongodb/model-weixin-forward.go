@@ -0,0 +1,149 @@
+package mongodb
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 消息转发的目标地址
+type EntityWxForwardTarget struct {
+	EntityBase `bson:",inline"`
+
+	ID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+
+	AppID string `json:"appid" bson:"appid"`
+
+	Name       string   `json:"name" bson:"name"`
+	Url        string   `json:"url" bson:"url"`
+	Secret     string   `json:"secret" bson:"secret"`             // 用于 HMAC-SHA256 签名
+	Events     []string `json:"events" bson:"events"`             // 过滤条件，例如 text、event、event:subscribe，为空表示全部
+	TimeoutMs  int      `json:"timeout_ms" bson:"timeout_ms"`     // 单次请求超时时间
+	MaxRetries int      `json:"max_retries" bson:"max_retries"`   // 失败后的重试次数
+	UseAsReply bool     `json:"use_as_reply" bson:"use_as_reply"` // 用返回的内容作为被动回复
+	Enabled    bool     `json:"enabled" bson:"enabled"`
+
+	// 作为关键词没有匹配到时的外部回复，只在这时同步调用，不再转发其他消息
+	UseAsFallback      bool `json:"use_as_fallback" bson:"use_as_fallback"`
+	BreakerFailures    int  `json:"breaker_failures" bson:"breaker_failures"`         // 连续失败多少次后熔断，默认5次
+	BreakerCooldownSec int  `json:"breaker_cooldown_sec" bson:"breaker_cooldown_sec"` // 熔断多少秒后再尝试，默认30秒
+}
+
+// 实现 ModelEntier 接口
+func (e *EntityWxForwardTarget) GetCreatedAt() time.Time {
+	return e.CreatedAt
+}
+
+func (e *EntityWxForwardTarget) SetCreatedAt(t time.Time) {
+	e.CreatedAt = t
+}
+
+// 消息转发的投递记录
+type EntityWxForwardLog struct {
+	EntityBase `bson:",inline"`
+
+	ID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+
+	AppID    string `json:"appid" bson:"appid"`
+	TargetID string `json:"target_id" bson:"target_id"`
+	Url      string `json:"url" bson:"url"`
+	OpenID   string `json:"openid" bson:"openid"`
+	MsgType  string `json:"msg_type" bson:"msg_type"`
+	Event    string `json:"event,omitempty" bson:"event,omitempty"`
+
+	Status     string `json:"status" bson:"status"` // success, fail
+	Attempts   int    `json:"attempts" bson:"attempts"`
+	HttpStatus int    `json:"http_status" bson:"http_status"`
+	Error      string `json:"error" bson:"error"`
+	DurationMs int64  `json:"duration_ms" bson:"duration_ms"`
+	Payload    string `json:"payload" bson:"payload"`
+	Response   string `json:"response" bson:"response"`
+}
+
+// 实现 ModelEntier 接口
+func (e *EntityWxForwardLog) GetCreatedAt() time.Time {
+	return e.CreatedAt
+}
+
+func (e *EntityWxForwardLog) SetCreatedAt(t time.Time) {
+	e.CreatedAt = t
+}
+
+var ModelWxForwardTarget *ModelBase[EntityWxForwardTarget, *EntityWxForwardTarget]
+var ModelWxForwardLog *ModelBase[EntityWxForwardLog, *EntityWxForwardLog]
+
+func init() {
+	AddModelInitFunc(func(client *MongoClient) error {
+		log.Println("init mongodb model wx forward targets")
+
+		collectionName := "wx-forward-targets"
+
+		ModelWxForwardTarget = NewModelBase[EntityWxForwardTarget, *EntityWxForwardTarget](collectionName)
+
+		// 检查索引是否存在
+		collection, err := mongoClient.GetCollection(collectionName)
+		if err != nil {
+			log.Println("Error mongoClient.GetCollection")
+			return err
+		}
+		indexs, err := GetCollectionIndexs(context.Background(), collection)
+		if err != nil {
+			log.Println("Error GetCollectionIndexs")
+			return err
+		}
+		if !CheckCollectionIndexExists(indexs, "appid", false) {
+			_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+				Keys: bson.M{
+					"appid": 1,
+				},
+				Options: options.Index().SetUnique(false),
+			})
+			if err != nil {
+				log.Println("Error CreateOne")
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	AddModelInitFunc(func(client *MongoClient) error {
+		log.Println("init mongodb model wx forward logs")
+
+		collectionName := "wx-forward-logs"
+
+		ModelWxForwardLog = NewModelBase[EntityWxForwardLog, *EntityWxForwardLog](collectionName)
+
+		// 检查索引是否存在
+		collection, err := mongoClient.GetCollection(collectionName)
+		if err != nil {
+			log.Println("Error mongoClient.GetCollection")
+			return err
+		}
+		indexs, err := GetCollectionIndexs(context.Background(), collection)
+		if err != nil {
+			log.Println("Error GetCollectionIndexs")
+			return err
+		}
+		if !CheckCollectionCompoundIndexExists(indexs, []string{"appid", "created_at"}, false) {
+			_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+				Keys: bson.D{
+					{Key: "appid", Value: 1},
+					{Key: "created_at", Value: 1},
+				},
+				Options: options.Index().SetUnique(false),
+			})
+			if err != nil {
+				log.Println("Error CreateOne")
+				return err
+			}
+		}
+
+		return nil
+	})
+}
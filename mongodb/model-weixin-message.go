@@ -0,0 +1,100 @@
+package mongodb
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 粉丝发来的消息、事件，以及回复给粉丝的消息
+type EntityWxMessage struct {
+	EntityBase `bson:",inline"`
+
+	ID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+
+	AppID  string `json:"appid" bson:"appid"`
+	OpenID string `json:"openid" bson:"openid"`
+
+	Direction string    `json:"direction" bson:"direction"`                       // in-粉丝发来的，out-回复给粉丝的
+	ReplyMode string    `json:"reply_mode,omitempty" bson:"reply_mode,omitempty"` // direction=out时有效，passive-被动回复，custom-客服消息
+	Time      time.Time `json:"time" bson:"time"`                                 // 消息时间，粉丝发来的取 CreateTime
+
+	MsgType  string `json:"msg_type" bson:"msg_type"`
+	MsgId    int64  `json:"msg_id,omitempty" bson:"msg_id,omitempty"`
+	Event    string `json:"event,omitempty" bson:"event,omitempty"`
+	EventKey string `json:"event_key,omitempty" bson:"event_key,omitempty"`
+	Content  string `json:"content" bson:"content"` // 文本内容，用于搜索
+	Raw      string `json:"raw" bson:"raw"`         // 完整的消息，json字符串
+
+	// 粉丝发来的图片、语音、视频，开启自动下载后保存到本地
+	MediaId     string `json:"media_id,omitempty" bson:"media_id,omitempty"`
+	MediaStatus string `json:"media_status,omitempty" bson:"media_status,omitempty"` // done-已下载，fail-下载失败
+	MediaFile   string `json:"media_file,omitempty" bson:"media_file,omitempty"`     // 本地文件的url路径
+}
+
+// 实现 ModelEntier 接口
+func (e *EntityWxMessage) GetCreatedAt() time.Time {
+	return e.CreatedAt
+}
+
+func (e *EntityWxMessage) SetCreatedAt(t time.Time) {
+	e.CreatedAt = t
+}
+
+var ModelWxMessage *ModelBase[EntityWxMessage, *EntityWxMessage]
+
+func init() {
+	AddModelInitFunc(func(client *MongoClient) error {
+		log.Println("init mongodb model wx messages")
+
+		collectionName := "wx-messages"
+
+		ModelWxMessage = NewModelBase[EntityWxMessage, *EntityWxMessage](collectionName)
+
+		// 检查索引是否存在
+		collection, err := mongoClient.GetCollection(collectionName)
+		if err != nil {
+			log.Println("Error mongoClient.GetCollection")
+			return err
+		}
+		indexs, err := GetCollectionIndexs(context.Background(), collection)
+		if err != nil {
+			log.Println("Error GetCollectionIndexs")
+			return err
+		}
+		if !CheckCollectionCompoundIndexExists(indexs, []string{"appid", "openid", "time"}, false) {
+			_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+				Keys: bson.D{
+					{Key: "appid", Value: 1},
+					{Key: "openid", Value: 1},
+					{Key: "time", Value: 1},
+				},
+				Options: options.Index().SetUnique(false),
+			})
+			if err != nil {
+				log.Println("Error CreateOne")
+				return err
+			}
+		}
+		if !CheckCollectionCompoundIndexExists(indexs, []string{"appid", "time"}, false) {
+			_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+				Keys: bson.D{
+					{Key: "appid", Value: 1},
+					{Key: "time", Value: 1},
+				},
+				Options: options.Index().SetUnique(false),
+			})
+			if err != nil {
+				log.Println("Error CreateOne")
+				return err
+			}
+		}
+
+		return nil
+	})
+}
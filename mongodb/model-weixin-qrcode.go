@@ -28,6 +28,8 @@ type EntityWxQrcode struct {
 	Ticket        string `json:"ticket" bson:"ticket"`
 	ExpireSeconds int    `json:"expire_seconds" bson:"expire_seconds"`
 	Url           string `json:"url" bson:"url"`
+
+	ReplyData string `json:"-" bson:"reply_data"` // 扫这个码关注或者扫码时的回复，格式同 AutoReplyData
 }
 
 // 实现 ModelEntier 接口
@@ -0,0 +1,193 @@
+package mongodb
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 自动回复的命中次数，按小时预先聚合，每个规则的每条消息一条记录
+type EntityWxReplyStat struct {
+	EntityBase `bson:",inline"`
+
+	ID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+
+	AppID     string    `json:"appid" bson:"appid"`
+	Hour      time.Time `json:"hour" bson:"hour"` // 整点时间
+	ReplyType string    `json:"reply_type" bson:"reply_type"`
+	RuleKey   string    `json:"rule_key" bson:"rule_key"`
+	MsgIndex  int       `json:"msg_index" bson:"msg_index"` // 消息在 msg_list 中的下标
+	Count     int64     `json:"count" bson:"count"`
+}
+
+// 实现 ModelEntier 接口
+func (e *EntityWxReplyStat) GetCreatedAt() time.Time {
+	return e.CreatedAt
+}
+
+func (e *EntityWxReplyStat) SetCreatedAt(t time.Time) {
+	e.CreatedAt = t
+}
+
+// 没有匹配到关键词的文本消息，按小时预先聚合
+type EntityWxReplyUnmatched struct {
+	EntityBase `bson:",inline"`
+
+	ID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+
+	AppID   string    `json:"appid" bson:"appid"`
+	Hour    time.Time `json:"hour" bson:"hour"`
+	Content string    `json:"content" bson:"content"`
+	Count   int64     `json:"count" bson:"count"`
+}
+
+// 实现 ModelEntier 接口
+func (e *EntityWxReplyUnmatched) GetCreatedAt() time.Time {
+	return e.CreatedAt
+}
+
+func (e *EntityWxReplyUnmatched) SetCreatedAt(t time.Time) {
+	e.CreatedAt = t
+}
+
+// 防重放拒绝的请求，按小时、原因预先聚合
+type EntityWxReplayReject struct {
+	EntityBase `bson:",inline"`
+
+	ID primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+
+	AppID  string    `json:"appid" bson:"appid"`
+	Hour   time.Time `json:"hour" bson:"hour"`
+	Reason string    `json:"reason" bson:"reason"` // timestamp expired, nonce replayed 等
+	Count  int64     `json:"count" bson:"count"`
+}
+
+// 实现 ModelEntier 接口
+func (e *EntityWxReplayReject) GetCreatedAt() time.Time {
+	return e.CreatedAt
+}
+
+func (e *EntityWxReplayReject) SetCreatedAt(t time.Time) {
+	e.CreatedAt = t
+}
+
+var ModelWxReplyStat *ModelBase[EntityWxReplyStat, *EntityWxReplyStat]
+var ModelWxReplyUnmatched *ModelBase[EntityWxReplyUnmatched, *EntityWxReplyUnmatched]
+var ModelWxReplayReject *ModelBase[EntityWxReplayReject, *EntityWxReplayReject]
+
+func init() {
+	AddModelInitFunc(func(client *MongoClient) error {
+		log.Println("init mongodb model wx reply stats")
+
+		collectionName := "wx-reply-stats"
+
+		ModelWxReplyStat = NewModelBase[EntityWxReplyStat, *EntityWxReplyStat](collectionName)
+
+		// 检查索引是否存在
+		collection, err := mongoClient.GetCollection(collectionName)
+		if err != nil {
+			log.Println("Error mongoClient.GetCollection")
+			return err
+		}
+		indexs, err := GetCollectionIndexs(context.Background(), collection)
+		if err != nil {
+			log.Println("Error GetCollectionIndexs")
+			return err
+		}
+		if !CheckCollectionCompoundIndexExists(indexs, []string{"appid", "hour", "reply_type", "rule_key", "msg_index"}, true) {
+			_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+				Keys: bson.D{
+					{Key: "appid", Value: 1},
+					{Key: "hour", Value: 1},
+					{Key: "reply_type", Value: 1},
+					{Key: "rule_key", Value: 1},
+					{Key: "msg_index", Value: 1},
+				},
+				Options: options.Index().SetUnique(true),
+			})
+			if err != nil {
+				log.Println("Error CreateOne")
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	AddModelInitFunc(func(client *MongoClient) error {
+		log.Println("init mongodb model wx reply unmatched")
+
+		collectionName := "wx-reply-unmatched"
+
+		ModelWxReplyUnmatched = NewModelBase[EntityWxReplyUnmatched, *EntityWxReplyUnmatched](collectionName)
+
+		// 检查索引是否存在
+		collection, err := mongoClient.GetCollection(collectionName)
+		if err != nil {
+			log.Println("Error mongoClient.GetCollection")
+			return err
+		}
+		indexs, err := GetCollectionIndexs(context.Background(), collection)
+		if err != nil {
+			log.Println("Error GetCollectionIndexs")
+			return err
+		}
+		if !CheckCollectionCompoundIndexExists(indexs, []string{"appid", "hour", "content"}, true) {
+			_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+				Keys: bson.D{
+					{Key: "appid", Value: 1},
+					{Key: "hour", Value: 1},
+					{Key: "content", Value: 1},
+				},
+				Options: options.Index().SetUnique(true),
+			})
+			if err != nil {
+				log.Println("Error CreateOne")
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	AddModelInitFunc(func(client *MongoClient) error {
+		log.Println("init mongodb model wx replay reject")
+
+		collectionName := "wx-replay-rejects"
+
+		ModelWxReplayReject = NewModelBase[EntityWxReplayReject, *EntityWxReplayReject](collectionName)
+
+		// 检查索引是否存在
+		collection, err := mongoClient.GetCollection(collectionName)
+		if err != nil {
+			log.Println("Error mongoClient.GetCollection")
+			return err
+		}
+		indexs, err := GetCollectionIndexs(context.Background(), collection)
+		if err != nil {
+			log.Println("Error GetCollectionIndexs")
+			return err
+		}
+		if !CheckCollectionCompoundIndexExists(indexs, []string{"appid", "hour", "reason"}, true) {
+			_, err = collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+				Keys: bson.D{
+					{Key: "appid", Value: 1},
+					{Key: "hour", Value: 1},
+					{Key: "reason", Value: 1},
+				},
+				Options: options.Index().SetUnique(true),
+			})
+			if err != nil {
+				log.Println("Error CreateOne")
+				return err
+			}
+		}
+
+		return nil
+	})
+}
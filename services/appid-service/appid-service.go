@@ -59,6 +59,8 @@ type GetAppEnabledDataResp struct {
 	EnabledAutoReplyKeyword   bool   `json:"enabled_auto_reply_keyword"`
 	EnabledAutoReplyMessage   bool   `json:"enabled_auto_reply_message"`
 	EnabledAutoReplySubscribe bool   `json:"enabled_auto_reply_subscribe"`
+	EnabledMediaDownload      bool   `json:"enabled_media_download"`
+	KeywordMatchAll           bool   `json:"keyword_match_all"`
 }
 
 // 获取公众号的相关功能启用状态
@@ -76,6 +78,8 @@ func GetAppEnabledData(ctx context.Context, appid string) (*GetAppEnabledDataRes
 		EnabledAutoReplyKeyword:   doc.EnabledAutoReplyKeyword,
 		EnabledAutoReplyMessage:   doc.EnabledAutoReplyMessage,
 		EnabledAutoReplySubscribe: doc.EnabledAutoReplySubscribe,
+		EnabledMediaDownload:      doc.EnabledMediaDownload,
+		KeywordMatchAll:           doc.KeywordMatchAll,
 	}, nil
 }
 
@@ -95,6 +99,8 @@ func GetAppEnabledDataForReplyType(ctx context.Context, appid string, reply_type
 		return doc.EnabledAutoReplyMessage, nil
 	} else if reply_type == "subscribe" {
 		return doc.EnabledAutoReplySubscribe, nil
+	} else if reply_type == "keyword_match_all" {
+		return doc.KeywordMatchAll, nil
 	}
 	return false, errors.New("reply_type error")
 }
@@ -109,6 +115,10 @@ func SetAppEnabledData(ctx context.Context, appid string, reply_type string, ena
 		d = bson.D{{Key: "enabled_auto_reply_message", Value: enabled}}
 	} else if reply_type == "subscribe" {
 		d = bson.D{{Key: "enabled_auto_reply_subscribe", Value: enabled}}
+	} else if reply_type == "media_download" {
+		d = bson.D{{Key: "enabled_media_download", Value: enabled}}
+	} else if reply_type == "keyword_match_all" {
+		d = bson.D{{Key: "keyword_match_all", Value: enabled}}
 	} else {
 		return errors.New("reply_type error")
 	}
@@ -121,3 +131,16 @@ func SetAppEnabledData(ctx context.Context, appid string, reply_type string, ena
 	}
 	return nil
 }
+
+// 是否自动下载粉丝发来的媒体文件，公众号不在数据库中的视为未开启
+func GetAppMediaDownloadEnabled(ctx context.Context, appid string) (bool, error) {
+	filter := bson.D{{Key: "appid", Value: appid}}
+	doc, err := mongodb.ModelWxAppid.FindOne(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	if doc == nil {
+		return false, nil
+	}
+	return doc.EnabledMediaDownload, nil
+}
@@ -0,0 +1,539 @@
+package flowservice
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+	"github.com/redis/go-redis/v9"
+	"github.com/samber/lo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+ * 多步骤的对话流程
+ * 粉丝发送流程的触发词后进入流程，之后发来的消息优先交给流程处理，不再走关键词回复
+ * 每个粉丝当前所在的步骤和已经收集的答案保存在 redis 中，超时未回复则 redis 中的状态过期，流程自动退出
+ * 走完所有步骤后，答案保存到 mongodb
+ * 同一个粉丝的消息加锁后逐条处理，避免并发的消息读到同一个状态后互相覆盖
+ * 图片的答案保存 media_id，临时素材在微信侧只保留3天，公众号开启自动下载时导出结果会换成下载后的文件
+ */
+
+const (
+	FlowInputText   = "text"
+	FlowInputNumber = "number"
+	FlowInputChoice = "choice"
+	FlowInputImage  = "image"
+)
+
+// 步骤的 next 为这个值时表示结束
+const FlowStepEnd = "end"
+
+// 每一步等待输入的默认超时时间，秒
+const defaultFlowTimeout = 600
+
+// 处理一条消息时持有的锁的过期时间，也是等待锁的最长时间
+const flowLockTimeout = 10 * time.Second
+
+// 等待锁时重试的间隔
+const flowLockRetryInterval = 50 * time.Millisecond
+
+type FlowStep struct {
+	ID             string            `json:"id"`
+	Prompt         string            `json:"prompt"`                    // 提示语
+	Input          string            `json:"input"`                     // 期望的输入，text number choice image
+	Choices        []string          `json:"choices,omitempty"`         // input=choice时的选项，粉丝可以回复选项或者序号
+	Pattern        string            `json:"pattern,omitempty"`         // input=text时的正则校验
+	Min            *float64          `json:"min,omitempty"`             // input=number时的最小值
+	Max            *float64          `json:"max,omitempty"`             // input=number时的最大值
+	ErrorText      string            `json:"error_text,omitempty"`      // 校验不通过时的回复
+	Next           string            `json:"next,omitempty"`            // 下一步的ID，为空表示按顺序的下一步，end表示结束
+	NextByChoice   map[string]string `json:"next_by_choice,omitempty"`  // input=choice时按选项跳转
+	TimeoutSeconds int               `json:"timeout_seconds,omitempty"` // 等待输入的超时时间，0使用流程的默认值
+}
+
+type FlowState struct {
+	FlowID    string            `json:"flow_id"`
+	StepID    string            `json:"step_id"`
+	Answers   map[string]string `json:"answers"`
+	StartedAt time.Time         `json:"started_at"`
+}
+
+var flowRdb *redis.Client
+
+// 不初始化时不处理流程
+func Init(rdb *redis.Client) {
+	flowRdb = rdb
+}
+
+func ParseSteps(str string) ([]*FlowStep, error) {
+	steps := []*FlowStep{}
+	if str == "" {
+		return steps, nil
+	}
+	err := json.Unmarshal([]byte(str), &steps)
+	if err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// 检查步骤的定义，保存时调用
+func ValidateSteps(steps []*FlowStep) error {
+	if len(steps) <= 0 {
+		return errors.New("steps is empty")
+	}
+	ids := make(map[string]bool)
+	for _, step := range steps {
+		if step.ID == "" || step.ID == FlowStepEnd || ids[step.ID] {
+			return fmt.Errorf("step id error: %s", step.ID)
+		}
+		ids[step.ID] = true
+	}
+	for _, step := range steps {
+		if !lo.Contains([]string{FlowInputText, FlowInputNumber, FlowInputChoice, FlowInputImage}, step.Input) {
+			return fmt.Errorf("step %s input error: %s", step.ID, step.Input)
+		}
+		if step.Input == FlowInputChoice && len(step.Choices) <= 0 {
+			return fmt.Errorf("step %s choices is empty", step.ID)
+		}
+		if step.Pattern != "" {
+			if _, err := regexp.Compile(step.Pattern); err != nil {
+				return fmt.Errorf("step %s pattern error: %s", step.ID, err.Error())
+			}
+		}
+		if step.Next != "" && step.Next != FlowStepEnd && !ids[step.Next] {
+			return fmt.Errorf("step %s next not found: %s", step.ID, step.Next)
+		}
+		for choice, next := range step.NextByChoice {
+			if !lo.Contains(step.Choices, choice) {
+				return fmt.Errorf("step %s next_by_choice choice not found: %s", step.ID, choice)
+			}
+			if next != FlowStepEnd && !ids[next] {
+				return fmt.Errorf("step %s next_by_choice next not found: %s", step.ID, next)
+			}
+		}
+		if step.TimeoutSeconds < 0 {
+			return fmt.Errorf("step %s timeout_seconds error", step.ID)
+		}
+	}
+	return nil
+}
+
+func stateKey(appid, openid string) string {
+	return appid + "_flow_state_" + openid
+}
+
+func getState(ctx context.Context, appid, openid string) (*FlowState, error) {
+	str, err := flowRdb.Get(ctx, stateKey(appid, openid)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var state FlowState
+	err = json.Unmarshal([]byte(str), &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func saveState(ctx context.Context, appid, openid string, state *FlowState, timeout time.Duration) error {
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return flowRdb.Set(ctx, stateKey(appid, openid), string(bs), timeout).Err()
+}
+
+func clearState(ctx context.Context, appid, openid string) error {
+	return flowRdb.Del(ctx, stateKey(appid, openid)).Err()
+}
+
+func lockKey(appid, openid string) string {
+	return appid + "_flow_lock_" + openid
+}
+
+// 只删除自己加的锁，处理超时后锁已经过期被其他消息拿到时不能删掉
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// 获取粉丝的流程锁，其他消息正在处理时等待，返回释放锁的函数
+func lockState(ctx context.Context, appid, openid string) (func(), error) {
+	key := lockKey(appid, openid)
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+	deadline := time.Now().Add(flowLockTimeout)
+	for {
+		ok, err := flowRdb.SetNX(ctx, key, token, flowLockTimeout).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return func() {
+				if err := unlockScript.Run(context.Background(), flowRdb, []string{key}, token).Err(); err != nil {
+					log.Println("flowservice unlock error", key, err)
+				}
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("wait flow lock timeout")
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(flowLockRetryInterval):
+		}
+	}
+}
+
+func stepTimeout(flow *mongodb.EntityWxFlow, step *FlowStep) time.Duration {
+	seconds := step.TimeoutSeconds
+	if seconds <= 0 {
+		seconds = flow.TimeoutSeconds
+	}
+	if seconds <= 0 {
+		seconds = defaultFlowTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func findStep(steps []*FlowStep, id string) (*FlowStep, int) {
+	for i, step := range steps {
+		if step.ID == id {
+			return step, i
+		}
+	}
+	return nil, -1
+}
+
+func textReply(content string) []*weixinservice.AutoReplyMessage {
+	return []*weixinservice.AutoReplyMessage{{MsgType: "text", Content: content}}
+}
+
+// 步骤的提示语，选择题带上序号和选项
+func stepPrompt(step *FlowStep) string {
+	if step.Input != FlowInputChoice {
+		return step.Prompt
+	}
+	lines := []string{step.Prompt}
+	for i, choice := range step.Choices {
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, choice))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 校验粉丝的输入，返回保存的答案，校验不通过时返回的错误为回复给粉丝的提示
+func validateInput(step *FlowStep, msg msghandler.Message) (string, error) {
+	errText := step.ErrorText
+
+	if step.Input == FlowInputImage {
+		m, ok := msg.(*msghandler.MessageImage)
+		if !ok {
+			return "", errors.New(lo.Ternary(errText != "", errText, "请发送一张图片"))
+		}
+		return m.MediaId, nil
+	}
+
+	m, ok := msg.(*msghandler.MessageText)
+	if !ok {
+		return "", errors.New(lo.Ternary(errText != "", errText, "请输入文字"))
+	}
+	text := strings.TrimSpace(m.Content)
+
+	switch step.Input {
+	case FlowInputNumber:
+		n, err := strconv.ParseFloat(text, 64)
+		if err != nil || (step.Min != nil && n < *step.Min) || (step.Max != nil && n > *step.Max) {
+			return "", errors.New(lo.Ternary(errText != "", errText, "请输入正确的数字"))
+		}
+	case FlowInputChoice:
+		if idx, err := strconv.Atoi(text); err == nil && idx >= 1 && idx <= len(step.Choices) {
+			return step.Choices[idx-1], nil
+		}
+		if !lo.Contains(step.Choices, text) {
+			return "", errors.New(lo.Ternary(errText != "", errText, "请回复选项或序号"))
+		}
+	default:
+		if text == "" {
+			return "", errors.New(lo.Ternary(errText != "", errText, "请输入文字"))
+		}
+		if step.Pattern != "" {
+			re, err := regexp.Compile(step.Pattern)
+			if err != nil || !re.MatchString(text) {
+				return "", errors.New(lo.Ternary(errText != "", errText, "输入的格式不正确"))
+			}
+		}
+	}
+	return text, nil
+}
+
+// 下一步的ID，结束时返回 FlowStepEnd
+func nextStepID(steps []*FlowStep, step *FlowStep, idx int, value string) string {
+	if next, ok := step.NextByChoice[value]; ok {
+		return next
+	}
+	if step.Next != "" {
+		return step.Next
+	}
+	if idx+1 < len(steps) {
+		return steps[idx+1].ID
+	}
+	return FlowStepEnd
+}
+
+// 粉丝发送的文本是否触发了流程
+func findTriggeredFlow(ctx context.Context, appid, text string) (*mongodb.EntityWxFlow, error) {
+	if text == "" {
+		return nil, nil
+	}
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "enabled", Value: true}, {Key: "triggers", Value: text}}
+	return mongodb.ModelWxFlow.FindOne(ctx, filter)
+}
+
+/**
+ * 处理粉丝发来的消息
+ * handled 为 true 时消息已经被流程处理，msgList 为流程的回复，否则继续走普通的回复
+ */
+func HandleMessage(ctx context.Context, appid string, msg msghandler.Message) ([]*weixinservice.AutoReplyMessage, bool, error) {
+	if flowRdb == nil || msg.GetMsgType() == "event" {
+		return nil, false, nil
+	}
+	openid := msg.GetFromUserName()
+
+	unlock, err := lockState(ctx, appid, openid)
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
+
+	state, err := getState(ctx, appid, openid)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// 不在流程中，检查是否触发了流程
+	if state == nil {
+		m, ok := msg.(*msghandler.MessageText)
+		if !ok {
+			return nil, false, nil
+		}
+		flow, err := findTriggeredFlow(ctx, appid, strings.TrimSpace(m.Content))
+		if err != nil || flow == nil {
+			return nil, false, err
+		}
+		steps, err := ParseSteps(flow.Steps)
+		if err != nil || len(steps) <= 0 {
+			log.Println("flowservice ParseSteps error", flow.ID.Hex(), err)
+			return nil, false, nil
+		}
+
+		log.Println("flowservice start flow", appid, openid, flow.Name)
+		state = &FlowState{
+			FlowID:    flow.ID.Hex(),
+			StepID:    steps[0].ID,
+			Answers:   map[string]string{},
+			StartedAt: time.Now(),
+		}
+		err = saveState(ctx, appid, openid, state, stepTimeout(flow, steps[0]))
+		if err != nil {
+			return nil, false, err
+		}
+		return textReply(stepPrompt(steps[0])), true, nil
+	}
+
+	// 流程被删除或者停用了，直接退出
+	flow, err := mongodb.ModelWxFlow.FindByID(ctx, state.FlowID)
+	if err != nil {
+		return nil, false, err
+	}
+	if flow == nil || !flow.Enabled {
+		log.Println("flowservice flow not available, exit", appid, openid, state.FlowID)
+		return nil, false, clearState(ctx, appid, openid)
+	}
+	steps, err := ParseSteps(flow.Steps)
+	if err != nil {
+		log.Println("flowservice ParseSteps error", state.FlowID, err)
+	}
+
+	msgList, waitStep, action := advanceFlow(flow, steps, state, msg)
+	switch action {
+	case flowActionExit:
+		log.Println("flowservice step not found, exit", appid, openid, state.StepID)
+		return nil, false, clearState(ctx, appid, openid)
+	case flowActionCancel:
+		log.Println("flowservice cancel flow", appid, openid, flow.Name)
+		return msgList, true, clearState(ctx, appid, openid)
+	case flowActionFinish:
+		log.Println("flowservice finish flow", appid, openid, flow.Name)
+		err = clearState(ctx, appid, openid)
+		if err != nil {
+			return nil, true, err
+		}
+		_, err = mongodb.ModelWxFlowResult.InsertOne(ctx, &mongodb.EntityWxFlowResult{
+			AppID:      appid,
+			FlowID:     state.FlowID,
+			OpenID:     openid,
+			Answers:    state.Answers,
+			StartedAt:  state.StartedAt,
+			FinishedAt: time.Now(),
+		})
+		return msgList, true, err
+	}
+	err = saveState(ctx, appid, openid, state, stepTimeout(flow, waitStep))
+	return msgList, true, err
+}
+
+type flowAction int
+
+const (
+	flowActionWait   flowAction = iota // 等待 waitStep 的输入，包括校验不通过时重新输入
+	flowActionCancel                   // 粉丝主动退出
+	flowActionFinish                   // 走完了所有步骤
+	flowActionExit                     // 步骤找不到了，退出流程，消息走普通的回复
+)
+
+// 处理流程中的一条输入，更新 state 的步骤和答案，返回回复、接下来等待输入的步骤和处理结果
+func advanceFlow(flow *mongodb.EntityWxFlow, steps []*FlowStep, state *FlowState, msg msghandler.Message) ([]*weixinservice.AutoReplyMessage, *FlowStep, flowAction) {
+	step, idx := findStep(steps, state.StepID)
+	if step == nil {
+		return nil, nil, flowActionExit
+	}
+
+	// 主动退出
+	if m, ok := msg.(*msghandler.MessageText); ok && flow.CancelKeyword != "" && strings.TrimSpace(m.Content) == flow.CancelKeyword {
+		return textReply(lo.Ternary(flow.CancelText != "", flow.CancelText, "已退出")), nil, flowActionCancel
+	}
+
+	value, verr := validateInput(step, msg)
+	if verr != nil {
+		// 重新计时，再提示一次
+		return textReply(verr.Error() + "\n\n" + stepPrompt(step)), step, flowActionWait
+	}
+	state.Answers[step.ID] = value
+
+	nextID := nextStepID(steps, step, idx, value)
+	if nextID == FlowStepEnd {
+		return textReply(lo.Ternary(flow.FinishText != "", flow.FinishText, "感谢参与")), nil, flowActionFinish
+	}
+
+	next, _ := findStep(steps, nextID)
+	if next == nil {
+		state.StepID = nextID
+		return nil, nil, flowActionExit
+	}
+	state.StepID = next.ID
+	return textReply(stepPrompt(next)), next, flowActionWait
+}
+
+// 粉丝的回答以 = + - @、制表符或回车开头时，excel 会当成公式执行，前面加上 ' 作为文本显示
+func csvSafeCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// 图片答案的 media_id 对应的已下载的文件，公众号没有开启自动下载或者还没下载完时没有
+func findMediaFiles(ctx context.Context, appid string, doc *mongodb.EntityWxFlowResult, steps []*FlowStep) (map[string]string, error) {
+	var mediaIds []string
+	for _, step := range steps {
+		if step.Input == FlowInputImage && doc.Answers[step.ID] != "" {
+			mediaIds = append(mediaIds, doc.Answers[step.ID])
+		}
+	}
+	ret := make(map[string]string)
+	if len(mediaIds) <= 0 {
+		return ret, nil
+	}
+
+	filter := bson.D{
+		{Key: "appid", Value: appid},
+		{Key: "openid", Value: doc.OpenID},
+		{Key: "media_id", Value: bson.D{{Key: "$in", Value: mediaIds}}},
+		{Key: "media_status", Value: "done"},
+	}
+	messages, err := mongodb.ModelWxMessage.FindMany(ctx, filter, options.Find())
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		ret[m.MediaId] = m.MediaFile
+	}
+	return ret, nil
+}
+
+// 导出流程的结果为csv，列为 openid、开始时间、完成时间，以及每一步的答案，图片为已下载的文件或者 media_id
+func ExportResultsCSV(ctx context.Context, appid, flowId string, w io.Writer) error {
+	flow, err := mongodb.ModelWxFlow.FindByID(ctx, flowId)
+	if err != nil {
+		return err
+	}
+	if flow == nil || flow.AppID != appid {
+		return errors.New("flow not found")
+	}
+	steps, err := ParseSteps(flow.Steps)
+	if err != nil {
+		return err
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "flow_id", Value: flowId}}
+	docs, err := mongodb.ModelWxFlowResult.FindMany(ctx, filter, findOptions)
+	if err != nil {
+		return err
+	}
+
+	// 带上 BOM，excel 打开时不会乱码
+	_, err = w.Write([]byte("\xEF\xBB\xBF"))
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	header := []string{"openid", "started_at", "finished_at"}
+	for _, step := range steps {
+		header = append(header, csvSafeCell(step.ID))
+	}
+	err = cw.Write(header)
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		mediaFiles, err := findMediaFiles(ctx, appid, doc, steps)
+		if err != nil {
+			return err
+		}
+		row := []string{doc.OpenID, doc.StartedAt.Format(time.DateTime), doc.FinishedAt.Format(time.DateTime)}
+		for _, step := range steps {
+			answer := doc.Answers[step.ID]
+			if file, ok := mediaFiles[answer]; ok && step.Input == FlowInputImage {
+				answer = file
+			}
+			row = append(row, csvSafeCell(answer))
+		}
+		err = cw.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
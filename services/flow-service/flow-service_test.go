@@ -0,0 +1,192 @@
+package flowservice
+
+import (
+	"testing"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+)
+
+func TestCsvSafeCell(t *testing.T) {
+	cases := map[string]string{
+		"":                         "",
+		"hello":                    "hello",
+		"=HYPERLINK(\"http://x\")": "'=HYPERLINK(\"http://x\")",
+		"+1":                       "'+1",
+		"-1":                       "'-1",
+		"@SUM(A1)":                 "'@SUM(A1)",
+		"\t=1":                     "'\t=1",
+		"a=1":                      "a=1",
+		"你好":                       "你好",
+	}
+	for in, want := range cases {
+		if got := csvSafeCell(in); got != want {
+			t.Errorf("csvSafeCell(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestValidateSteps(t *testing.T) {
+	cases := []struct {
+		name    string
+		steps   []*FlowStep
+		wantErr bool
+	}{
+		{"empty", nil, true},
+		{"ok", []*FlowStep{{ID: "a", Input: FlowInputText}, {ID: "b", Input: FlowInputImage, Next: FlowStepEnd}}, false},
+		{"empty id", []*FlowStep{{ID: "", Input: FlowInputText}}, true},
+		{"id is end", []*FlowStep{{ID: FlowStepEnd, Input: FlowInputText}}, true},
+		{"duplicate id", []*FlowStep{{ID: "a", Input: FlowInputText}, {ID: "a", Input: FlowInputText}}, true},
+		{"unknown input", []*FlowStep{{ID: "a", Input: "video"}}, true},
+		{"choice without choices", []*FlowStep{{ID: "a", Input: FlowInputChoice}}, true},
+		{"bad pattern", []*FlowStep{{ID: "a", Input: FlowInputText, Pattern: "("}}, true},
+		{"next not found", []*FlowStep{{ID: "a", Input: FlowInputText, Next: "b"}}, true},
+		{"next_by_choice ok", []*FlowStep{
+			{ID: "a", Input: FlowInputChoice, Choices: []string{"是", "否"}, NextByChoice: map[string]string{"是": "b", "否": FlowStepEnd}},
+			{ID: "b", Input: FlowInputText},
+		}, false},
+		{"next_by_choice unknown choice", []*FlowStep{
+			{ID: "a", Input: FlowInputChoice, Choices: []string{"是"}, NextByChoice: map[string]string{"否": FlowStepEnd}},
+		}, true},
+		{"next_by_choice next not found", []*FlowStep{
+			{ID: "a", Input: FlowInputChoice, Choices: []string{"是"}, NextByChoice: map[string]string{"是": "c"}},
+		}, true},
+		{"negative timeout", []*FlowStep{{ID: "a", Input: FlowInputText, TimeoutSeconds: -1}}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := ValidateSteps(c.steps)
+			if (err != nil) != c.wantErr {
+				t.Errorf("ValidateSteps() error = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateInput(t *testing.T) {
+	text := func(s string) msghandler.Message { return &msghandler.MessageText{MsgType: "text", Content: s} }
+	image := &msghandler.MessageImage{MsgType: "image", PicUrl: "http://mmbiz.qpic.cn/x", MediaId: "media1"}
+
+	numberStep := &FlowStep{ID: "age", Input: FlowInputNumber, Min: floatPtr(1), Max: floatPtr(120)}
+	choiceStep := &FlowStep{ID: "city", Input: FlowInputChoice, Choices: []string{"北京", "上海"}}
+	patternStep := &FlowStep{ID: "phone", Input: FlowInputText, Pattern: `^1\d{10}$`, ErrorText: "手机号不正确"}
+	imageStep := &FlowStep{ID: "photo", Input: FlowInputImage}
+
+	cases := []struct {
+		name    string
+		step    *FlowStep
+		msg     msghandler.Message
+		want    string
+		wantErr string
+	}{
+		{"number ok", numberStep, text(" 18 "), "18", ""},
+		{"number below min", numberStep, text("0"), "", "请输入正确的数字"},
+		{"number above max", numberStep, text("121"), "", "请输入正确的数字"},
+		{"number not a number", numberStep, text("abc"), "", "请输入正确的数字"},
+		{"number image", numberStep, image, "", "请输入文字"},
+		{"choice by text", choiceStep, text("上海"), "上海", ""},
+		{"choice by index", choiceStep, text("1"), "北京", ""},
+		{"choice index out of range", choiceStep, text("3"), "", "请回复选项或序号"},
+		{"choice unknown", choiceStep, text("广州"), "", "请回复选项或序号"},
+		{"pattern ok", patternStep, text("13800138000"), "13800138000", ""},
+		{"pattern mismatch uses error_text", patternStep, text("123"), "", "手机号不正确"},
+		{"text empty", &FlowStep{ID: "name", Input: FlowInputText}, text("  "), "", "请输入文字"},
+		{"image keeps media_id", imageStep, image, "media1", ""},
+		{"image text", imageStep, text("hi"), "", "请发送一张图片"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := validateInput(c.step, c.msg)
+			if c.wantErr != "" {
+				if err == nil || err.Error() != c.wantErr {
+					t.Errorf("validateInput() error = %v, want %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil || got != c.want {
+				t.Errorf("validateInput() = %q, %v, want %q", got, err, c.want)
+			}
+		})
+	}
+}
+
+func TestNextStepID(t *testing.T) {
+	steps := []*FlowStep{
+		{ID: "a", Input: FlowInputChoice, Choices: []string{"是", "否"}, NextByChoice: map[string]string{"否": FlowStepEnd}},
+		{ID: "b", Input: FlowInputText, Next: "d"},
+		{ID: "c", Input: FlowInputText},
+		{ID: "d", Input: FlowInputText},
+	}
+	cases := []struct {
+		name  string
+		idx   int
+		value string
+		want  string
+	}{
+		{"next_by_choice", 0, "否", FlowStepEnd},
+		{"choice without jump goes in order", 0, "是", "b"},
+		{"next", 1, "x", "d"},
+		{"in order", 2, "x", "d"},
+		{"last step ends", 3, "x", FlowStepEnd},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := nextStepID(steps, steps[c.idx], c.idx, c.value); got != c.want {
+				t.Errorf("nextStepID() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestAdvanceFlow(t *testing.T) {
+	flow := &mongodb.EntityWxFlow{CancelKeyword: "退出", CancelText: "已取消", FinishText: "完成"}
+	steps := []*FlowStep{
+		{ID: "name", Prompt: "姓名", Input: FlowInputText},
+		{ID: "join", Prompt: "参加吗", Input: FlowInputChoice, Choices: []string{"是", "否"}, NextByChoice: map[string]string{"否": FlowStepEnd}},
+		{ID: "photo", Prompt: "照片", Input: FlowInputImage},
+	}
+	text := func(s string) msghandler.Message { return &msghandler.MessageText{MsgType: "text", Content: s} }
+
+	cases := []struct {
+		name       string
+		stepID     string
+		msg        msghandler.Message
+		wantAction flowAction
+		wantStep   string // 接下来等待的步骤
+		wantReply  string
+		wantAnswer string
+	}{
+		{"next step", "name", text("张三"), flowActionWait, "join", "参加吗\n1. 是\n2. 否", "张三"},
+		{"invalid input waits on same step", "join", text("3"), flowActionWait, "join", "请回复选项或序号\n\n参加吗\n1. 是\n2. 否", ""},
+		{"cancel", "join", text(" 退出 "), flowActionCancel, "", "已取消", ""},
+		{"finish by next_by_choice", "join", text("2"), flowActionFinish, "", "完成", "否"},
+		{"finish after last step", "photo", &msghandler.MessageImage{MsgType: "image", MediaId: "m1"}, flowActionFinish, "", "完成", "m1"},
+		{"step removed", "gone", text("x"), flowActionExit, "", "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			state := &FlowState{StepID: c.stepID, Answers: map[string]string{}}
+			msgList, waitStep, action := advanceFlow(flow, steps, state, c.msg)
+			if action != c.wantAction {
+				t.Fatalf("action = %v, want %v", action, c.wantAction)
+			}
+			if c.wantStep != "" && (waitStep == nil || waitStep.ID != c.wantStep || state.StepID != c.wantStep) {
+				t.Errorf("wait step = %v, state.StepID = %q, want %q", waitStep, state.StepID, c.wantStep)
+			}
+			reply := ""
+			if len(msgList) > 0 {
+				reply = msgList[0].Content
+			}
+			if reply != c.wantReply {
+				t.Errorf("reply = %q, want %q", reply, c.wantReply)
+			}
+			if got := state.Answers[c.stepID]; got != c.wantAnswer {
+				t.Errorf("answer = %q, want %q", got, c.wantAnswer)
+			}
+		})
+	}
+}
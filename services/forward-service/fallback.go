@@ -0,0 +1,216 @@
+package forwardservice
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/**
+ * 外部回复，关键词没有匹配到时调用设置了 use_as_fallback 的转发目标，返回的内容作为回复
+ * 请求内容在转发的基础上带上文本内容和粉丝信息，签名和返回格式都和转发一样
+ * 为了不超过微信的5秒限制，超时时间不超过 MaxReplyTimeoutMs 和请求剩余的时间，不重试，剩余时间不够时不调用
+ * 连续失败 breaker_failures 次后熔断，breaker_cooldown_sec 秒内不再调用，之后放一个请求试探，成功后恢复
+ * 熔断的状态保存在进程内，每个实例各自统计
+ */
+
+const (
+	defaultBreakerFailures    = 5
+	defaultBreakerCooldownSec = 30
+)
+
+type FallbackFollower struct {
+	Nickname     string     `json:"nickname"`
+	Subscribed   bool       `json:"subscribed"`
+	SubscribedAt *time.Time `json:"subscribed_at,omitempty"`
+	SceneID      string     `json:"scene_id,omitempty"`
+}
+
+type FallbackPayload struct {
+	*ForwardPayload
+	Content  string            `json:"content,omitempty"` // 文本消息的内容
+	Follower *FallbackFollower `json:"follower,omitempty"`
+}
+
+func NewFallbackPayload(ctx context.Context, appid string, msg msghandler.Message) *FallbackPayload {
+	payload := &FallbackPayload{ForwardPayload: NewForwardPayload(appid, msg)}
+	if m, ok := msg.(*msghandler.MessageText); ok {
+		payload.Content = m.Content
+	}
+
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "openid", Value: msg.GetFromUserName()}}
+	user, err := mongodb.ModelWeixinUser.FindOne(ctx, filter)
+	if err != nil {
+		log.Println("NewFallbackPayload ModelWeixinUser.FindOne error", err)
+	}
+	if user != nil {
+		payload.Follower = &FallbackFollower{
+			Nickname:     user.Nickname,
+			Subscribed:   user.Subscribed,
+			SubscribedAt: user.SubscribedAt,
+			SceneID:      user.SceneID,
+		}
+	}
+	return payload
+}
+
+// 公众号启用的外部回复，没有时返回nil
+func GetFallbackTarget(ctx context.Context, appid string) (*mongodb.EntityWxForwardTarget, error) {
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "enabled", Value: true}, {Key: "use_as_fallback", Value: true}}
+	return mongodb.ModelWxForwardTarget.FindOne(ctx, filter)
+}
+
+// 从缓存的启用目标中找外部回复，回复消息时用
+func findFallbackTarget(ctx context.Context, appid string) (*mongodb.EntityWxForwardTarget, error) {
+	targets, err := GetEnabledTargets(ctx, appid)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		if target.UseAsFallback {
+			return target, nil
+		}
+	}
+	return nil, nil
+}
+
+// 实现 weixinservice.FallbackResponder
+func FallbackResponder(ctx context.Context, appid string, msg msghandler.Message) ([]*weixinservice.AutoReplyMessage, error) {
+	target, err := findFallbackTarget(ctx, appid)
+	if err != nil || target == nil {
+		return nil, err
+	}
+
+	payload := NewFallbackPayload(ctx, appid, msg)
+	if !MatchTarget(target, payload.ForwardPayload) {
+		return nil, nil
+	}
+	return callFallback(ctx, target, payload)
+}
+
+// 经过熔断调用一次外部回复
+func callFallback(ctx context.Context, target *mongodb.EntityWxForwardTarget, payload *FallbackPayload) ([]*weixinservice.AutoReplyMessage, error) {
+	// 剩余时间不够不算失败
+	t, err := replyTarget(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	if !breakerAllow(target) {
+		log.Println("FallbackResponder breaker is open", payload.AppID, target.Url)
+		return nil, nil
+	}
+	respBody, err := deliverBody(ctx, t, payload.ForwardPayload, body, 0)
+	if err == nil {
+		var msgList []*weixinservice.AutoReplyMessage
+		msgList, err = ParseReplyMessages(respBody)
+		if err == nil {
+			breakerDone(target, true)
+			return msgList, nil
+		}
+	}
+	breakerDone(target, false)
+	return nil, err
+}
+
+type BreakerState struct {
+	State     string     `json:"state"` // closed, open, half_open
+	Failures  int        `json:"failures"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+type breaker struct {
+	failures  int
+	openUntil time.Time
+	probing   bool // 熔断结束后正在试探
+}
+
+var breakers = make(map[string]*breaker)
+var breakersMutex sync.Mutex
+
+func breakerSettings(target *mongodb.EntityWxForwardTarget) (int, time.Duration) {
+	failures := target.BreakerFailures
+	if failures <= 0 {
+		failures = defaultBreakerFailures
+	}
+	cooldownSec := target.BreakerCooldownSec
+	if cooldownSec <= 0 {
+		cooldownSec = defaultBreakerCooldownSec
+	}
+	return failures, time.Duration(cooldownSec) * time.Second
+}
+
+// 是否可以调用，熔断结束后只放一个请求去试探
+func breakerAllow(target *mongodb.EntityWxForwardTarget) bool {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	b := breakers[target.ID.Hex()]
+	maxFailures, _ := breakerSettings(target)
+	if b == nil || b.failures < maxFailures {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func breakerDone(target *mongodb.EntityWxForwardTarget, success bool) {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	id := target.ID.Hex()
+	b := breakers[id]
+	if b == nil {
+		if success {
+			return
+		}
+		b = &breaker{}
+		breakers[id] = b
+	}
+	b.probing = false
+	if success {
+		delete(breakers, id)
+		return
+	}
+	b.failures++
+	maxFailures, cooldown := breakerSettings(target)
+	if b.failures >= maxFailures {
+		b.openUntil = time.Now().Add(cooldown)
+		log.Println("FallbackResponder breaker open", target.Url, b.failures, b.openUntil)
+	}
+}
+
+// 熔断状态，用于后台查看
+func GetBreakerState(target *mongodb.EntityWxForwardTarget) *BreakerState {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	b := breakers[target.ID.Hex()]
+	if b == nil {
+		return &BreakerState{State: "closed"}
+	}
+	ret := &BreakerState{State: "closed", Failures: b.failures}
+	maxFailures, _ := breakerSettings(target)
+	if b.failures >= maxFailures {
+		openUntil := b.openUntil
+		ret.OpenUntil = &openUntil
+		ret.State = "open"
+		if !time.Now().Before(b.openUntil) {
+			ret.State = "half_open"
+		}
+	}
+	return ret
+}
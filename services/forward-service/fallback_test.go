@@ -0,0 +1,193 @@
+package forwardservice
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 本地的外部回复服务，delay 控制响应的耗时，fail 为 true 时返回 500
+type stubResponder struct {
+	server *httptest.Server
+	calls  atomic.Int32
+	delay  atomic.Int64
+	fail   atomic.Bool
+	last   atomic.Value // 最后一次收到的请求内容
+}
+
+func newStubResponder(t *testing.T) *stubResponder {
+	s := &stubResponder{}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		if Sign("secret", r.Header.Get("X-Woaa-Timestamp"), body) != r.Header.Get("X-Woaa-Signature") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.last.Store(body)
+		time.Sleep(time.Duration(s.delay.Load()))
+		if s.fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"msg_list":[{"msg_type":"text","content":"faq answer"}]}`))
+	}))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func newStubTarget(url string) *mongodb.EntityWxForwardTarget {
+	return &mongodb.EntityWxForwardTarget{
+		ID:                 primitive.NewObjectID(),
+		Url:                url,
+		Secret:             "secret",
+		TimeoutMs:          200,
+		UseAsFallback:      true,
+		BreakerFailures:    2,
+		BreakerCooldownSec: 1,
+	}
+}
+
+func newStubPayload() *FallbackPayload {
+	return &FallbackPayload{
+		ForwardPayload: &ForwardPayload{AppID: "wx_test", OpenID: "openid_test", MsgType: "text"},
+		Content:        "how much",
+		Follower:       &FallbackFollower{Nickname: "tester", Subscribed: true},
+	}
+}
+
+func TestCallFallbackSuccess(t *testing.T) {
+	stub := newStubResponder(t)
+	target := newStubTarget(stub.server.URL)
+
+	msgList, err := callFallback(context.Background(), target, newStubPayload())
+	if err != nil {
+		t.Fatalf("callFallback() error = %v", err)
+	}
+	if len(msgList) != 1 || msgList[0].Content != "faq answer" {
+		t.Fatalf("callFallback() msgList = %+v", msgList)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(stub.last.Load().([]byte), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["content"] != "how much" || got["openid"] != "openid_test" {
+		t.Errorf("payload = %v", got)
+	}
+	if follower, _ := got["follower"].(map[string]any); follower["nickname"] != "tester" {
+		t.Errorf("payload follower = %v", got["follower"])
+	}
+}
+
+func TestCallFallbackTimeout(t *testing.T) {
+	stub := newStubResponder(t)
+	stub.delay.Store(int64(time.Second))
+	target := newStubTarget(stub.server.URL)
+
+	start := time.Now()
+	_, err := callFallback(context.Background(), target, newStubPayload())
+	if err == nil {
+		t.Fatal("callFallback() should time out")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("callFallback() took %v, want about timeout_ms", d)
+	}
+}
+
+func TestCallFallbackRequestDeadline(t *testing.T) {
+	stub := newStubResponder(t)
+	stub.delay.Store(int64(time.Second))
+	target := newStubTarget(stub.server.URL)
+	target.TimeoutMs = 3000
+
+	// 超时时间限制在请求剩余的时间内
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := callFallback(ctx, target, newStubPayload()); err == nil {
+		t.Fatal("callFallback() should time out")
+	}
+	if d := time.Since(start); d > 600*time.Millisecond {
+		t.Errorf("callFallback() took %v, want less than the request deadline", d)
+	}
+
+	// 剩余的时间不够，不调用
+	calls := stub.calls.Load()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := callFallback(ctx, target, newStubPayload()); err == nil {
+		t.Fatal("callFallback() should refuse without enough time left")
+	}
+	if stub.calls.Load() != calls {
+		t.Error("callFallback() should not call the responder without enough time left")
+	}
+}
+
+func TestCallFallbackBreaker(t *testing.T) {
+	stub := newStubResponder(t)
+	stub.fail.Store(true)
+	target := newStubTarget(stub.server.URL)
+	ctx := context.Background()
+
+	// 连续失败 breaker_failures 次后熔断
+	for i := 0; i < target.BreakerFailures; i++ {
+		if _, err := callFallback(ctx, target, newStubPayload()); err == nil {
+			t.Fatal("callFallback() should fail")
+		}
+	}
+	if state := GetBreakerState(target).State; state != "open" {
+		t.Fatalf("state = %s, want open", state)
+	}
+	calls := stub.calls.Load()
+	msgList, err := callFallback(ctx, target, newStubPayload())
+	if err != nil || msgList != nil || stub.calls.Load() != calls {
+		t.Fatal("callFallback() should skip the responder when open")
+	}
+
+	// 冷却后半开，试探失败继续熔断
+	time.Sleep(time.Duration(target.BreakerCooldownSec)*time.Second + 100*time.Millisecond)
+	if state := GetBreakerState(target).State; state != "half_open" {
+		t.Fatalf("state = %s, want half_open", state)
+	}
+	if _, err := callFallback(ctx, target, newStubPayload()); err == nil {
+		t.Fatal("probe should fail")
+	}
+	if state := GetBreakerState(target).State; state != "open" {
+		t.Fatalf("state = %s, want open after failed probe", state)
+	}
+
+	// 再次冷却后试探成功，恢复
+	time.Sleep(time.Duration(target.BreakerCooldownSec)*time.Second + 100*time.Millisecond)
+	stub.fail.Store(false)
+	msgList, err = callFallback(ctx, target, newStubPayload())
+	if err != nil || len(msgList) != 1 {
+		t.Fatalf("probe should succeed, err = %v", err)
+	}
+	if state := GetBreakerState(target).State; state != "closed" {
+		t.Fatalf("state = %s, want closed", state)
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	target := newStubTarget("")
+	for i := 0; i < target.BreakerFailures; i++ {
+		breakerDone(target, false)
+	}
+	breakers[target.ID.Hex()].openUntil = time.Now().Add(-time.Millisecond)
+
+	if !breakerAllow(target) {
+		t.Fatal("first probe should be allowed")
+	}
+	if breakerAllow(target) {
+		t.Fatal("only one probe at a time")
+	}
+}
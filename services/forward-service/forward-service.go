@@ -0,0 +1,287 @@
+package forwardservice
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/lib/lru"
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+	"github.com/go-resty/resty/v2"
+	"github.com/samber/lo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+ * 把粉丝发来的消息和事件转发给业务系统
+ * 请求头带上 HMAC-SHA256 签名，签名内容是 timestamp + "\n" + body
+ * X-Woaa-Timestamp: 时间戳
+ * X-Woaa-Signature: hex(hmac_sha256(secret, timestamp + "\n" + body))
+ */
+
+const defaultTimeoutMs = 3000
+
+// 请求内同步调用时的超时时间上限，保存目标时 timeout_ms 也不能超过
+const MaxReplyTimeoutMs = 3000
+
+// 剩余的时间少于这个就不再同步调用，留给后面的处理和返回
+const minReplyTimeoutMs = 200
+
+// 目前只用于后台显示，不返回原始的 secret
+const SecretMask = "******"
+
+// 重试间隔 1s 2s 4s ... 的上限
+const maxRetryBackoff = 30 * time.Second
+
+// 兜底的过期时间，避免没收到失效通知时一直使用旧的目标
+const enabledTargetsTTL = 10 * time.Minute
+
+type ForwardPayload struct {
+	AppID      string             `json:"appid"`
+	OpenID     string             `json:"openid"`
+	MsgType    string             `json:"msg_type"`
+	Event      string             `json:"event,omitempty"`
+	CreateTime int64              `json:"create_time"`
+	Message    msghandler.Message `json:"message"`
+}
+
+func NewForwardPayload(appid string, msg msghandler.Message) *ForwardPayload {
+	payload := &ForwardPayload{
+		AppID:      appid,
+		OpenID:     msg.GetFromUserName(),
+		MsgType:    msg.GetMsgType(),
+		CreateTime: msg.GetCreateTime(),
+		Message:    msg,
+	}
+	if e := msghandler.GetMessageEvent(msg); e != nil {
+		payload.Event = e.Event
+	}
+	return payload
+}
+
+var lruEnabledTargets = lru.NewCacheLRUWithTTL[[]*mongodb.EntityWxForwardTarget](100, enabledTargetsTTL, func(ctx context.Context, appid string) (*[]*mongodb.EntityWxForwardTarget, error) {
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "enabled", Value: true}}
+	targets, err := mongodb.ModelWxForwardTarget.FindMany(ctx, filter, options.Find())
+	if err != nil {
+		return nil, err
+	}
+	return &targets, nil
+})
+
+// 获取公众号启用的转发目标，每条消息都要用，缓存在内存中，返回的目标不能修改
+func GetEnabledTargets(ctx context.Context, appid string) ([]*mongodb.EntityWxForwardTarget, error) {
+	targets, err := lruEnabledTargets.Get(ctx, appid)
+	if err != nil {
+		return nil, err
+	}
+	return *targets, nil
+}
+
+// 转发目标修改后调用，下次使用时重新加载
+func InvalidateTargets(appid string) {
+	lruEnabledTargets.Remove(appid)
+}
+
+// 判断消息是否符合目标的过滤条件
+func MatchTarget(target *mongodb.EntityWxForwardTarget, payload *ForwardPayload) bool {
+	if len(target.Events) == 0 {
+		return true
+	}
+	if lo.Contains(target.Events, payload.MsgType) {
+		return true
+	}
+	if payload.Event != "" && lo.Contains(target.Events, "event:"+payload.Event) {
+		return true
+	}
+	return false
+}
+
+func Sign(secret, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newRestyClient(target *mongodb.EntityWxForwardTarget) *resty.Client {
+	timeoutMs := target.TimeoutMs
+	if timeoutMs <= 0 {
+		timeoutMs = defaultTimeoutMs
+	}
+	client := resty.New()
+	client.SetTimeout(time.Duration(timeoutMs) * time.Millisecond)
+	wxProxy := os.Getenv("WA_PROXY")
+	if wxProxy != "" {
+		client.SetProxy(wxProxy)
+	}
+	return client
+}
+
+// 发送一次请求
+func post(ctx context.Context, target *mongodb.EntityWxForwardTarget, body []byte) (*resty.Response, error) {
+	timestamp := fmt.Sprint(time.Now().Unix())
+	resp, err := newRestyClient(target).R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("X-Woaa-Timestamp", timestamp).
+		SetHeader("X-Woaa-Signature", Sign(target.Secret, timestamp, body)).
+		SetBody(body).
+		Post(target.Url)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		return resp, fmt.Errorf("http status %d", resp.StatusCode())
+	}
+	return resp, nil
+}
+
+/**
+ * 投递，失败按 1s 2s 4s ... 重试，间隔最长 maxRetryBackoff，ctx 结束时不再重试，并记录投递结果
+ * 返回最后一次请求的响应内容
+ */
+func Deliver(ctx context.Context, target *mongodb.EntityWxForwardTarget, payload *ForwardPayload, maxRetries int) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return deliverBody(ctx, target, payload, body, maxRetries)
+}
+
+// body 为请求的内容，payload 只用于记录投递结果
+func deliverBody(ctx context.Context, target *mongodb.EntityWxForwardTarget, payload *ForwardPayload, body []byte, maxRetries int) ([]byte, error) {
+	start := time.Now()
+	var resp *resty.Response
+	var err error
+	attempts := 0
+	for {
+		attempts++
+		resp, err = post(ctx, target, body)
+		if err == nil || attempts > maxRetries {
+			break
+		}
+		log.Println("forwardservice.Deliver error", target.Url, attempts, err)
+		backoff := min(time.Duration(1<<(attempts-1))*time.Second, maxRetryBackoff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+			continue
+		}
+		break
+	}
+
+	doc := &mongodb.EntityWxForwardLog{
+		AppID:      payload.AppID,
+		TargetID:   target.ID.Hex(),
+		Url:        target.Url,
+		OpenID:     payload.OpenID,
+		MsgType:    payload.MsgType,
+		Event:      payload.Event,
+		Status:     "success",
+		Attempts:   attempts,
+		DurationMs: time.Since(start).Milliseconds(),
+		Payload:    string(body),
+	}
+	var respBody []byte
+	if resp != nil {
+		respBody = resp.Body()
+		doc.HttpStatus = resp.StatusCode()
+		doc.Response = string(respBody)
+	}
+	if err != nil {
+		doc.Status = "fail"
+		doc.Error = err.Error()
+	}
+	saveForwardLog(doc)
+
+	return respBody, err
+}
+
+// 同步调用时不等待写入
+func saveForwardLog(doc *mongodb.EntityWxForwardLog) {
+	if mongodb.ModelWxForwardLog == nil {
+		return
+	}
+	go func() {
+		_, err := mongodb.ModelWxForwardLog.InsertOne(context.Background(), doc)
+		if err != nil {
+			log.Println("forwardservice saveForwardLog InsertOne error", err)
+		}
+	}()
+}
+
+// 没有投递就丢弃的消息，例如后台队列满了，同样记录一条失败的投递结果
+func RecordDropped(target *mongodb.EntityWxForwardTarget, payload *ForwardPayload, reason string) {
+	saveForwardLog(&mongodb.EntityWxForwardLog{
+		AppID:    payload.AppID,
+		TargetID: target.ID.Hex(),
+		Url:      target.Url,
+		OpenID:   payload.OpenID,
+		MsgType:  payload.MsgType,
+		Event:    payload.Event,
+		Status:   "fail",
+		Error:    reason,
+	})
+}
+
+/**
+ * 请求内同步调用一次，不重试
+ * 超时时间取目标的 timeout_ms、MaxReplyTimeoutMs 和 ctx 剩余时间中最小的，剩余时间不够时不调用
+ */
+func DeliverForReply(ctx context.Context, target *mongodb.EntityWxForwardTarget, payload *ForwardPayload) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	t, err := replyTarget(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return deliverBody(ctx, t, payload, body, 0)
+}
+
+// 复制一份目标，超时时间限制在请求剩余的时间内
+func replyTarget(ctx context.Context, target *mongodb.EntityWxForwardTarget) (*mongodb.EntityWxForwardTarget, error) {
+	timeoutMs := target.TimeoutMs
+	if timeoutMs <= 0 || timeoutMs > MaxReplyTimeoutMs {
+		timeoutMs = MaxReplyTimeoutMs
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		left := int(time.Until(deadline).Milliseconds()) - minReplyTimeoutMs
+		if left < minReplyTimeoutMs {
+			return nil, errors.New("not enough time left before reply deadline")
+		}
+		timeoutMs = min(timeoutMs, left)
+	}
+	t := *target
+	t.TimeoutMs = timeoutMs
+	return &t, nil
+}
+
+/**
+ * 业务系统的返回内容作为被动回复，格式和自动回复的 reply_data 一样
+ * { "reply_all": true, "msg_list": [{ "msg_type": "text", "content": "hello" }] }
+ * 返回空内容表示不回复
+ */
+func ParseReplyMessages(body []byte) ([]*weixinservice.AutoReplyMessage, error) {
+	if len(body) == 0 {
+		return nil, nil
+	}
+	var data weixinservice.AutoReplyData
+	err := json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, errors.New("invalid reply body")
+	}
+	return weixinservice.ConvertReplyDataToMessages(&data, nil)
+}
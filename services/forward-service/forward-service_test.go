@@ -0,0 +1,27 @@
+package forwardservice
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeliverStopsRetryingWhenContextDone(t *testing.T) {
+	stub := newStubResponder(t)
+	stub.fail.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := Deliver(ctx, newStubTarget(stub.server.URL), newStubPayload().ForwardPayload, 10)
+	if err == nil {
+		t.Fatal("Deliver should fail")
+	}
+	// 1s 之后第二次失败，下一次要等 2s，ctx 先结束
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Deliver took %v after ctx was done", elapsed)
+	}
+	if n := stub.calls.Load(); n != 2 {
+		t.Errorf("calls = %d, want 2", n)
+	}
+}
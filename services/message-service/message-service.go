@@ -0,0 +1,117 @@
+package messageservice
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// 保存粉丝发来的消息或事件，返回记录的ID
+func SaveInboundMessage(ctx context.Context, appid string, msg msghandler.Message) (string, error) {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+
+	doc := &mongodb.EntityWxMessage{
+		AppID:     appid,
+		OpenID:    msg.GetFromUserName(),
+		Direction: "in",
+		Time:      time.Unix(msg.GetCreateTime(), 0),
+		MsgType:   msg.GetMsgType(),
+		Raw:       string(raw),
+	}
+	if m, ok := msg.(msghandler.MessageWithMsgId); ok {
+		doc.MsgId = m.GetMsgId()
+	}
+	if e := msghandler.GetMessageEvent(msg); e != nil {
+		doc.Event = e.Event
+		doc.EventKey = e.EventKey
+	}
+	if m, ok := msg.(*msghandler.MessageText); ok {
+		doc.Content = m.Content
+	}
+	_, doc.MediaId = GetMessageMedia(msg)
+
+	return mongodb.ModelWxMessage.InsertOne(ctx, doc)
+}
+
+// 获取粉丝发来的媒体消息的类型和 media_id，不是媒体消息的返回空
+// 小视频下载下来也是视频，所以类型返回 video
+func GetMessageMedia(msg msghandler.Message) (string, string) {
+	switch m := msg.(type) {
+	case *msghandler.MessageImage:
+		return "image", m.MediaId
+	case *msghandler.MessageVoice:
+		return "voice", m.MediaId
+	case *msghandler.MessageVideo:
+		return "video", m.MediaId
+	case *msghandler.MessageShortVideo:
+		return "video", m.MediaId
+	}
+	return "", ""
+}
+
+// 记录媒体文件的下载结果
+func SetMessageMediaFile(ctx context.Context, id string, status string, filePath string) error {
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "media_status", Value: status},
+		{Key: "media_file", Value: filePath},
+	}}}
+	_, err := mongodb.ModelWxMessage.UpdateByID(ctx, id, update)
+	return err
+}
+
+/**
+ * 保存回复给粉丝的消息
+ * @param replyMode passive-被动回复，custom-客服消息
+ * @param data 被动回复是 ReplyMessageXXX 结构体，客服消息是 NewCustomXXX 构造的 map
+ */
+func SaveOutboundMessage(ctx context.Context, appid, openid, replyMode string, data any) (string, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	doc := &mongodb.EntityWxMessage{
+		AppID:     appid,
+		OpenID:    openid,
+		Direction: "out",
+		ReplyMode: replyMode,
+		Time:      time.Now(),
+		Raw:       string(raw),
+	}
+
+	if replyMode == "passive" {
+		tmp := struct {
+			MsgType string `json:"MsgType"`
+			Content string `json:"Content"`
+		}{}
+		err = json.Unmarshal(raw, &tmp)
+		if err != nil {
+			log.Println("SaveOutboundMessage json.Unmarshal error", err)
+		}
+		doc.MsgType = tmp.MsgType
+		doc.Content = tmp.Content
+	} else {
+		tmp := struct {
+			MsgType string `json:"msgtype"`
+			Text    struct {
+				Content string `json:"content"`
+			} `json:"text"`
+		}{}
+		err = json.Unmarshal(raw, &tmp)
+		if err != nil {
+			log.Println("SaveOutboundMessage json.Unmarshal error", err)
+		}
+		doc.MsgType = tmp.MsgType
+		doc.Content = tmp.Text.Content
+	}
+
+	return mongodb.ModelWxMessage.InsertOne(ctx, doc)
+}
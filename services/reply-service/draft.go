@@ -0,0 +1,338 @@
+package replyservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"github.com/samber/lo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+ * 关注回复、关键词回复、消息回复的草稿
+ * 保存为草稿时只写入 draft_data，发布后才更新到 reply_data 等正式字段，和菜单点击回复一样
+ * 不保存为草稿时和原来一样直接生效，兼容原来的保存接口
+ * 新增的规则在发布前 reply_data 为空，不会被匹配到
+ * 菜单点击回复的草稿随菜单发布到微信时生效，不在这里处理
+ */
+
+var DraftReplyTypes = []string{
+	string(weixinservice.AutoReplyTypeSubscribe),
+	string(weixinservice.AutoReplyTypeKeyword),
+	string(weixinservice.AutoReplyTypeMessage),
+}
+
+const RevisionActionPublish = "publish"
+
+// 草稿的内容，draft_data 中保存的 json
+type AutoReplyDraft struct {
+	ReplyData   *weixinservice.AutoReplyData `json:"reply_data"`
+	RuleTitle   string                       `json:"rule_title,omitempty"`
+	Keywords    []string                     `json:"keywords,omitempty"`
+	KeywordsDef []*weixinservice.KeywordDef  `json:"keywords_def,omitempty"`
+	Priority    int                          `json:"priority,omitempty"`
+}
+
+// 待发布的修改
+type PendingDraft struct {
+	ID        string        `json:"id"`
+	ReplyType string        `json:"reply_type"`
+	RuleTitle string        `json:"rule_title"`
+	Change    string        `json:"change"` // created-新增，updated-修改
+	Diff      *RevisionDiff `json:"diff"`
+}
+
+func ParseAutoReplyDraft(str string) (*AutoReplyDraft, error) {
+	var ret AutoReplyDraft
+	err := json.Unmarshal([]byte(str), &ret)
+	if err != nil {
+		return nil, err
+	}
+	if ret.ReplyData == nil {
+		ret.ReplyData = &weixinservice.AutoReplyData{MsgList: make([]*weixinservice.AutoReplyMessage, 0)}
+	}
+	return &ret, nil
+}
+
+// 规则发布后的样子，没有草稿时为当前内容
+func ApplyAutoReplyDraft(doc *mongodb.EntityWeixinAutoReply) (*mongodb.EntityWeixinAutoReply, error) {
+	ret := *doc
+	if doc.DraftData == "" {
+		return &ret, nil
+	}
+	draft, err := ParseAutoReplyDraft(doc.DraftData)
+	if err != nil {
+		return nil, err
+	}
+	replyDataStr, err := json.Marshal(draft.ReplyData)
+	if err != nil {
+		return nil, err
+	}
+	ret.ReplyData = string(replyDataStr)
+	ret.RuleTitle = draft.RuleTitle
+	ret.Keywords = draft.Keywords
+	ret.KeywordsDef = ""
+	ret.Priority = draft.Priority
+	if doc.ReplyType == string(weixinservice.AutoReplyTypeKeyword) {
+		keywordsDefStr, err := json.Marshal(draft.KeywordsDef)
+		if err != nil {
+			return nil, err
+		}
+		ret.KeywordsDef = string(keywordsDefStr)
+	}
+	ret.DraftData = ""
+	return &ret, nil
+}
+
+/**
+ * 保存草稿
+ * @param id 为空时新增，关注回复和消息回复每个公众号只有一条，有则更新
+ * @return 规则的ID
+ */
+func SaveAutoReplyDraft(ctx context.Context, appid string, id string, replyType string, draft *AutoReplyDraft) (string, error) {
+	bs, err := json.Marshal(draft)
+	if err != nil {
+		return "", err
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "draft_data", Value: string(bs)}}}}
+
+	if id != "" {
+		objectID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return "", err
+		}
+		filter := bson.D{{Key: "_id", Value: objectID}, {Key: "appid", Value: appid}, {Key: "reply_type", Value: replyType}}
+		ret, err := mongodb.ModelWeixinAutoReply.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return "", err
+		}
+		if ret.MatchedCount <= 0 {
+			return "", errors.New("rule not found")
+		}
+		return id, nil
+	}
+
+	if replyType != string(weixinservice.AutoReplyTypeKeyword) {
+		filter := bson.D{{Key: "appid", Value: appid}, {Key: "reply_type", Value: replyType}}
+		doc, err := mongodb.ModelWeixinAutoReply.FindOneAndUpdate(ctx, filter, update, true)
+		if err != nil {
+			return "", err
+		}
+		return doc.ID.Hex(), nil
+	}
+
+	return mongodb.ModelWeixinAutoReply.InsertOne(ctx, &mongodb.EntityWeixinAutoReply{
+		AppID:     appid,
+		ReplyType: replyType,
+		DraftData: string(bs),
+	})
+}
+
+// 保存草稿，并记录一个 save_draft 版本
+func SaveAutoReplyDraftWithRevision(ctx context.Context, appid string, id string, replyType string, draft *AutoReplyDraft, userID, username string) (string, error) {
+	id, err := SaveAutoReplyDraft(ctx, appid, id, replyType, draft)
+	if err != nil {
+		return "", err
+	}
+	docs, err := findDraftDocs(ctx, appid, []string{id})
+	if err != nil {
+		return "", err
+	}
+	for _, doc := range docs {
+		next, err := ApplyAutoReplyDraft(doc)
+		if err != nil {
+			return "", err
+		}
+		_, err = RecordRevision(ctx, next, RevisionActionSaveDraft, userID, username)
+		if err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// 保存后直接发布，不经过草稿，记录一个 save 版本
+func SaveAndPublishAutoReply(ctx context.Context, appid string, id string, replyType string, draft *AutoReplyDraft, userID, username string) (string, error) {
+	id, err := SaveAutoReplyDraft(ctx, appid, id, replyType, draft)
+	if err != nil {
+		return "", err
+	}
+	docs, err := findDraftDocs(ctx, appid, []string{id})
+	if err != nil {
+		return "", err
+	}
+	_, err = publishDocs(ctx, docs, RevisionActionSave, userID, username)
+	return id, err
+}
+
+// 关注、关键词、消息回复的规则，有草稿的替换为草稿发布后的内容
+func GetRulesWithDrafts(ctx context.Context, appid string) ([]*mongodb.EntityWeixinAutoReply, error) {
+	findOptions := options.Find().SetSort(bson.D{{Key: "priority", Value: -1}, {Key: "created_at", Value: 1}})
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "reply_type", Value: bson.D{{Key: "$in", Value: DraftReplyTypes}}}}
+	docs, err := mongodb.ModelWeixinAutoReply.FindMany(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*mongodb.EntityWeixinAutoReply, 0, len(docs))
+	for _, doc := range docs {
+		next, err := ApplyAutoReplyDraft(doc)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, next)
+	}
+	return ret, nil
+}
+
+func findDraftDocs(ctx context.Context, appid string, ids []string) ([]*mongodb.EntityWeixinAutoReply, error) {
+	filter := bson.D{
+		{Key: "appid", Value: appid},
+		{Key: "reply_type", Value: bson.D{{Key: "$in", Value: DraftReplyTypes}}},
+		{Key: "draft_data", Value: bson.D{{Key: "$nin", Value: bson.A{"", nil}}}},
+	}
+	if len(ids) > 0 {
+		objectIDs := make([]primitive.ObjectID, 0, len(ids))
+		for _, id := range ids {
+			objectID, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				return nil, err
+			}
+			objectIDs = append(objectIDs, objectID)
+		}
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{{Key: "$in", Value: objectIDs}}})
+	}
+	findOptions := options.Find().SetSort(bson.D{{Key: "reply_type", Value: 1}, {Key: "created_at", Value: 1}})
+	return mongodb.ModelWeixinAutoReply.FindMany(ctx, filter, findOptions)
+}
+
+// 公众号所有待发布的修改
+func ListPendingDrafts(ctx context.Context, appid string) ([]*PendingDraft, error) {
+	docs, err := findDraftDocs(ctx, appid, nil)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*PendingDraft, 0, len(docs))
+	for _, doc := range docs {
+		next, err := ApplyAutoReplyDraft(doc)
+		if err != nil {
+			return nil, err
+		}
+		diff, err := DiffRevisions(ruleSnapshot(doc), ruleSnapshot(next))
+		if err != nil {
+			return nil, err
+		}
+		item := &PendingDraft{
+			ID:        doc.ID.Hex(),
+			ReplyType: doc.ReplyType,
+			RuleTitle: next.RuleTitle,
+			Change:    "updated",
+			Diff:      diff,
+		}
+		if doc.ReplyData == "" {
+			item.Change = "created"
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+func ruleSnapshot(doc *mongodb.EntityWeixinAutoReply) *mongodb.EntityWxAutoReplyRevision {
+	return &mongodb.EntityWxAutoReplyRevision{
+		ReplyType:   doc.ReplyType,
+		ReplyData:   doc.ReplyData,
+		RuleTitle:   doc.RuleTitle,
+		Keywords:    doc.Keywords,
+		KeywordsDef: doc.KeywordsDef,
+		Priority:    doc.Priority,
+	}
+}
+
+/**
+ * 发布草稿，ids 为空时发布公众号所有的草稿
+ * 发布前检查所有草稿，有错误时都不发布
+ * @return 发布的规则
+ */
+func PublishDrafts(ctx context.Context, appid string, ids []string, userID, username string) ([]*mongodb.EntityWeixinAutoReply, error) {
+	docs, err := findDraftDocs(ctx, appid, ids)
+	if err != nil {
+		return nil, err
+	}
+	return publishDocs(ctx, docs, RevisionActionPublish, userID, username)
+}
+
+// 把草稿写入正式字段，并记录版本
+func publishDocs(ctx context.Context, docs []*mongodb.EntityWeixinAutoReply, action string, userID, username string) ([]*mongodb.EntityWeixinAutoReply, error) {
+	nextList := make([]*mongodb.EntityWeixinAutoReply, 0, len(docs))
+	for _, doc := range docs {
+		next, err := ApplyAutoReplyDraft(doc)
+		if err != nil {
+			return nil, errors.New("草稿解析失败:" + doc.ID.Hex())
+		}
+		replyData, err := ParseAutoReplyData(next.ReplyData)
+		if err != nil {
+			return nil, err
+		}
+		if err := replyData.Validate(); err != nil {
+			return nil, errors.New("草稿错误:" + next.RuleTitle + " " + err.Error())
+		}
+		nextList = append(nextList, next)
+	}
+
+	for _, next := range nextList {
+		update := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "reply_data", Value: next.ReplyData},
+			{Key: "rule_title", Value: next.RuleTitle},
+			{Key: "keywords", Value: next.Keywords},
+			{Key: "keywords_def", Value: next.KeywordsDef},
+			{Key: "priority", Value: next.Priority},
+			{Key: "draft_data", Value: ""},
+		}}}
+		_, err := mongodb.ModelWeixinAutoReply.UpdateByID(ctx, next.ID.Hex(), update)
+		if err != nil {
+			return nil, err
+		}
+		_, err = RecordRevision(ctx, next, action, userID, username)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nextList, nil
+}
+
+// 丢弃草稿，ids 为空时丢弃公众号所有的草稿。从未发布过的规则直接删除
+func DiscardDrafts(ctx context.Context, appid string, ids []string) (int, error) {
+	docs, err := findDraftDocs(ctx, appid, ids)
+	if err != nil {
+		return 0, err
+	}
+
+	neverPublished := lo.Filter(docs, func(doc *mongodb.EntityWeixinAutoReply, _ int) bool {
+		return doc.ReplyData == ""
+	})
+	if len(neverPublished) > 0 {
+		filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: lo.Map(neverPublished, func(doc *mongodb.EntityWeixinAutoReply, _ int) primitive.ObjectID {
+			return doc.ID
+		})}}}}
+		_, err = mongodb.ModelWeixinAutoReply.DeleteMany(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, doc := range docs {
+		if doc.ReplyData == "" {
+			continue
+		}
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "draft_data", Value: ""}}}}
+		_, err = mongodb.ModelWeixinAutoReply.UpdateByID(ctx, doc.ID.Hex(), update)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(docs), nil
+}
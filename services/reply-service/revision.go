@@ -0,0 +1,307 @@
+package replyservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+ * 自动回复规则的历史版本
+ * 每次保存、保存草稿、发布、删除、恢复后都写入一个新版本，保存完整的规则内容和与上一个版本的差异
+ * 恢复旧版本时用旧版本的内容覆盖当前规则，规则已经删除的按原来的ID重新插入
+ */
+
+const (
+	RevisionActionSave      = "save"
+	RevisionActionSaveDraft = "save_draft" // 保存为草稿，版本的内容是草稿发布后的样子
+	RevisionActionDelete    = "delete"
+	RevisionActionRestore   = "restore"
+)
+
+// 同一个规则同时保存时版本号会冲突，重新读取最新的版本后重试
+const recordRevisionMaxAttempts = 5
+
+// 版本之间的差异
+type RevisionDiff struct {
+	RuleTitle       *RevisionValueChange        `json:"rule_title,omitempty"`
+	Priority        *RevisionValueChange        `json:"priority,omitempty"`
+	KeywordsAdded   []*weixinservice.KeywordDef `json:"keywords_added,omitempty"`
+	KeywordsRemoved []*weixinservice.KeywordDef `json:"keywords_removed,omitempty"`
+	Messages        []*RevisionMessageDiff      `json:"messages,omitempty"`
+	Options         []string                    `json:"options,omitempty"` // 发生变化的其他配置，reply_all strategy schedule variants
+}
+
+type RevisionValueChange struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+type RevisionMessageDiff struct {
+	Index  int                             `json:"index"`
+	Change string                          `json:"change"` // added, removed, changed
+	Before *weixinservice.AutoReplyMessage `json:"before,omitempty"`
+	After  *weixinservice.AutoReplyMessage `json:"after,omitempty"`
+}
+
+// 记录规则当前的内容为一个新版本，同时和上一个版本比较得到差异
+func RecordRevision(ctx context.Context, rule *mongodb.EntityWeixinAutoReply, action string, userID, username string) (*mongodb.EntityWxAutoReplyRevision, error) {
+	var err error
+	for i := 0; i < recordRevisionMaxAttempts; i++ {
+		var rev *mongodb.EntityWxAutoReplyRevision
+		rev, err = insertRevision(ctx, rule, action, userID, username)
+		if err == nil {
+			return rev, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func insertRevision(ctx context.Context, rule *mongodb.EntityWeixinAutoReply, action string, userID, username string) (*mongodb.EntityWxAutoReplyRevision, error) {
+	ruleID := rule.ID.Hex()
+	last, err := getLatestRevision(ctx, rule.AppID, ruleID)
+	if err != nil {
+		return nil, err
+	}
+
+	rev := &mongodb.EntityWxAutoReplyRevision{
+		AppID:       rule.AppID,
+		RuleID:      ruleID,
+		Revision:    1,
+		Action:      action,
+		UserID:      userID,
+		Username:    username,
+		ReplyType:   rule.ReplyType,
+		ReplyData:   rule.ReplyData,
+		RuleTitle:   rule.RuleTitle,
+		Keywords:    rule.Keywords,
+		KeywordsDef: rule.KeywordsDef,
+		Priority:    rule.Priority,
+	}
+	prev := &mongodb.EntityWxAutoReplyRevision{}
+	if last != nil {
+		rev.Revision = last.Revision + 1
+		prev = last
+	}
+	diff, err := DiffRevisions(prev, rev)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := json.Marshal(diff)
+	if err != nil {
+		return nil, err
+	}
+	rev.Diff = string(bs)
+
+	id, err := mongodb.ModelWxAutoReplyRevision.InsertOne(ctx, rev)
+	if err != nil {
+		return nil, err
+	}
+	rev.ID, _ = primitive.ObjectIDFromHex(id)
+	return rev, nil
+}
+
+func getLatestRevision(ctx context.Context, appid, ruleID string) (*mongodb.EntityWxAutoReplyRevision, error) {
+	findOptions := options.Find().SetSort(bson.D{{Key: "revision", Value: -1}}).SetLimit(1)
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "rule_id", Value: ruleID}}
+	docs, err := mongodb.ModelWxAutoReplyRevision.FindMany(ctx, filter, findOptions)
+	if err != nil || len(docs) <= 0 {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+// 规则的所有版本，新的在前
+func ListRevisions(ctx context.Context, appid, ruleID string) ([]*mongodb.EntityWxAutoReplyRevision, error) {
+	findOptions := options.Find().SetSort(bson.D{{Key: "revision", Value: -1}})
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "rule_id", Value: ruleID}}
+	return mongodb.ModelWxAutoReplyRevision.FindMany(ctx, filter, findOptions)
+}
+
+func GetRevision(ctx context.Context, appid, ruleID string, revision int) (*mongodb.EntityWxAutoReplyRevision, error) {
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "rule_id", Value: ruleID}, {Key: "revision", Value: revision}}
+	doc, err := mongodb.ModelWxAutoReplyRevision.FindOne(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, errors.New("revision not found")
+	}
+	return doc, nil
+}
+
+// 比较两个版本，from 到 to 的变化
+func DiffRevisions(from, to *mongodb.EntityWxAutoReplyRevision) (*RevisionDiff, error) {
+	diff := &RevisionDiff{}
+	if from.RuleTitle != to.RuleTitle {
+		diff.RuleTitle = &RevisionValueChange{Before: from.RuleTitle, After: to.RuleTitle}
+	}
+	if from.Priority != to.Priority {
+		diff.Priority = &RevisionValueChange{Before: from.Priority, After: to.Priority}
+	}
+
+	fromDefs, err := parseKeywordsDef(from.KeywordsDef)
+	if err != nil {
+		return nil, err
+	}
+	toDefs, err := parseKeywordsDef(to.KeywordsDef)
+	if err != nil {
+		return nil, err
+	}
+	diff.KeywordsAdded = keywordDefsMinus(toDefs, fromDefs)
+	diff.KeywordsRemoved = keywordDefsMinus(fromDefs, toDefs)
+
+	fromData, err := ParseAutoReplyData(from.ReplyData)
+	if err != nil {
+		return nil, err
+	}
+	toData, err := ParseAutoReplyData(to.ReplyData)
+	if err != nil {
+		return nil, err
+	}
+	n := max(len(fromData.MsgList), len(toData.MsgList))
+	for i := 0; i < n; i++ {
+		var before, after *weixinservice.AutoReplyMessage
+		if i < len(fromData.MsgList) {
+			before = fromData.MsgList[i]
+		}
+		if i < len(toData.MsgList) {
+			after = toData.MsgList[i]
+		}
+		switch {
+		case before == nil:
+			diff.Messages = append(diff.Messages, &RevisionMessageDiff{Index: i, Change: "added", After: after})
+		case after == nil:
+			diff.Messages = append(diff.Messages, &RevisionMessageDiff{Index: i, Change: "removed", Before: before})
+		case !jsonEqual(before, after):
+			diff.Messages = append(diff.Messages, &RevisionMessageDiff{Index: i, Change: "changed", Before: before, After: after})
+		}
+	}
+
+	if fromData.ReplyAll != toData.ReplyAll {
+		diff.Options = append(diff.Options, "reply_all")
+	}
+	if fromData.Strategy != toData.Strategy {
+		diff.Options = append(diff.Options, "strategy")
+	}
+	if !jsonEqual(fromData.Schedule, toData.Schedule) {
+		diff.Options = append(diff.Options, "schedule")
+	}
+	if !jsonEqual(fromData.Variants, toData.Variants) {
+		diff.Options = append(diff.Options, "variants")
+	}
+	return diff, nil
+}
+
+func parseKeywordsDef(str string) ([]*weixinservice.KeywordDef, error) {
+	defs := []*weixinservice.KeywordDef{}
+	if str == "" {
+		return defs, nil
+	}
+	err := json.Unmarshal([]byte(str), &defs)
+	return defs, err
+}
+
+// a 中有而 b 中没有的关键词
+func keywordDefsMinus(a, b []*weixinservice.KeywordDef) []*weixinservice.KeywordDef {
+	keys := make(map[weixinservice.KeywordDef]bool)
+	for _, def := range b {
+		keys[*def] = true
+	}
+	var ret []*weixinservice.KeywordDef
+	for _, def := range a {
+		if !keys[*def] {
+			ret = append(ret, def)
+		}
+	}
+	return ret
+}
+
+func jsonEqual(a, b any) bool {
+	as, _ := json.Marshal(a)
+	bs, _ := json.Marshal(b)
+	return string(as) == string(bs)
+}
+
+// 把规则恢复为某个版本的内容，返回恢复后的规则
+func RestoreRevision(ctx context.Context, appid, ruleID string, revision int, userID, username string) (*mongodb.EntityWeixinAutoReply, error) {
+	rev, err := GetRevision(ctx, appid, ruleID, revision)
+	if err != nil {
+		return nil, err
+	}
+	if rev.Action == RevisionActionDelete {
+		return nil, errors.New("不能恢复为删除的版本")
+	}
+
+	rule, err := mongodb.ModelWeixinAutoReply.FindByID(ctx, ruleID)
+	if err != nil {
+		return nil, err
+	}
+	if rule != nil && rule.AppID != appid {
+		return nil, errors.New("rule not found")
+	}
+
+	if rule == nil {
+		// 关注回复和消息回复只能有一条，已经有新的时不能恢复被删除的
+		if rev.ReplyType != string(weixinservice.AutoReplyTypeKeyword) {
+			filter := bson.D{{Key: "appid", Value: appid}, {Key: "reply_type", Value: rev.ReplyType}}
+			exists, err := mongodb.ModelWeixinAutoReply.FindOne(ctx, filter)
+			if err != nil {
+				return nil, err
+			}
+			if exists != nil {
+				return nil, errors.New("已经存在同类型的回复，不能恢复")
+			}
+		}
+		objectID, err := primitive.ObjectIDFromHex(ruleID)
+		if err != nil {
+			return nil, err
+		}
+		rule = &mongodb.EntityWeixinAutoReply{ID: objectID, AppID: appid, ReplyType: rev.ReplyType}
+		rule.ReplyData = rev.ReplyData
+		rule.RuleTitle = rev.RuleTitle
+		rule.Keywords = rev.Keywords
+		rule.KeywordsDef = rev.KeywordsDef
+		rule.Priority = rev.Priority
+		_, err = mongodb.ModelWeixinAutoReply.InsertOne(ctx, rule)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// 同时清掉草稿，否则之后发布草稿会覆盖恢复的内容
+		update := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "reply_data", Value: rev.ReplyData},
+			{Key: "rule_title", Value: rev.RuleTitle},
+			{Key: "keywords", Value: rev.Keywords},
+			{Key: "keywords_def", Value: rev.KeywordsDef},
+			{Key: "priority", Value: rev.Priority},
+			{Key: "draft_data", Value: ""},
+		}}}
+		_, err = mongodb.ModelWeixinAutoReply.UpdateByID(ctx, ruleID, update)
+		if err != nil {
+			return nil, err
+		}
+		rule.ReplyData = rev.ReplyData
+		rule.RuleTitle = rev.RuleTitle
+		rule.Keywords = rev.Keywords
+		rule.KeywordsDef = rev.KeywordsDef
+		rule.Priority = rev.Priority
+		rule.DraftData = ""
+	}
+
+	_, err = RecordRevision(ctx, rule, RevisionActionRestore, userID, username)
+	if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
@@ -0,0 +1,656 @@
+package replyservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	appidservice "github.com/anchel/wechat-official-account-admin/services/appid-service"
+	weixinservice "github.com/anchel/wechat-official-account-admin/services/weixin-service"
+	"github.com/anchel/wechat-official-account-admin/wxmp/wxapi"
+	"github.com/samber/lo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v3"
+)
+
+/**
+ * 自动回复规则的导入导出，用于在测试号和正式号之间迁移
+ * 导出的文档带版本号，格式为 json 或 yaml，yaml 的字段名和 json 保持一致
+ * 导入时先整体校验，有错误时不做任何修改。dry_run 只返回报告
+ * merge-按规则名称、回复类型合并，已有的会被覆盖。replace-导入后删除原有的关注、消息、关键词回复
+ * replace 先写入新规则再删除旧规则，中途失败时旧规则还在，不会丢失，重新导入即可
+ * 写入和删除的规则都记录历史版本，可以在版本列表中恢复
+ * 菜单点击回复先按本地的菜单ID找菜单，跨公众号时菜单ID不同，改为找点击菜单的 key 重合最多的菜单
+ * 找不到菜单时跳过，菜单回复只写入草稿，随菜单发布生效
+ */
+
+const ReplyRulesVersion = 1
+
+const (
+	ReplyRulesFormatJSON = "json"
+	ReplyRulesFormatYAML = "yaml"
+
+	ReplyRulesImportMerge   = "merge"
+	ReplyRulesImportReplace = "replace"
+
+	RevisionActionImport = "import"
+)
+
+// 公众号的回复开关
+type ReplyRulesEnabled struct {
+	Keyword         bool `json:"keyword"`
+	Message         bool `json:"message"`
+	Subscribe       bool `json:"subscribe"`
+	KeywordMatchAll bool `json:"keyword_match_all"`
+}
+
+type ReplyRuleItem struct {
+	ReplyType string                       `json:"reply_type"` // subscribe, keyword, message, menu_click
+	ReplyData *weixinservice.AutoReplyData `json:"reply_data,omitempty"`
+
+	RuleTitle   string                      `json:"rule_title,omitempty"`
+	Keywords    []string                    `json:"keywords,omitempty"`
+	KeywordsDef []*weixinservice.KeywordDef `json:"keywords_def,omitempty"`
+	Priority    int                         `json:"priority,omitempty"`
+
+	ExtId         string                                  `json:"ext_id,omitempty"`          // menu_click时有效，本地的菜单ID
+	MenuReplyData map[string]*weixinservice.AutoReplyData `json:"menu_reply_data,omitempty"` // menu_click时有效，key为菜单的key
+}
+
+type ReplyRulesDocument struct {
+	Version    int                `json:"version"`
+	AppID      string             `json:"appid"`
+	ExportedAt string             `json:"exported_at"`
+	Enabled    *ReplyRulesEnabled `json:"enabled,omitempty"`
+	Rules      []*ReplyRuleItem   `json:"rules"`
+}
+
+type ReplyRulesImportIssue struct {
+	Index     int    `json:"index"` // 规则在文档中的下标，-1表示整个文档
+	ReplyType string `json:"reply_type,omitempty"`
+	RuleTitle string `json:"rule_title,omitempty"`
+	Message   string `json:"message"`
+}
+
+type ReplyRulesImportReport struct {
+	DryRun    bool                     `json:"dry_run"`
+	Mode      string                   `json:"mode"`
+	Applied   bool                     `json:"applied"`
+	Created   int                      `json:"created"`
+	Updated   int                      `json:"updated"`
+	Deleted   int                      `json:"deleted"`
+	Skipped   int                      `json:"skipped"`
+	Errors    []*ReplyRulesImportIssue `json:"errors"`
+	Conflicts []*ReplyRulesImportIssue `json:"conflicts"`
+}
+
+func (r *ReplyRulesImportReport) addError(idx int, item *ReplyRuleItem, format string, args ...any) {
+	r.Errors = append(r.Errors, newImportIssue(idx, item, fmt.Sprintf(format, args...)))
+}
+
+func (r *ReplyRulesImportReport) addConflict(idx int, item *ReplyRuleItem, format string, args ...any) {
+	r.Conflicts = append(r.Conflicts, newImportIssue(idx, item, fmt.Sprintf(format, args...)))
+}
+
+func newImportIssue(idx int, item *ReplyRuleItem, msg string) *ReplyRulesImportIssue {
+	issue := &ReplyRulesImportIssue{Index: idx, Message: msg}
+	if item != nil {
+		issue.ReplyType = item.ReplyType
+		issue.RuleTitle = item.RuleTitle
+	}
+	return issue
+}
+
+// 导出公众号的所有自动回复规则
+func ExportReplyRules(ctx context.Context, appid string) (*ReplyRulesDocument, error) {
+	enabled, err := appidservice.GetAppEnabledData(ctx, appid)
+	if err != nil {
+		return nil, err
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "reply_type", Value: 1}, {Key: "priority", Value: -1}, {Key: "created_at", Value: 1}})
+	docs, err := mongodb.ModelWeixinAutoReply.FindMany(ctx, bson.D{{Key: "appid", Value: appid}}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &ReplyRulesDocument{
+		Version:    ReplyRulesVersion,
+		AppID:      appid,
+		ExportedAt: time.Now().Format(time.DateTime),
+		Enabled: &ReplyRulesEnabled{
+			Keyword:         enabled.EnabledAutoReplyKeyword,
+			Message:         enabled.EnabledAutoReplyMessage,
+			Subscribe:       enabled.EnabledAutoReplySubscribe,
+			KeywordMatchAll: enabled.KeywordMatchAll,
+		},
+		Rules: make([]*ReplyRuleItem, 0, len(docs)),
+	}
+	for _, doc := range docs {
+		item := &ReplyRuleItem{ReplyType: doc.ReplyType}
+		if doc.ReplyType == string(weixinservice.AutoReplyTypeMenuClick) {
+			item.ExtId = doc.ExtId
+			if doc.ReplyData == "" {
+				continue
+			}
+			err = json.Unmarshal([]byte(doc.ReplyData), &item.MenuReplyData)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			item.ReplyData, err = ParseAutoReplyData(doc.ReplyData)
+			if err != nil {
+				return nil, err
+			}
+			item.RuleTitle = doc.RuleTitle
+			item.Keywords = doc.Keywords
+			item.Priority = doc.Priority
+			if doc.KeywordsDef != "" {
+				err = json.Unmarshal([]byte(doc.KeywordsDef), &item.KeywordsDef)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		ret.Rules = append(ret.Rules, item)
+	}
+	return ret, nil
+}
+
+// 序列化导出的文档
+func EncodeReplyRules(doc *ReplyRulesDocument, format string) ([]byte, error) {
+	bs, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if format != ReplyRulesFormatYAML {
+		return bs, nil
+	}
+	// 先转成通用的结构，yaml 的字段名才能和 json 一致
+	var v any
+	err = json.Unmarshal(bs, &v)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(v)
+}
+
+// 解析导入的文档
+func DecodeReplyRules(data []byte, format string) (*ReplyRulesDocument, error) {
+	bs := data
+	if format == ReplyRulesFormatYAML {
+		var v any
+		err := yaml.Unmarshal(data, &v)
+		if err != nil {
+			return nil, err
+		}
+		bs, err = json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var doc ReplyRulesDocument
+	err := json.Unmarshal(bs, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// 导入到公众号，有错误或者 dryRun 时不做修改
+func ImportReplyRules(ctx context.Context, appid string, doc *ReplyRulesDocument, mode string, dryRun bool, userID, username string) (*ReplyRulesImportReport, error) {
+	report := &ReplyRulesImportReport{
+		DryRun:    dryRun,
+		Mode:      mode,
+		Errors:    []*ReplyRulesImportIssue{},
+		Conflicts: []*ReplyRulesImportIssue{},
+	}
+	if mode != ReplyRulesImportMerge && mode != ReplyRulesImportReplace {
+		return nil, errors.New("mode error")
+	}
+	if doc.Version <= 0 || doc.Version > ReplyRulesVersion {
+		report.addError(-1, nil, "不支持的版本: %d", doc.Version)
+		return report, nil
+	}
+
+	validateReplyRules(doc, report)
+	err := validateReplyRulesMedia(ctx, appid, doc, report)
+	if err != nil {
+		return nil, err
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	existing, err := mongodb.ModelWeixinAutoReply.FindMany(ctx, bson.D{{Key: "appid", Value: appid}}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	ops, replaced := planReplyRulesImport(ctx, appid, doc, existing, mode, report)
+	if len(report.Errors) > 0 || dryRun {
+		return report, nil
+	}
+
+	var savedIDs []string
+	for _, op := range ops {
+		id, err := op()
+		if err != nil {
+			return nil, err
+		}
+		if id != "" {
+			savedIDs = append(savedIDs, id)
+		}
+	}
+	for _, id := range savedIDs {
+		rule, err := mongodb.ModelWeixinAutoReply.FindByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if rule == nil {
+			continue
+		}
+		_, err = RecordRevision(ctx, rule, RevisionActionImport, userID, username)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 新规则都写入后再删除被替换的规则，删除前记录一个版本，之后还可以恢复
+	if len(replaced) > 0 {
+		for _, rule := range replaced {
+			_, err = RecordRevision(ctx, rule, RevisionActionDelete, userID, username)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ids := lo.Map(replaced, func(rule *mongodb.EntityWeixinAutoReply, _ int) primitive.ObjectID { return rule.ID })
+		_, err = mongodb.ModelWeixinAutoReply.DeleteMany(ctx, bson.D{{Key: "appid", Value: appid}, {Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if doc.Enabled != nil {
+		enabledMap := map[string]bool{
+			"keyword":           doc.Enabled.Keyword,
+			"message":           doc.Enabled.Message,
+			"subscribe":         doc.Enabled.Subscribe,
+			"keyword_match_all": doc.Enabled.KeywordMatchAll,
+		}
+		for k, v := range enabledMap {
+			err = appidservice.SetAppEnabledData(ctx, appid, k, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	report.Applied = true
+	return report, nil
+}
+
+// 检查每条规则本身是否正确
+func validateReplyRules(doc *ReplyRulesDocument, report *ReplyRulesImportReport) {
+	singles := make(map[string]int)
+	titles := make(map[string]int)
+	for idx, item := range doc.Rules {
+		if item == nil {
+			report.addError(idx, nil, "规则为空")
+			continue
+		}
+		switch weixinservice.AutoReplyType(item.ReplyType) {
+		case weixinservice.AutoReplyTypeSubscribe, weixinservice.AutoReplyTypeMessage:
+			if first, ok := singles[item.ReplyType]; ok {
+				report.addError(idx, item, "和第 %d 条规则重复，每个公众号只能有一条", first)
+				continue
+			}
+			singles[item.ReplyType] = idx
+		case weixinservice.AutoReplyTypeKeyword:
+			if item.RuleTitle == "" || len(item.KeywordsDef) <= 0 {
+				report.addError(idx, item, "规则名称和关键词不能为空")
+				continue
+			}
+			if first, ok := titles[item.RuleTitle]; ok {
+				report.addError(idx, item, "和第 %d 条规则的名称重复", first)
+				continue
+			}
+			titles[item.RuleTitle] = idx
+			for _, def := range item.KeywordsDef {
+				if def == nil || def.Keyword == "" {
+					report.addError(idx, item, "关键词不能为空")
+					break
+				}
+				if !def.Regex {
+					continue
+				}
+				if _, err := weixinservice.CompileKeywordRegex(def); err != nil {
+					report.addError(idx, item, "正则表达式错误: %s", def.Keyword)
+				}
+			}
+		case weixinservice.AutoReplyTypeMenuClick:
+			if item.ExtId == "" {
+				report.addError(idx, item, "菜单ID不能为空")
+				continue
+			}
+			for key, data := range item.MenuReplyData {
+				if data == nil {
+					report.addError(idx, item, "菜单 %s 的回复为空", key)
+				} else if err := data.Validate(); err != nil {
+					report.addError(idx, item, "菜单 %s 的回复错误: %s", key, err.Error())
+				}
+			}
+			continue
+		default:
+			report.addError(idx, item, "回复类型错误: %s", item.ReplyType)
+			continue
+		}
+
+		if item.ReplyData == nil {
+			report.addError(idx, item, "回复内容为空")
+		} else if err := item.ReplyData.Validate(); err != nil {
+			report.addError(idx, item, "回复内容错误: %s", err.Error())
+		}
+	}
+}
+
+// 检查引用的 media_id 在目标公众号的素材中是否存在，临时素材还要检查是否过期
+func validateReplyRulesMedia(ctx context.Context, appid string, doc *ReplyRulesDocument, report *ReplyRulesImportReport) error {
+	refs := make(map[string][]int) // media_id -> 规则下标
+	for idx, item := range doc.Rules {
+		if item == nil {
+			continue
+		}
+		add := func(mediaId string) {
+			if mediaId != "" && !lo.Contains(refs[mediaId], idx) {
+				refs[mediaId] = append(refs[mediaId], idx)
+			}
+		}
+		collectReplyDataMedia(item.ReplyData, add)
+		for _, data := range item.MenuReplyData {
+			collectReplyDataMedia(data, add)
+		}
+	}
+	if len(refs) <= 0 {
+		return nil
+	}
+
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "media_id", Value: bson.D{{Key: "$in", Value: lo.Keys(refs)}}}}
+	materials, err := mongodb.ModelWeixinMaterial.FindMany(ctx, filter, options.Find())
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	found := make(map[string]*mongodb.EntityWeixinMaterial)
+	for _, m := range materials {
+		found[m.MediaId] = m
+	}
+
+	for _, mediaId := range lo.Keys(refs) {
+		m, ok := found[mediaId]
+		msg := ""
+		if !ok {
+			msg = "素材不存在于目标公众号: %s"
+		} else if m.MediaCat == "temp" && m.ExpiresAt != nil && m.ExpiresAt.Before(now) {
+			msg = "临时素材已过期: %s"
+		}
+		if msg == "" {
+			continue
+		}
+		for _, idx := range refs[mediaId] {
+			report.addError(idx, doc.Rules[idx], msg, mediaId)
+		}
+	}
+	return nil
+}
+
+func collectReplyDataMedia(data *weixinservice.AutoReplyData, add func(string)) {
+	if data == nil {
+		return
+	}
+	for _, msg := range data.MsgList {
+		if msg == nil {
+			continue
+		}
+		add(msg.MediaId)
+		add(msg.ThumbMediaId)
+	}
+	for _, v := range data.Variants {
+		collectReplyDataMedia(v, add)
+	}
+}
+
+// 导入的一步修改，返回写入的关注、消息、关键词规则的ID，用于记录版本，菜单回复的草稿返回空
+type replyRulesImportOp func() (string, error)
+
+/**
+ * 生成要执行的修改，同时记录冲突
+ * @return 要执行的修改，以及 replace 时要删除的旧规则
+ */
+func planReplyRulesImport(ctx context.Context, appid string, doc *ReplyRulesDocument, existing []*mongodb.EntityWeixinAutoReply, mode string, report *ReplyRulesImportReport) ([]replyRulesImportOp, []*mongodb.EntityWeixinAutoReply) {
+	var ops []replyRulesImportOp
+
+	replaceTypes := []string{string(weixinservice.AutoReplyTypeSubscribe), string(weixinservice.AutoReplyTypeMessage), string(weixinservice.AutoReplyTypeKeyword)}
+	var kept, replaced []*mongodb.EntityWeixinAutoReply
+	for _, e := range existing {
+		if mode == ReplyRulesImportReplace && lo.Contains(replaceTypes, e.ReplyType) {
+			report.Deleted++
+			replaced = append(replaced, e)
+			continue
+		}
+		kept = append(kept, e)
+	}
+
+	for idx, item := range doc.Rules {
+		if item == nil {
+			continue
+		}
+
+		if item.ReplyType == string(weixinservice.AutoReplyTypeMenuClick) {
+			ops = append(ops, planMenuReplyImport(ctx, appid, idx, item, kept, report)...)
+			continue
+		}
+
+		replyDataStr, err := json.Marshal(item.ReplyData)
+		if err != nil {
+			report.addError(idx, item, "转换回复内容失败")
+			continue
+		}
+		keywordsDefStr := ""
+		if item.ReplyType == string(weixinservice.AutoReplyTypeKeyword) {
+			bs, err := json.Marshal(item.KeywordsDef)
+			if err != nil {
+				report.addError(idx, item, "转换关键词失败")
+				continue
+			}
+			keywordsDefStr = string(bs)
+		}
+
+		// 合并时，关注和消息回复按类型、关键词回复按名称找到已有的规则
+		var target *mongodb.EntityWeixinAutoReply
+		for _, e := range kept {
+			if e.ReplyType != item.ReplyType {
+				continue
+			}
+			if item.ReplyType != string(weixinservice.AutoReplyTypeKeyword) || e.RuleTitle == item.RuleTitle {
+				target = e
+				break
+			}
+		}
+		if item.ReplyType == string(weixinservice.AutoReplyTypeKeyword) {
+			checkKeywordConflicts(idx, item, kept, target, report)
+		}
+
+		if target != nil {
+			report.addConflict(idx, item, "覆盖已有的规则")
+			if target.DraftData != "" {
+				report.addConflict(idx, item, "丢弃已有规则未发布的草稿")
+			}
+			report.Updated++
+			id := target.ID
+			ops = append(ops, func() (string, error) {
+				update := bson.D{{Key: "$set", Value: bson.D{
+					{Key: "reply_data", Value: string(replyDataStr)},
+					{Key: "rule_title", Value: item.RuleTitle},
+					{Key: "keywords", Value: item.Keywords},
+					{Key: "keywords_def", Value: keywordsDefStr},
+					{Key: "priority", Value: item.Priority},
+					{Key: "draft_data", Value: ""}, // 导入的内容直接生效，丢弃原来的草稿，避免之后发布时被覆盖
+				}}}
+				_, err := mongodb.ModelWeixinAutoReply.UpdateByID(ctx, id.Hex(), update)
+				return id.Hex(), err
+			})
+			continue
+		}
+
+		report.Created++
+		ops = append(ops, func() (string, error) {
+			return mongodb.ModelWeixinAutoReply.InsertOne(ctx, &mongodb.EntityWeixinAutoReply{
+				AppID:       appid,
+				ReplyType:   item.ReplyType,
+				ReplyData:   string(replyDataStr),
+				RuleTitle:   item.RuleTitle,
+				Keywords:    item.Keywords,
+				KeywordsDef: keywordsDefStr,
+				Priority:    item.Priority,
+			})
+		})
+	}
+	return ops, replaced
+}
+
+// 关键词和其他已有规则的关键词相同时，记录冲突，按优先级只有一个会生效
+func checkKeywordConflicts(idx int, item *ReplyRuleItem, kept []*mongodb.EntityWeixinAutoReply, target *mongodb.EntityWeixinAutoReply, report *ReplyRulesImportReport) {
+	keys := make(map[string]bool)
+	for _, def := range item.KeywordsDef {
+		keys[keywordDefKey(def)] = true
+	}
+	for _, e := range kept {
+		if e.ReplyType != item.ReplyType || e == target || e.KeywordsDef == "" {
+			continue
+		}
+		defs := []*weixinservice.KeywordDef{}
+		if json.Unmarshal([]byte(e.KeywordsDef), &defs) != nil {
+			continue
+		}
+		for _, def := range defs {
+			if keys[keywordDefKey(def)] {
+				report.addConflict(idx, item, "关键词 %s 和已有规则 %s 重复", def.Keyword, e.RuleTitle)
+			}
+		}
+	}
+}
+
+func keywordDefKey(def *weixinservice.KeywordDef) string {
+	k := def.Keyword
+	if def.IgnoreCase && !def.Regex {
+		k = weixinservice.NormalizeKeyword(k)
+	}
+	return fmt.Sprintf("%t|%t|%t|%s", def.Exact, def.Regex, def.IgnoreCase, k)
+}
+
+// 菜单点击回复，目标公众号有对应的菜单时写入草稿
+func planMenuReplyImport(ctx context.Context, appid string, idx int, item *ReplyRuleItem, kept []*mongodb.EntityWeixinAutoReply, report *ReplyRulesImportReport) []replyRulesImportOp {
+	menu, keys, err := findImportMenu(ctx, appid, item)
+	if err != nil {
+		report.addError(idx, item, "查询菜单失败: %s", err.Error())
+		return nil
+	}
+	if menu == nil {
+		report.addConflict(idx, item, "目标公众号没有包含这些菜单 key 的菜单，跳过")
+		report.Skipped++
+		return nil
+	}
+	extId := menu.ID.Hex()
+	if extId != item.ExtId {
+		report.addConflict(idx, item, "按菜单 key 匹配到目标公众号的菜单 %s", extId)
+	}
+	for key := range item.MenuReplyData {
+		if !keys[key] {
+			report.addConflict(idx, item, "目标菜单中没有 key %s，这个回复不会生效", key)
+		}
+	}
+
+	bs, err := json.Marshal(item.MenuReplyData)
+	if err != nil {
+		report.addError(idx, item, "转换回复内容失败")
+		return nil
+	}
+
+	_, exists := lo.Find(kept, func(e *mongodb.EntityWeixinAutoReply) bool {
+		return e.ReplyType == item.ReplyType && e.ExtId == extId
+	})
+	if exists {
+		report.addConflict(idx, item, "覆盖已有的菜单回复草稿")
+		report.Updated++
+	} else {
+		report.Created++
+	}
+	return []replyRulesImportOp{func() (string, error) {
+		filter := bson.D{{Key: "appid", Value: appid}, {Key: "reply_type", Value: item.ReplyType}, {Key: "ext_id", Value: extId}}
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "draft_data", Value: string(bs)}}}}
+		_, err := mongodb.ModelWeixinAutoReply.FindOneAndUpdate(ctx, filter, update, true)
+		return "", err
+	}}
+}
+
+/**
+ * 导入菜单回复的目标菜单，以及菜单中点击菜单的 key
+ * 同一个公众号重新导入时菜单ID不变，直接使用；否则选 key 重合最多的菜单，一个都没有时返回nil
+ */
+func findImportMenu(ctx context.Context, appid string, item *ReplyRuleItem) (*mongodb.EntityMenu, map[string]bool, error) {
+	if objectID, err := primitive.ObjectIDFromHex(item.ExtId); err == nil {
+		menu, err := mongodb.ModelMenu.FindOne(ctx, bson.D{{Key: "_id", Value: objectID}, {Key: "appid", Value: appid}})
+		if err != nil {
+			return nil, nil, err
+		}
+		if menu != nil {
+			return menu, menuClickKeys(menu), nil
+		}
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	menus, err := mongodb.ModelMenu.FindMany(ctx, bson.D{{Key: "appid", Value: appid}}, findOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	var best *mongodb.EntityMenu
+	var bestKeys map[string]bool
+	bestCount := 0
+	for _, menu := range menus {
+		keys := menuClickKeys(menu)
+		count := 0
+		for key := range item.MenuReplyData {
+			if keys[key] {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestKeys, bestCount = menu, keys, count
+		}
+	}
+	return best, bestKeys, nil
+}
+
+// 菜单中所有点击菜单的 key，包括子菜单
+func menuClickKeys(menu *mongodb.EntityMenu) map[string]bool {
+	var menuData struct {
+		Button []*wxapi.MenuButtonItemApiFormat `json:"button"`
+	}
+	keys := make(map[string]bool)
+	if err := json.Unmarshal([]byte(menu.MenuData), &menuData); err != nil {
+		return keys
+	}
+	var walk func(buttons []*wxapi.MenuButtonItemApiFormat)
+	walk = func(buttons []*wxapi.MenuButtonItemApiFormat) {
+		for _, b := range buttons {
+			if b.Type == "click" && b.Key != "" {
+				keys[b.Key] = true
+			}
+			walk(b.SubButton)
+		}
+	}
+	walk(menuData.Button)
+	return keys
+}
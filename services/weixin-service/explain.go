@@ -0,0 +1,202 @@
+package weixinservice
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	appidservice "github.com/anchel/wechat-official-account-admin/services/appid-service"
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+ * 解释一条消息会得到什么回复，以 dryRun 调用 GetReplyMessages，判断的过程由 ExplainResult 记录
+ * 返回所有匹配到的规则、最终生效的规则和原因、回复开关的状态、以及替换模板变量后的消息
+ * 不会发送消息，也不改变轮流等策略的状态、不记录命中次数、不调用外部回复
+ */
+
+type ExplainRule struct {
+	Source    string     `json:"source"` // keyword, common, qrcode, menu
+	RuleID    string     `json:"rule_id,omitempty"`
+	RuleKey   string     `json:"rule_key"`
+	RuleTitle string     `json:"rule_title,omitempty"`
+	Priority  int        `json:"priority"`
+	Keyword   string     `json:"keyword,omitempty"` // 匹配到的关键词
+	MatchType string     `json:"match_type,omitempty"`
+	Pick      *ReplyPick `json:"pick"`
+	Winner    bool       `json:"winner"`
+	Reason    string     `json:"reason"`
+}
+
+type ExplainResult struct {
+	ReplyType     AutoReplyType       `json:"reply_type"`
+	Enabled       map[string]bool     `json:"enabled"` // 检查过的回复开关
+	MatchAll      bool                `json:"match_all"`
+	Rules         []*ExplainRule      `json:"rules"`
+	Steps         []string            `json:"steps"`
+	MsgList       []*AutoReplyMessage `json:"msg_list"`
+	FallbackToMsg bool                `json:"fallback_to_message"` // 关键词没有匹配到，改为消息回复
+
+	rules []*mongodb.EntityWeixinAutoReply // 不为nil时代替数据库中的关注、关键词、消息回复规则
+}
+
+/**
+ * @param rules 关注、关键词、消息回复的规则，为nil时使用数据库中已发布的规则，用于解释草稿发布后的效果
+ */
+func ExplainReply(ctx context.Context, appid string, msg msghandler.Message, rules []*mongodb.EntityWeixinAutoReply) (*ExplainResult, error) {
+	ret := &ExplainResult{
+		Enabled: make(map[string]bool),
+		Rules:   []*ExplainRule{},
+		Steps:   []string{},
+		MsgList: []*AutoReplyMessage{},
+		rules:   rules,
+	}
+	msgList, err := GetReplyMessages(ctx, appid, msg, true, ret)
+	if err != nil {
+		return nil, err
+	}
+	if ret.ReplyType == "" {
+		return ret, nil
+	}
+	if len(msgList) <= 0 {
+		ret.step("没有回复")
+		return ret, nil
+	}
+	ret.MsgList = msgList
+	return ret, nil
+}
+
+// 以下方法在 r 为nil时什么都不做，正常回复时不记录
+
+func (r *ExplainResult) step(format string, args ...any) {
+	if r == nil {
+		return
+	}
+	r.Steps = append(r.Steps, fmt.Sprintf(format, args...))
+}
+
+func (r *ExplainResult) setReplyType(replyType AutoReplyType) {
+	if r == nil {
+		return
+	}
+	r.ReplyType = replyType
+	r.step("回复类型为 %s", replyType)
+}
+
+func (r *ExplainResult) fallbackToMessage() {
+	if r == nil {
+		return
+	}
+	r.FallbackToMsg = true
+	r.step("关键词回复为空，改为消息回复")
+}
+
+// 回复的开关
+func (r *ExplainResult) checkEnabled(ctx context.Context, appid string, name string) (bool, error) {
+	enabled, err := appidservice.GetAppEnabledDataForReplyType(ctx, appid, name)
+	if err != nil {
+		log.Println("Error GetAppEnabledDataForReplyType", err)
+		return false, err
+	}
+	if r != nil {
+		r.Enabled[name] = enabled
+	}
+	return enabled, nil
+}
+
+// 转换规则的回复，并记录选择的过程
+func (r *ExplainResult) convert(rule *ExplainRule, replyData any, target *ReplyTarget) ([]*AutoReplyMessage, error) {
+	msgList, pick, err := pickReplyMessages(replyData, target, false)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		rule.Pick = pick
+		r.Rules = append(r.Rules, rule)
+	}
+	return msgList, nil
+}
+
+// 没有参与选择的规则
+func (r *ExplainResult) skip(rule *ExplainRule, reason string) {
+	if r == nil {
+		return
+	}
+	rule.Reason = reason
+	r.Rules = append(r.Rules, rule)
+}
+
+// 关键词匹配器，传入了规则时用这些规则临时创建，顺序和数据库中的一致
+func (r *ExplainResult) keywordMatcher(ctx context.Context, appid string) (*KeywordMatcher, error) {
+	if r == nil || r.rules == nil {
+		return GetKeywordMatcher(ctx, appid)
+	}
+	var keywordRules []*mongodb.EntityWeixinAutoReply
+	for _, rule := range r.rules {
+		if rule.ReplyType == string(AutoReplyTypeKeyword) {
+			keywordRules = append(keywordRules, rule)
+		}
+	}
+	sort.SliceStable(keywordRules, func(i, j int) bool {
+		if keywordRules[i].Priority != keywordRules[j].Priority {
+			return keywordRules[i].Priority > keywordRules[j].Priority
+		}
+		return keywordRules[i].CreatedAt.Before(keywordRules[j].CreatedAt)
+	})
+	return NewKeywordMatcher(keywordRules), nil
+}
+
+// 关注、消息回复的规则，没有时返回nil
+func (r *ExplainResult) findCommonRule(ctx context.Context, appid string, replyType AutoReplyType) (*mongodb.EntityWeixinAutoReply, error) {
+	if r == nil || r.rules == nil {
+		filter := bson.D{{Key: "appid", Value: appid}, {Key: "reply_type", Value: string(replyType)}}
+		return mongodb.ModelWeixinAutoReply.FindOne(ctx, filter)
+	}
+	for _, rule := range r.rules {
+		if rule.ReplyType == string(replyType) {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+// 数据库中关注、关键词、消息回复的规则，顺序和关键词匹配器一致
+func findPublishedRules(ctx context.Context, appid string) ([]*mongodb.EntityWeixinAutoReply, error) {
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "priority", Value: -1}, {Key: "created_at", Value: 1}})
+	filter := bson.D{
+		{Key: "appid", Value: appid},
+		{Key: "reply_type", Value: bson.D{{Key: "$in", Value: bson.A{string(AutoReplyTypeSubscribe), string(AutoReplyTypeKeyword), string(AutoReplyTypeMessage)}}}},
+	}
+	return mongodb.ModelWeixinAutoReply.FindMany(ctx, filter, findOptions)
+}
+
+// 关键词匹配到的规则
+func newKeywordExplainRule(m *KeywordRuleMatch) *ExplainRule {
+	rule := &ExplainRule{
+		Source:    "keyword",
+		RuleID:    m.Rule.ID.Hex(),
+		RuleKey:   m.Rule.ID.Hex(),
+		RuleTitle: m.Rule.RuleTitle,
+		Priority:  m.Rule.Priority,
+	}
+	if m.Def != nil {
+		rule.Keyword = m.Def.Keyword
+		rule.MatchType = keywordMatchType(m.Def)
+	}
+	return rule
+}
+
+func keywordMatchType(def *KeywordDef) string {
+	switch {
+	case def.Regex:
+		return "regex"
+	case def.Exact:
+		return "exact"
+	}
+	return "contains"
+}
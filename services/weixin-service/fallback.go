@@ -0,0 +1,34 @@
+package weixinservice
+
+import (
+	"context"
+	"log"
+
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+)
+
+/**
+ * 关键词没有匹配到时的外部回复，例如业务系统的 FAQ 机器人
+ * 在消息回复之前调用，返回空或者出错时继续使用消息回复
+ * 由 modules/weixin 注册，ctx 带有被动回复的期限，实现方调用外部接口的超时不能超过这个期限
+ */
+
+type FallbackResponder func(ctx context.Context, appid string, msg msghandler.Message) ([]*AutoReplyMessage, error)
+
+var fallbackResponder FallbackResponder
+
+func SetFallbackResponder(responder FallbackResponder) {
+	fallbackResponder = responder
+}
+
+func getFallbackReplyMessages(ctx context.Context, appid string, msg msghandler.Message) []*AutoReplyMessage {
+	if fallbackResponder == nil {
+		return nil
+	}
+	msgList, err := fallbackResponder(ctx, appid, msg)
+	if err != nil {
+		log.Println("Error fallbackResponder", appid, err)
+		return nil
+	}
+	return msgList
+}
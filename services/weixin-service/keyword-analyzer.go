@@ -0,0 +1,307 @@
+package weixinservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	appidservice "github.com/anchel/wechat-official-account-admin/services/appid-service"
+)
+
+/**
+ * 关键词规则的冲突检查
+ * 规则按优先级从高到低匹配，默认只取第一个生效的规则，所以排在前面的规则可能让后面的关键词永远匹配不到
+ * duplicate-不同规则有相同的关键词
+ * shadowed-关键词能匹配的文本都会先被前面的规则匹配到
+ * redundant-同一个规则中，关键词已经被另一个关键词覆盖
+ * overlap-前面的规则只在部分时间生效，或者只覆盖部分文本，或者开启了合并所有匹配到的规则，两个规则都可能回复
+ * 正则无法判断覆盖关系，只检查作为前面的规则时能否匹配后面的完全匹配关键词
+ */
+
+const (
+	KeywordIssueDuplicate = "duplicate"
+	KeywordIssueShadowed  = "shadowed"
+	KeywordIssueRedundant = "redundant"
+	KeywordIssueOverlap   = "overlap"
+)
+
+type KeywordIssue struct {
+	Kind        string `json:"kind"`
+	RuleID      string `json:"rule_id"`
+	RuleTitle   string `json:"rule_title"`
+	Keyword     string `json:"keyword,omitempty"`
+	ByRuleID    string `json:"by_rule_id,omitempty"`
+	ByRuleTitle string `json:"by_rule_title,omitempty"`
+	ByKeyword   string `json:"by_keyword,omitempty"`
+	Message     string `json:"message"`
+}
+
+type KeywordAnalysis struct {
+	Conflicts     []*KeywordIssue `json:"conflicts"`      // duplicate、overlap
+	Unreachable   []*KeywordIssue `json:"unreachable"`    // shadowed、redundant，关键词永远不会起作用
+	ShadowedRules []*KeywordIssue `json:"shadowed_rules"` // 所有关键词都匹配不到的规则
+}
+
+// 和 ruleID 相关的问题，保存规则时作为提示
+func (a *KeywordAnalysis) ForRule(ruleID string) *KeywordAnalysis {
+	filter := func(list []*KeywordIssue) []*KeywordIssue {
+		ret := []*KeywordIssue{}
+		for _, issue := range list {
+			if issue.RuleID == ruleID || issue.ByRuleID == ruleID {
+				ret = append(ret, issue)
+			}
+		}
+		return ret
+	}
+	return &KeywordAnalysis{
+		Conflicts:     filter(a.Conflicts),
+		Unreachable:   filter(a.Unreachable),
+		ShadowedRules: filter(a.ShadowedRules),
+	}
+}
+
+func (a *KeywordAnalysis) Empty() bool {
+	return len(a.Conflicts) <= 0 && len(a.Unreachable) <= 0 && len(a.ShadowedRules) <= 0
+}
+
+type analyzerRule struct {
+	doc          *mongodb.EntityWeixinAutoReply
+	defs         []*KeywordDef
+	regexps      []*regexp.Regexp
+	alwaysActive bool // 没有生效时间的限制，匹配到就一定会回复
+}
+
+/**
+ * 检查公众号的关键词规则
+ * @param rules 为nil时使用数据库中已发布的规则，传入草稿发布后的规则可以在发布前检查
+ */
+func AnalyzeAppKeywordRules(ctx context.Context, appid string, rules []*mongodb.EntityWeixinAutoReply) (*KeywordAnalysis, error) {
+	var err error
+	if rules == nil {
+		rules, err = findPublishedRules(ctx, appid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	matchAll, err := appidservice.GetAppEnabledDataForReplyType(ctx, appid, "keyword_match_all")
+	if err != nil {
+		return nil, err
+	}
+	return AnalyzeKeywordRules(rules, matchAll), nil
+}
+
+// 检查关键词规则，docs 为公众号的所有关键词规则，matchAll 为公众号是否合并所有匹配到的规则
+func AnalyzeKeywordRules(docs []*mongodb.EntityWeixinAutoReply, matchAll bool) *KeywordAnalysis {
+	ret := &KeywordAnalysis{
+		Conflicts:     []*KeywordIssue{},
+		Unreachable:   []*KeywordIssue{},
+		ShadowedRules: []*KeywordIssue{},
+	}
+
+	var rules []*analyzerRule
+	for _, doc := range docs {
+		if doc.ReplyType != string(AutoReplyTypeKeyword) || doc.KeywordsDef == "" || doc.ReplyData == "" {
+			continue
+		}
+		defs := []*KeywordDef{}
+		err := json.Unmarshal([]byte(doc.KeywordsDef), &defs)
+		if err != nil {
+			continue
+		}
+		rule := &analyzerRule{doc: doc}
+		for _, def := range defs {
+			if def == nil || def.Keyword == "" {
+				continue
+			}
+			var re *regexp.Regexp
+			if def.Regex {
+				// 编译不了的正则匹配时会跳过
+				if re, err = CompileKeywordRegex(def); err != nil {
+					continue
+				}
+			}
+			rule.defs = append(rule.defs, def)
+			rule.regexps = append(rule.regexps, re)
+		}
+		if len(rule.defs) <= 0 {
+			continue
+		}
+		var data AutoReplyData
+		if json.Unmarshal([]byte(doc.ReplyData), &data) == nil {
+			rule.alwaysActive = data.Schedule == nil && len(data.MsgList) > 0
+		}
+		rules = append(rules, rule)
+	}
+	// 和匹配时的顺序一致
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].doc.Priority != rules[j].doc.Priority {
+			return rules[i].doc.Priority > rules[j].doc.Priority
+		}
+		return rules[i].doc.CreatedAt.Before(rules[j].doc.CreatedAt)
+	})
+
+	for j, rule := range rules {
+		unreachable := 0
+		for defIdx := range rule.defs {
+			issue := analyzeKeywordDef(rules, j, defIdx, matchAll)
+			if issue == nil {
+				continue
+			}
+			switch issue.Kind {
+			case KeywordIssueShadowed, KeywordIssueRedundant:
+				ret.Unreachable = append(ret.Unreachable, issue)
+				if issue.Kind == KeywordIssueShadowed {
+					unreachable++
+				}
+			default:
+				ret.Conflicts = append(ret.Conflicts, issue)
+			}
+		}
+		if unreachable == len(rule.defs) {
+			ret.ShadowedRules = append(ret.ShadowedRules, &KeywordIssue{
+				Kind:      KeywordIssueShadowed,
+				RuleID:    rule.doc.ID.Hex(),
+				RuleTitle: rule.doc.RuleTitle,
+				Message:   "规则的所有关键词都会先被其他规则匹配到，这个规则永远不会回复",
+			})
+		}
+	}
+	return ret
+}
+
+// 检查第 j 个规则的第 defIdx 个关键词，只返回最严重的一个问题
+func analyzeKeywordDef(rules []*analyzerRule, j int, defIdx int, matchAll bool) *KeywordIssue {
+	rule := rules[j]
+	def := rule.defs[defIdx]
+	newIssue := func(kind string, by *analyzerRule, byDef *KeywordDef, msg string) *KeywordIssue {
+		return &KeywordIssue{
+			Kind:        kind,
+			RuleID:      rule.doc.ID.Hex(),
+			RuleTitle:   rule.doc.RuleTitle,
+			Keyword:     def.Keyword,
+			ByRuleID:    by.doc.ID.Hex(),
+			ByRuleTitle: by.doc.RuleTitle,
+			ByKeyword:   byDef.Keyword,
+			Message:     msg,
+		}
+	}
+
+	// 同一个规则中被其他关键词覆盖
+	for i, other := range rule.defs {
+		if i == defIdx {
+			continue
+		}
+		if keywordDefCovers(other, rule.regexps[i], def) == coverFull && (!keywordDefEqual(other, def) || i < defIdx) {
+			return newIssue(KeywordIssueRedundant, rule, other, fmt.Sprintf("已经被同一规则的关键词 %s 覆盖", other.Keyword))
+		}
+	}
+
+	var overlap *KeywordIssue
+	for i, prev := range rules {
+		if i == j {
+			continue
+		}
+		for k, prevDef := range prev.defs {
+			if keywordDefEqual(prevDef, def) {
+				if i > j {
+					// 重复只在后面的规则上报告一次
+					continue
+				}
+				if matchAll || !prev.alwaysActive {
+					return newIssue(KeywordIssueDuplicate, prev, prevDef, "和其他规则的关键词重复")
+				}
+				return newIssue(KeywordIssueShadowed, prev, prevDef, "和优先级更高的规则的关键词重复，永远不会匹配到")
+			}
+			if i > j {
+				continue
+			}
+			cover := keywordDefCovers(prevDef, prev.regexps[k], def)
+			if cover == coverNone {
+				continue
+			}
+			if cover == coverFull && prev.alwaysActive && !matchAll {
+				return newIssue(KeywordIssueShadowed, prev, prevDef, fmt.Sprintf("能匹配的文本都会先被关键词 %s 匹配到", prevDef.Keyword))
+			}
+			if overlap == nil {
+				msg := fmt.Sprintf("部分文本会先被关键词 %s 匹配到", prevDef.Keyword)
+				if matchAll {
+					msg = fmt.Sprintf("和关键词 %s 会同时匹配，回复会合并", prevDef.Keyword)
+				} else if !prev.alwaysActive {
+					msg = fmt.Sprintf("关键词 %s 的规则在生效时间内会先匹配到", prevDef.Keyword)
+				}
+				overlap = newIssue(KeywordIssueOverlap, prev, prevDef, msg)
+			}
+		}
+	}
+	return overlap
+}
+
+const (
+	coverNone = iota
+	coverPartial
+	coverFull
+)
+
+func keywordDefEqual(a, b *KeywordDef) bool {
+	if a.Exact != b.Exact || a.Regex != b.Regex || a.IgnoreCase != b.IgnoreCase {
+		return false
+	}
+	if a.IgnoreCase && !a.Regex {
+		return NormalizeKeyword(a.Keyword) == NormalizeKeyword(b.Keyword)
+	}
+	return a.Keyword == b.Keyword
+}
+
+// a 能匹配到 b 所能匹配的文本的程度，aRe 为 a 编译后的正则
+func keywordDefCovers(a *KeywordDef, aRe *regexp.Regexp, b *KeywordDef) int {
+	if b.Regex {
+		// 正则能匹配的文本无法枚举
+		return coverNone
+	}
+
+	if b.Exact {
+		texts := []string{b.Keyword}
+		if b.IgnoreCase {
+			texts = append(texts, NormalizeKeyword(b.Keyword), strings.ToUpper(ToHalfWidth(b.Keyword)))
+		}
+		matched := 0
+		for _, text := range texts {
+			if MatchKeywordDef(a, aRe, text) != nil {
+				matched++
+			}
+		}
+		if matched == 0 {
+			return coverNone
+		}
+		// b 忽略大小写时 a 也要忽略大小写，才能覆盖所有写法
+		if matched == len(texts) && (!b.IgnoreCase || a.IgnoreCase) {
+			return coverFull
+		}
+		return coverPartial
+	}
+
+	// b 是包含匹配，a 也是包含匹配并且 a 是 b 的子串时，包含 b 的文本一定包含 a
+	if a.Exact || a.Regex {
+		if MatchKeywordDef(a, aRe, b.Keyword) != nil {
+			return coverPartial
+		}
+		return coverNone
+	}
+	if a.IgnoreCase {
+		if strings.Contains(NormalizeKeyword(b.Keyword), NormalizeKeyword(a.Keyword)) {
+			return coverFull
+		}
+		return coverNone
+	}
+	if strings.Contains(b.Keyword, a.Keyword) {
+		if b.IgnoreCase {
+			return coverPartial
+		}
+		return coverFull
+	}
+	return coverNone
+}
@@ -0,0 +1,187 @@
+package weixinservice
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/lib/ahocorasick"
+	"github.com/anchel/wechat-official-account-admin/lib/lru"
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+ * 编译好的关键词匹配器，每个公众号一个，缓存在内存中
+ * 完全匹配用 map，包含匹配用 Aho-Corasick 自动机，正则只能逐个匹配
+ * 规则修改后需要调用 InvalidateKeywordMatcher，多节点之间的同步由调用方负责
+ */
+
+type keywordRule struct {
+	doc     *mongodb.EntityWeixinAutoReply
+	defs    []*KeywordDef
+	regexps []*regexp.Regexp // 和 defs 一一对应，不是正则的为nil
+}
+
+// 关键词所在的规则和规则中的第几个关键词
+type keywordRef struct {
+	rule int
+	def  int
+}
+
+type KeywordMatcher struct {
+	rules []*keywordRule // 按优先级从高到低
+
+	exact           map[string][]keywordRef
+	exactIgnoreCase map[string][]keywordRef
+
+	contains              *ahocorasick.Matcher
+	containsRefs          []keywordRef
+	containsIgnoreCase    *ahocorasick.Matcher
+	containsIgnoreCaseRef []keywordRef
+
+	regexRefs []keywordRef
+}
+
+type KeywordRuleMatch struct {
+	Rule  *mongodb.EntityWeixinAutoReply
+	Def   *KeywordDef // 匹配到的关键词
+	Match *KeywordMatch
+}
+
+func NewKeywordMatcher(docs []*mongodb.EntityWeixinAutoReply) *KeywordMatcher {
+	m := &KeywordMatcher{
+		exact:           make(map[string][]keywordRef),
+		exactIgnoreCase: make(map[string][]keywordRef),
+	}
+
+	var containsPatterns, containsIgnoreCasePatterns []string
+
+	for _, doc := range docs {
+		if doc.KeywordsDef == "" || doc.ReplyData == "" {
+			continue
+		}
+		defs := []*KeywordDef{}
+		err := json.Unmarshal([]byte(doc.KeywordsDef), &defs)
+		if err != nil {
+			log.Println("Error json.Unmarshal", doc.RuleTitle, err)
+			continue
+		}
+
+		rule := &keywordRule{doc: doc, defs: defs, regexps: make([]*regexp.Regexp, len(defs))}
+		m.rules = append(m.rules, rule)
+		ruleIdx := len(m.rules) - 1
+
+		for defIdx, def := range defs {
+			if def.Keyword == "" {
+				continue
+			}
+			ref := keywordRef{rule: ruleIdx, def: defIdx}
+			switch {
+			case def.Regex:
+				re, err := CompileKeywordRegex(def)
+				if err != nil {
+					log.Println("Error CompileKeywordRegex", doc.RuleTitle, def.Keyword, err)
+					continue
+				}
+				rule.regexps[defIdx] = re
+				m.regexRefs = append(m.regexRefs, ref)
+			case def.Exact && def.IgnoreCase:
+				k := NormalizeKeyword(def.Keyword)
+				m.exactIgnoreCase[k] = append(m.exactIgnoreCase[k], ref)
+			case def.Exact:
+				m.exact[def.Keyword] = append(m.exact[def.Keyword], ref)
+			case def.IgnoreCase:
+				containsIgnoreCasePatterns = append(containsIgnoreCasePatterns, NormalizeKeyword(def.Keyword))
+				m.containsIgnoreCaseRef = append(m.containsIgnoreCaseRef, ref)
+			default:
+				containsPatterns = append(containsPatterns, def.Keyword)
+				m.containsRefs = append(m.containsRefs, ref)
+			}
+		}
+	}
+
+	m.contains = ahocorasick.New(containsPatterns)
+	m.containsIgnoreCase = ahocorasick.New(containsIgnoreCasePatterns)
+	return m
+}
+
+// 返回所有匹配到的规则，按优先级从高到低
+// 一个规则有多个关键词匹配时，以规则中排在前面的关键词为准
+func (m *KeywordMatcher) Match(text string) []*KeywordRuleMatch {
+	type candidate struct {
+		def   int
+		match *KeywordMatch
+	}
+	candidates := make(map[int]*candidate)
+	add := func(ref keywordRef, match *KeywordMatch) {
+		c, ok := candidates[ref.rule]
+		if !ok || ref.def < c.def {
+			candidates[ref.rule] = &candidate{def: ref.def, match: match}
+		}
+	}
+
+	for _, ref := range m.exact[text] {
+		add(ref, &KeywordMatch{})
+	}
+	normalized := NormalizeKeyword(text)
+	for _, ref := range m.exactIgnoreCase[normalized] {
+		add(ref, &KeywordMatch{})
+	}
+	for _, idx := range m.contains.FindAll(text) {
+		add(m.containsRefs[idx], &KeywordMatch{})
+	}
+	for _, idx := range m.containsIgnoreCase.FindAll(normalized) {
+		add(m.containsIgnoreCaseRef[idx], &KeywordMatch{})
+	}
+	for _, ref := range m.regexRefs {
+		if c, ok := candidates[ref.rule]; ok && c.def < ref.def {
+			continue
+		}
+		rule := m.rules[ref.rule]
+		match := MatchKeywordDef(rule.defs[ref.def], rule.regexps[ref.def], text)
+		if match != nil {
+			add(ref, match)
+		}
+	}
+
+	ruleIdxs := make([]int, 0, len(candidates))
+	for idx := range candidates {
+		ruleIdxs = append(ruleIdxs, idx)
+	}
+	sort.Ints(ruleIdxs)
+
+	ret := make([]*KeywordRuleMatch, 0, len(ruleIdxs))
+	for _, idx := range ruleIdxs {
+		ret = append(ret, &KeywordRuleMatch{Rule: m.rules[idx].doc, Def: m.rules[idx].defs[candidates[idx].def], Match: candidates[idx].match})
+	}
+	return ret
+}
+
+// 兜底的过期时间，避免没收到失效通知时一直使用旧的规则
+const keywordMatcherTTL = 10 * time.Minute
+
+var lruKeywordMatcher = lru.NewCacheLRUWithTTL[KeywordMatcher](100, keywordMatcherTTL, func(ctx context.Context, appid string) (*KeywordMatcher, error) {
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "priority", Value: -1}, {Key: "created_at", Value: 1}})
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "reply_type", Value: string(AutoReplyTypeKeyword)}}
+	docs, err := mongodb.ModelWeixinAutoReply.FindMany(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("NewKeywordMatcher", appid, len(docs))
+	return NewKeywordMatcher(docs), nil
+})
+
+func GetKeywordMatcher(ctx context.Context, appid string) (*KeywordMatcher, error) {
+	return lruKeywordMatcher.Get(ctx, appid)
+}
+
+// 关键词规则修改后调用，下次匹配时重新加载
+func InvalidateKeywordMatcher(appid string) {
+	lruKeywordMatcher.Remove(appid)
+}
@@ -0,0 +1,146 @@
+package weixinservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+)
+
+func newKeywordRule(t testing.TB, title string, defs ...*KeywordDef) *mongodb.EntityWeixinAutoReply {
+	b, err := json.Marshal(defs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mongodb.EntityWeixinAutoReply{RuleTitle: title, KeywordsDef: string(b), ReplyData: `{}`}
+}
+
+func matchedTitles(matches []*KeywordRuleMatch) []string {
+	ret := []string{}
+	for _, m := range matches {
+		ret = append(ret, m.Rule.RuleTitle+":"+m.Def.Keyword)
+	}
+	return ret
+}
+
+func TestKeywordMatcher(t *testing.T) {
+	rules := []*mongodb.EntityWeixinAutoReply{
+		newKeywordRule(t, "exact", &KeywordDef{Keyword: "help", Exact: true}),
+		newKeywordRule(t, "exact_ic", &KeywordDef{Keyword: "Menu", Exact: true, IgnoreCase: true}),
+		newKeywordRule(t, "contains", &KeywordDef{Keyword: "价格"}, &KeywordDef{Keyword: "price"}),
+		newKeywordRule(t, "contains_ic", &KeywordDef{Keyword: "VIP", IgnoreCase: true}),
+		newKeywordRule(t, "overlap", &KeywordDef{Keyword: "she"}, &KeywordDef{Keyword: "hers"}),
+		newKeywordRule(t, "regex", &KeywordDef{Keyword: `^订单(\d+)$`, Regex: true}),
+		newKeywordRule(t, "bad_regex", &KeywordDef{Keyword: `(`, Regex: true}, &KeywordDef{Keyword: "bad"}),
+		{RuleTitle: "no_reply", KeywordsDef: `[{"keyword":"help"}]`},
+	}
+	m := NewKeywordMatcher(rules)
+
+	cases := []struct {
+		text string
+		want []string
+	}{
+		{"help", []string{"exact:help"}},
+		{"help me", []string{}},
+		{"menu", []string{"exact_ic:Menu"}},
+		{"ＭＥＮＵ", []string{"exact_ic:Menu"}},
+		{"price 和 价格", []string{"contains:价格"}}, // 规则中排在前面的关键词为准
+		{"the price", []string{"contains:price"}},
+		{"我是vip", []string{"contains_ic:VIP"}},
+		{"我是ＶＩＰ", []string{"contains_ic:VIP"}},
+		{"ushers", []string{"overlap:she"}},
+		{"hers", []string{"overlap:hers"}},
+		{"订单123", []string{"regex:" + `^订单(\d+)$`}},
+		{"订单abc", []string{}},
+		{"bad", []string{"bad_regex:bad"}},
+		{"vip price", []string{"contains:price", "contains_ic:VIP"}}, // 按优先级排列
+	}
+	for _, c := range cases {
+		if got := matchedTitles(m.Match(c.text)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Match(%q) = %v, want %v", c.text, got, c.want)
+		}
+	}
+
+	matches := m.Match("订单123")
+	if len(matches) != 1 || matches[0].Match.Regexp == nil {
+		t.Fatalf("Match() regex should keep the submatch, got %v", matches)
+	}
+	if got := expandKeywordText(t, matches[0].Match, "$1"); got != "123" {
+		t.Errorf("regex submatch = %q, want 123", got)
+	}
+}
+
+func expandKeywordText(t *testing.T, match *KeywordMatch, template string) string {
+	t.Helper()
+	return string(match.Regexp.ExpandString(nil, template, match.Text, match.Submatch))
+}
+
+// 原来的做法，每条消息都逐个规则解析关键词并匹配
+func linearKeywordMatch(docs []*mongodb.EntityWeixinAutoReply, text string) []*mongodb.EntityWeixinAutoReply {
+	var ret []*mongodb.EntityWeixinAutoReply
+	for _, doc := range docs {
+		if doc.KeywordsDef == "" || doc.ReplyData == "" {
+			continue
+		}
+		defs := []*KeywordDef{}
+		if err := json.Unmarshal([]byte(doc.KeywordsDef), &defs); err != nil {
+			continue
+		}
+		for _, def := range defs {
+			var re *regexp.Regexp
+			if def.Regex {
+				var err error
+				if re, err = CompileKeywordRegex(def); err != nil {
+					continue
+				}
+			}
+			if MatchKeywordDef(def, re, text) != nil {
+				ret = append(ret, doc)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+func benchmarkKeywordRules(b *testing.B, n int) []*mongodb.EntityWeixinAutoReply {
+	rules := make([]*mongodb.EntityWeixinAutoReply, 0, n)
+	for i := 0; i < n; i++ {
+		var def *KeywordDef
+		switch i % 10 {
+		case 0:
+			def = &KeywordDef{Keyword: fmt.Sprintf("exact%d", i), Exact: true}
+		case 1:
+			def = &KeywordDef{Keyword: fmt.Sprintf("Word%d", i), IgnoreCase: true}
+		default:
+			def = &KeywordDef{Keyword: fmt.Sprintf("关键词%d号", i)}
+		}
+		rules = append(rules, newKeywordRule(b, fmt.Sprintf("rule%d", i), def))
+	}
+	return rules
+}
+
+const benchmarkKeywordText = "你好，我想问一下关键词9995号的活动什么时候开始"
+
+func BenchmarkKeywordMatcher(b *testing.B) {
+	m := NewKeywordMatcher(benchmarkKeywordRules(b, 10000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(m.Match(benchmarkKeywordText)) != 1 {
+			b.Fatal("should match one rule")
+		}
+	}
+}
+
+func BenchmarkKeywordLinearScan(b *testing.B) {
+	rules := benchmarkKeywordRules(b, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(linearKeywordMatch(rules, benchmarkKeywordText)) != 1 {
+			b.Fatal("should match one rule")
+		}
+	}
+}
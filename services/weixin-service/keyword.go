@@ -0,0 +1,125 @@
+package weixinservice
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/**
+ * 关键词匹配
+ * exact-完全匹配，regex-正则匹配，都不是时为包含匹配
+ * ignore_case 时忽略大小写和全角半角，例如 "ＡＢＣ？" 和 "abc?" 视为相同
+ */
+
+type KeywordDef struct {
+	Keyword    string `json:"keyword"`
+	Exact      bool   `json:"exact"`
+	Regex      bool   `json:"regex"`
+	IgnoreCase bool   `json:"ignore_case"`
+}
+
+// 匹配结果，正则匹配时带上分组，作为模板变量 {{capture.1}} {{capture.name}} 使用
+type KeywordMatch struct {
+	Regexp   *regexp.Regexp
+	Text     string
+	Submatch []int
+}
+
+// 全角转半角
+func ToHalfWidth(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == 0x3000 { // 全角空格
+			return ' '
+		}
+		if r >= 0xFF01 && r <= 0xFF5E {
+			return r - 0xFEE0
+		}
+		return r
+	}, s)
+}
+
+// 全角转半角并转为小写
+func NormalizeKeyword(s string) string {
+	return strings.ToLower(ToHalfWidth(s))
+}
+
+// 编译正则，ignore_case 时加上 (?i)，表达式同样做全角转半角
+// 表达式不能转小写，否则 \D (?P<name>) 之类的语法会被改掉
+func CompileKeywordRegex(def *KeywordDef) (*regexp.Regexp, error) {
+	expr := def.Keyword
+	if def.IgnoreCase {
+		expr = "(?i)" + ToHalfWidth(expr)
+	}
+	return regexp.Compile(expr)
+}
+
+// 没有匹配上返回nil
+func MatchKeywordDef(def *KeywordDef, re *regexp.Regexp, text string) *KeywordMatch {
+	if def.Keyword == "" {
+		return nil
+	}
+	if def.Regex {
+		if re == nil {
+			return nil
+		}
+		// 正则已经带了 (?i)，只转半角，保留原文的大小写给模板变量 capture 用
+		if def.IgnoreCase {
+			text = ToHalfWidth(text)
+		}
+		submatch := re.FindStringSubmatchIndex(text)
+		if submatch == nil {
+			return nil
+		}
+		return &KeywordMatch{Regexp: re, Text: text, Submatch: submatch}
+	}
+
+	keyword := def.Keyword
+	if def.IgnoreCase {
+		keyword = NormalizeKeyword(keyword)
+		text = NormalizeKeyword(text)
+	}
+
+	if def.Exact {
+		if keyword == text {
+			return &KeywordMatch{}
+		}
+	} else if strings.Contains(text, keyword) {
+		return &KeywordMatch{}
+	}
+	return nil
+}
+
+// 正则的分组和匹配到的关键词记录到消息上，作为模板变量 capture.1 capture.name keyword 使用，返回新的消息，不修改原来的
+// 回复内容不做 $1 ${name} 展开，避免 "$5" 之类的原文被当成分组替换掉
+func ExpandReplyMessages(msgList []*AutoReplyMessage, def *KeywordDef, m *KeywordMatch) []*AutoReplyMessage {
+	keyword := ""
+	if def != nil {
+		keyword = def.Keyword
+	}
+
+	var captures map[string]string
+	if m != nil && m.Regexp != nil {
+		captures = make(map[string]string)
+		names := m.Regexp.SubexpNames()
+		for i := 1; i < len(names) && 2*i+1 < len(m.Submatch); i++ {
+			start, end := m.Submatch[2*i], m.Submatch[2*i+1]
+			if start < 0 {
+				continue
+			}
+			captures[strconv.Itoa(i)] = m.Text[start:end]
+			if names[i] != "" {
+				captures[names[i]] = m.Text[start:end]
+			}
+		}
+	}
+
+	ret := make([]*AutoReplyMessage, len(msgList))
+	for i, msg := range msgList {
+		cp := *msg
+		cp.captures = captures
+		cp.keyword = keyword
+		ret[i] = &cp
+	}
+	return ret
+}
@@ -0,0 +1,141 @@
+package weixinservice
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+	_ "time/tzdata" // 运行的镜像里没有时区数据，内嵌一份，否则 Asia/Shanghai 加载失败
+)
+
+/**
+ * 回复的生效时间
+ * start_at、end_at 为绝对的起止时间，例如节日问候
+ * windows 为每周的时间段，例如工作时间，end 小于 start 表示跨天，例如 22:00-08:00
+ * 时间都按 timezone 计算，不填则用环境变量 WX_SCHEDULE_TIMEZONE，再没有则用 Asia/Shanghai
+ */
+
+type ReplyScheduleWindow struct {
+	Weekdays []int  `json:"weekdays,omitempty"` // 0-周日，1-周一 ... 6-周六，为空表示每天
+	Start    string `json:"start"`              // 15:04
+	End      string `json:"end"`                // 15:04
+}
+
+type ReplySchedule struct {
+	Timezone string                 `json:"timezone,omitempty"`
+	StartAt  string                 `json:"start_at,omitempty"` // 2006-01-02 15:04:05
+	EndAt    string                 `json:"end_at,omitempty"`   // 2006-01-02 15:04:05
+	Windows  []*ReplyScheduleWindow `json:"windows,omitempty"`
+}
+
+const scheduleDateLayout = "2006-01-02 15:04:05"
+const scheduleTimeLayout = "15:04"
+
+func (s *ReplySchedule) location() (*time.Location, error) {
+	tz := s.Timezone
+	if tz == "" {
+		tz = os.Getenv("WX_SCHEDULE_TIMEZONE")
+	}
+	if tz == "" {
+		tz = "Asia/Shanghai"
+	}
+	return time.LoadLocation(tz)
+}
+
+// 检查配置是否正确，保存时调用
+func (s *ReplySchedule) Validate() error {
+	loc, err := s.location()
+	if err != nil {
+		return errors.New("timezone error: " + s.Timezone)
+	}
+	if s.StartAt != "" {
+		if _, err := time.ParseInLocation(scheduleDateLayout, s.StartAt, loc); err != nil {
+			return errors.New("start_at error: " + s.StartAt)
+		}
+	}
+	if s.EndAt != "" {
+		if _, err := time.ParseInLocation(scheduleDateLayout, s.EndAt, loc); err != nil {
+			return errors.New("end_at error: " + s.EndAt)
+		}
+	}
+	for _, w := range s.Windows {
+		if _, err := time.Parse(scheduleTimeLayout, w.Start); err != nil {
+			return errors.New("window start error: " + w.Start)
+		}
+		if _, err := time.Parse(scheduleTimeLayout, w.End); err != nil {
+			return errors.New("window end error: " + w.End)
+		}
+		for _, d := range w.Weekdays {
+			if d < 0 || d > 6 {
+				return errors.New("window weekday error")
+			}
+		}
+	}
+	return nil
+}
+
+// now 是否在生效时间内，配置错误的视为不生效
+func (s *ReplySchedule) Active(now time.Time) bool {
+	if err := s.Validate(); err != nil {
+		log.Println("ReplySchedule invalid", err)
+		return false
+	}
+	loc, _ := s.location()
+	now = now.In(loc)
+
+	if s.StartAt != "" {
+		t, _ := time.ParseInLocation(scheduleDateLayout, s.StartAt, loc)
+		if now.Before(t) {
+			return false
+		}
+	}
+	if s.EndAt != "" {
+		t, _ := time.ParseInLocation(scheduleDateLayout, s.EndAt, loc)
+		if !now.Before(t) {
+			return false
+		}
+	}
+
+	if len(s.Windows) <= 0 {
+		return true
+	}
+	for _, w := range s.Windows {
+		if w.active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *ReplyScheduleWindow) active(now time.Time) bool {
+	start, _ := time.Parse(scheduleTimeLayout, w.Start)
+	end, _ := time.Parse(scheduleTimeLayout, w.End)
+	minutes := now.Hour()*60 + now.Minute()
+	startMinutes := start.Hour()*60 + start.Minute()
+	endMinutes := end.Hour()*60 + end.Minute()
+
+	weekday := int(now.Weekday())
+	if startMinutes <= endMinutes {
+		return w.hasWeekday(weekday) && minutes >= startMinutes && minutes < endMinutes
+	}
+	// 跨天的时间段，凌晨的部分算前一天的
+	if minutes >= startMinutes {
+		return w.hasWeekday(weekday)
+	}
+	if minutes < endMinutes {
+		return w.hasWeekday((weekday + 6) % 7)
+	}
+	return false
+}
+
+func (w *ReplyScheduleWindow) hasWeekday(weekday int) bool {
+	if len(w.Weekdays) <= 0 {
+		return true
+	}
+	for _, d := range w.Weekdays {
+		if d == weekday {
+			return true
+		}
+	}
+	return false
+}
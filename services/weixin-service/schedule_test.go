@@ -0,0 +1,67 @@
+package weixinservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplyScheduleDefaultTimezone(t *testing.T) {
+	t.Setenv("WX_SCHEDULE_TIMEZONE", "")
+
+	s := &ReplySchedule{
+		Windows: []*ReplyScheduleWindow{{Weekdays: []int{1, 2, 3, 4, 5}, Start: "09:00", End: "18:00"}},
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	// 2024-06-03 是周一，上海时间 10:00 是 UTC 02:00
+	cases := []struct {
+		now  time.Time
+		want bool
+	}{
+		{time.Date(2024, 6, 3, 2, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 6, 3, 10, 0, 0, 0, time.UTC), false}, // 上海时间 18:00
+		{time.Date(2024, 6, 2, 2, 0, 0, 0, time.UTC), false},  // 周日
+	}
+	for _, c := range cases {
+		if got := s.Active(c.now); got != c.want {
+			t.Errorf("Active(%v) = %v, want %v", c.now, got, c.want)
+		}
+	}
+}
+
+func TestReplyScheduleOvernightWindow(t *testing.T) {
+	s := &ReplySchedule{
+		Timezone: "Asia/Shanghai",
+		Windows:  []*ReplyScheduleWindow{{Weekdays: []int{5}, Start: "22:00", End: "08:00"}},
+	}
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		now  time.Time
+		want bool
+	}{
+		{time.Date(2024, 6, 7, 23, 0, 0, 0, loc), true},  // 周五晚上
+		{time.Date(2024, 6, 8, 7, 59, 0, 0, loc), true},  // 周六凌晨算周五
+		{time.Date(2024, 6, 8, 8, 0, 0, 0, loc), false},  // 结束
+		{time.Date(2024, 6, 8, 23, 0, 0, 0, loc), false}, // 周六晚上
+	}
+	for _, c := range cases {
+		if got := s.Active(c.now); got != c.want {
+			t.Errorf("Active(%v) = %v, want %v", c.now, got, c.want)
+		}
+	}
+}
+
+func TestReplyScheduleInvalidTimezone(t *testing.T) {
+	s := &ReplySchedule{Timezone: "Mars/Olympus"}
+	if err := s.Validate(); err == nil {
+		t.Fatal("Validate() should fail for unknown timezone")
+	}
+	if s.Active(time.Now()) {
+		t.Fatal("Active() should be false for invalid schedule")
+	}
+}
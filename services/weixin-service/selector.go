@@ -0,0 +1,179 @@
+package weixinservice
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/**
+ * reply_all 为 false 时，从多条消息中选一条回复的策略
+ * random-均匀随机（默认），weighted-按 weight 加权随机，round_robin-每个用户按顺序轮流
+ * no_repeat-同一个用户不会连续两次收到同一条
+ * 每条消息发出的次数记录在 redis 的 hash 中，key 为规则的 rule_key，field 为消息的下标
+ */
+
+const (
+	ReplyStrategyRandom     = "random"
+	ReplyStrategyWeighted   = "weighted"
+	ReplyStrategyRoundRobin = "round_robin"
+	ReplyStrategyNoRepeat   = "no_repeat"
+)
+
+// 选择回复的对象，以及规则的唯一标识
+// rule_key: 关注、消息、关键词回复为规则的ID，菜单点击为 menu_<菜单ID>_<key>，二维码为 qrcode_<二维码ID>
+// 生效的是 variants 中的第几个时，rule_key 后面加上 _v<下标>
+type ReplyTarget struct {
+	AppID     string
+	OpenID    string
+	RuleKey   string
+	ReplyType AutoReplyType // 用于命中统计，为空时不统计
+	DryRun    bool          // 模拟器的消息，不改变轮流、不重复等策略的状态，也不记录次数
+}
+
+// 用户的轮流和上一次的记录保留的时间
+const replySelectorExpire = 30 * 24 * time.Hour
+
+var selectorRdb *redis.Client
+
+// 不初始化时只能使用随机，也不记录次数
+func InitReplySelector(rdb *redis.Client) {
+	selectorRdb = rdb
+}
+
+// 计数和刷新过期时间在一个脚本中完成，避免 INCR 之后 PEXPIRE 失败留下永不过期的 key
+var roundRobinScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[1])
+return count
+`)
+
+func (t *ReplyTarget) variant(idx int) *ReplyTarget {
+	if idx < 0 {
+		return t
+	}
+	return &ReplyTarget{AppID: t.AppID, OpenID: t.OpenID, RuleKey: fmt.Sprintf("%s_v%d", t.RuleKey, idx), ReplyType: t.ReplyType, DryRun: t.DryRun}
+}
+
+func (t *ReplyTarget) key(name string) string {
+	return t.AppID + "_reply_" + name + "_" + t.RuleKey
+}
+
+// 选择回复的消息的下标，dryRun 时只读取轮流和上一次的记录，不做修改
+func selectReplyIndex(ctx context.Context, data *AutoReplyData, target *ReplyTarget, dryRun bool) int {
+	n := len(data.MsgList)
+	if n <= 1 {
+		return 0
+	}
+	if target == nil || selectorRdb == nil {
+		return rand.Intn(n)
+	}
+
+	switch data.Strategy {
+	case ReplyStrategyWeighted:
+		return weightedIndex(data.MsgList, -1)
+	case ReplyStrategyRoundRobin:
+		key := target.key("rr") + "_" + target.OpenID
+		if dryRun {
+			count, err := selectorRdb.Get(ctx, key).Int64()
+			if err != nil && err != redis.Nil {
+				log.Println("selectReplyIndex round_robin error", err)
+			}
+			return int(count % int64(n))
+		}
+		count, err := roundRobinScript.Run(ctx, selectorRdb, []string{key}, replySelectorExpire.Milliseconds()).Int64()
+		if err != nil {
+			log.Println("selectReplyIndex round_robin error", err)
+			return rand.Intn(n)
+		}
+		return int((count - 1) % int64(n))
+	case ReplyStrategyNoRepeat:
+		key := target.key("last") + "_" + target.OpenID
+		last := -1
+		str, err := selectorRdb.Get(ctx, key).Result()
+		if err == nil {
+			last, _ = strconv.Atoi(str)
+		} else if err != redis.Nil {
+			log.Println("selectReplyIndex no_repeat error", err)
+		}
+		idx := weightedIndex(data.MsgList, last)
+		if dryRun {
+			return idx
+		}
+		err = selectorRdb.Set(ctx, key, strconv.Itoa(idx), replySelectorExpire).Err()
+		if err != nil {
+			log.Println("selectReplyIndex no_repeat error", err)
+		}
+		return idx
+	}
+	return rand.Intn(n)
+}
+
+// 按 weight 加权随机，exclude 为排除的下标，weight 都不大于0时等概率
+func weightedIndex(msgList []*AutoReplyMessage, exclude int) int {
+	total := 0
+	for i, msg := range msgList {
+		if i != exclude && msg.Weight > 0 {
+			total += msg.Weight
+		}
+	}
+	if total <= 0 {
+		if exclude < 0 || exclude >= len(msgList) {
+			return rand.Intn(len(msgList))
+		}
+		idx := rand.Intn(len(msgList) - 1)
+		if idx >= exclude {
+			idx++
+		}
+		return idx
+	}
+	r := rand.Intn(total)
+	for i, msg := range msgList {
+		if i == exclude || msg.Weight <= 0 {
+			continue
+		}
+		if r < msg.Weight {
+			return i
+		}
+		r -= msg.Weight
+	}
+	return 0
+}
+
+// 记录消息发出的次数，同时累加到按小时的统计
+func incrReplyHits(ctx context.Context, target *ReplyTarget, idxs []int) {
+	recordReplyStats(target, idxs)
+	if target == nil || selectorRdb == nil {
+		return
+	}
+	pipe := selectorRdb.Pipeline()
+	for _, idx := range idxs {
+		pipe.HIncrBy(ctx, target.key("hits"), strconv.Itoa(idx), 1)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		log.Println("incrReplyHits error", err)
+	}
+}
+
+// 获取规则中每条消息发出的次数，key 为消息的下标
+func GetReplyHits(ctx context.Context, appid, ruleKey string) (map[string]int64, error) {
+	ret := make(map[string]int64)
+	if selectorRdb == nil {
+		return ret, nil
+	}
+	target := &ReplyTarget{AppID: appid, RuleKey: ruleKey}
+	m, err := selectorRdb.HGetAll(ctx, target.key("hits")).Result()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range m {
+		ret[k], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return ret, nil
+}
@@ -0,0 +1,313 @@
+package weixinservice
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/**
+ * 自动回复的命中统计
+ * 每次回复按 appid、整点时间、回复类型、rule_key、消息下标累加到 mongodb，查询时再按需要汇总
+ * 关键词没有匹配到、改为消息回复的文本也按小时累加，用于发现需要补充的关键词
+ * 防重放拒绝的请求按小时、原因累加，用于发现重放攻击或者服务器时间不准
+ * 写入放在后台进行，失败只记录日志，不影响回复
+ * 模拟器的消息不统计
+ */
+
+// 统计的文本最多保留的字数
+const unmatchedContentMaxLen = 100
+
+func statHour(t time.Time) time.Time {
+	return t.Truncate(time.Hour)
+}
+
+// 记录规则中消息的命中次数
+func recordReplyStats(target *ReplyTarget, idxs []int) {
+	if target == nil || target.ReplyType == "" || target.DryRun || mongodb.ModelWxReplyStat == nil {
+		return
+	}
+	hour := statHour(time.Now())
+	go func() {
+		ctx := context.Background()
+		for _, idx := range idxs {
+			filter := bson.D{
+				{Key: "appid", Value: target.AppID},
+				{Key: "hour", Value: hour},
+				{Key: "reply_type", Value: string(target.ReplyType)},
+				{Key: "rule_key", Value: target.RuleKey},
+				{Key: "msg_index", Value: idx},
+			}
+			update := bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}}}
+			_, err := mongodb.ModelWxReplyStat.FindOneAndUpdate(ctx, filter, update, true)
+			if err != nil {
+				log.Println("recordReplyStats error", err)
+			}
+		}
+	}()
+}
+
+// 记录没有匹配到关键词的文本
+func recordUnmatchedText(appid string, content string) {
+	if content == "" || mongodb.ModelWxReplyUnmatched == nil {
+		return
+	}
+	if r := []rune(content); len(r) > unmatchedContentMaxLen {
+		content = string(r[:unmatchedContentMaxLen])
+	}
+	hour := statHour(time.Now())
+	go func() {
+		filter := bson.D{
+			{Key: "appid", Value: appid},
+			{Key: "hour", Value: hour},
+			{Key: "content", Value: content},
+		}
+		update := bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}}}
+		_, err := mongodb.ModelWxReplyUnmatched.FindOneAndUpdate(context.Background(), filter, update, true)
+		if err != nil {
+			log.Println("recordUnmatchedText error", err)
+		}
+	}()
+}
+
+// 记录防重放拒绝的请求，实现 msghandler.ReplayRejectHookFunc
+func RecordReplayReject(appid string, reason string) {
+	if mongodb.ModelWxReplayReject == nil {
+		return
+	}
+	hour := statHour(time.Now())
+	go func() {
+		filter := bson.D{
+			{Key: "appid", Value: appid},
+			{Key: "hour", Value: hour},
+			{Key: "reason", Value: reason},
+		}
+		update := bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}}}
+		_, err := mongodb.ModelWxReplayReject.FindOneAndUpdate(context.Background(), filter, update, true)
+		if err != nil {
+			log.Println("RecordReplayReject error", err)
+		}
+	}()
+}
+
+type ReplyStatsRuleItem struct {
+	ReplyType string `json:"reply_type" bson:"reply_type"`
+	RuleKey   string `json:"rule_key" bson:"rule_key"`
+	RuleTitle string `json:"rule_title" bson:"-"`
+	Count     int64  `json:"count" bson:"count"`
+}
+
+type ReplyStatsTextItem struct {
+	Content string `json:"content" bson:"_id"`
+	Count   int64  `json:"count" bson:"count"`
+}
+
+type ReplyStatsTrendItem struct {
+	Time  string `json:"time" bson:"_id"`
+	Count int64  `json:"count" bson:"count"`
+}
+
+type ReplayRejectStatsItem struct {
+	Reason string `json:"reason" bson:"_id"`
+	Count  int64  `json:"count" bson:"count"`
+}
+
+type ReplyStatsMessageItem struct {
+	MsgIndex int   `json:"msg_index" bson:"_id"`
+	Count    int64 `json:"count" bson:"count"`
+}
+
+func statsMatch(appid string, start, end time.Time) bson.D {
+	return bson.D{
+		{Key: "appid", Value: appid},
+		{Key: "hour", Value: bson.D{{Key: "$gte", Value: statHour(start)}, {Key: "$lt", Value: end}}},
+	}
+}
+
+const statsDateLayout = "2006-01-02"
+
+// 解析查询的日期范围，包含结束日期当天，默认为最近7天
+func ParseStatsDateRange(startDate, endDate string) (time.Time, time.Time, error) {
+	loc, err := (&ReplySchedule{}).location()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	now := time.Now().In(loc)
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1)
+	if endDate != "" {
+		t, err := time.ParseInLocation(statsDateLayout, endDate, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("end_date 格式错误")
+		}
+		end = t.AddDate(0, 0, 1)
+	}
+	start := end.AddDate(0, 0, -7)
+	if startDate != "" {
+		t, err := time.ParseInLocation(statsDateLayout, startDate, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("start_date 格式错误")
+		}
+		start = t
+	}
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, errors.New("start_date 不能晚于 end_date")
+	}
+	return start, end, nil
+}
+
+var ruleVariantSuffix = regexp.MustCompile(`_v\d+$`)
+
+// 命中次数最多的规则，replyType 为空时不限类型
+func GetTopReplyRules(ctx context.Context, appid string, replyType string, start, end time.Time, limit int) ([]*ReplyStatsRuleItem, error) {
+	match := statsMatch(appid, start, end)
+	if replyType != "" {
+		match = append(match, bson.E{Key: "reply_type", Value: replyType})
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "reply_type", Value: "$reply_type"}, {Key: "rule_key", Value: "$rule_key"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "reply_type", Value: "$_id.reply_type"},
+			{Key: "rule_key", Value: "$_id.rule_key"},
+			{Key: "count", Value: 1},
+		}}},
+	}
+	var list []*ReplyStatsRuleItem
+	err := mongodb.ModelWxReplyStat.Aggregate(ctx, pipeline, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	// 关注、消息、关键词回复的 rule_key 是规则的ID，补上规则的名称
+	titles := make(map[string]string)
+	for _, item := range list {
+		id := ruleVariantSuffix.ReplaceAllString(item.RuleKey, "")
+		title, ok := titles[id]
+		if !ok {
+			if _, err := primitive.ObjectIDFromHex(id); err == nil {
+				doc, err := mongodb.ModelWeixinAutoReply.FindByID(ctx, id)
+				if err != nil {
+					return nil, err
+				}
+				if doc != nil {
+					title = doc.RuleTitle
+				}
+			}
+			titles[id] = title
+		}
+		item.RuleTitle = title
+	}
+	return list, nil
+}
+
+// 规则中每条消息的命中次数
+func GetReplyRuleMessageStats(ctx context.Context, appid string, ruleKey string, start, end time.Time) ([]*ReplyStatsMessageItem, error) {
+	match := append(statsMatch(appid, start, end), bson.E{Key: "rule_key", Value: ruleKey})
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$msg_index"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	var list []*ReplyStatsMessageItem
+	err := mongodb.ModelWxReplyStat.Aggregate(ctx, pipeline, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// 出现次数最多的未匹配文本
+func GetTopUnmatchedTexts(ctx context.Context, appid string, start, end time.Time, limit int) ([]*ReplyStatsTextItem, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: statsMatch(appid, start, end)}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$content"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	var list []*ReplyStatsTextItem
+	err := mongodb.ModelWxReplyUnmatched.Aggregate(ctx, pipeline, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// 防重放拒绝的次数，按原因汇总
+func GetReplayRejectStats(ctx context.Context, appid string, start, end time.Time) ([]*ReplayRejectStatsItem, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: statsMatch(appid, start, end)}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$reason"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}}}},
+	}
+	var list []*ReplayRejectStatsItem
+	err := mongodb.ModelWxReplayReject.Aggregate(ctx, pipeline, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+/**
+ * 命中次数的趋势
+ * @param interval hour-按小时，day-按天，时间按回复生效时间的默认时区计算
+ * @param replyType ruleKey 为空时不限
+ */
+func GetReplyTrend(ctx context.Context, appid string, replyType string, ruleKey string, start, end time.Time, interval string) ([]*ReplyStatsTrendItem, error) {
+	match := statsMatch(appid, start, end)
+	if replyType != "" {
+		match = append(match, bson.E{Key: "reply_type", Value: replyType})
+	}
+	if ruleKey != "" {
+		match = append(match, bson.E{Key: "rule_key", Value: ruleKey})
+	}
+
+	format := "%Y-%m-%d %H:00"
+	if interval == "day" {
+		format = "%Y-%m-%d"
+	}
+	loc, err := (&ReplySchedule{}).location()
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$dateToString", Value: bson.D{
+				{Key: "format", Value: format},
+				{Key: "date", Value: "$hour"},
+				{Key: "timezone", Value: loc.String()},
+			}}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: "$count"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	var list []*ReplyStatsTrendItem
+	err = mongodb.ModelWxReplyStat.Aggregate(ctx, pipeline, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,37 @@
+package weixinservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseStatsDateRange(t *testing.T) {
+	t.Setenv("WX_SCHEDULE_TIMEZONE", "")
+
+	start, end, err := ParseStatsDateRange("2024-06-01", "2024-06-03")
+	if err != nil {
+		t.Fatalf("ParseStatsDateRange() error = %v", err)
+	}
+	// 按上海时间计算，包含结束日期当天
+	if want := time.Date(2024, 5, 31, 16, 0, 0, 0, time.UTC); !start.Equal(want) {
+		t.Errorf("start = %v, want %v", start.UTC(), want)
+	}
+	if want := time.Date(2024, 6, 3, 16, 0, 0, 0, time.UTC); !end.Equal(want) {
+		t.Errorf("end = %v, want %v", end.UTC(), want)
+	}
+
+	start, end, err = ParseStatsDateRange("", "")
+	if err != nil {
+		t.Fatalf("ParseStatsDateRange() default error = %v", err)
+	}
+	if end.Sub(start) != 7*24*time.Hour {
+		t.Errorf("default range = %v, want 7 days", end.Sub(start))
+	}
+
+	if _, _, err := ParseStatsDateRange("2024-06-05", "2024-06-01"); err == nil {
+		t.Error("start after end should fail")
+	}
+	if _, _, err := ParseStatsDateRange("2024/06/01", ""); err == nil {
+		t.Error("bad date format should fail")
+	}
+}
@@ -0,0 +1,154 @@
+package weixinservice
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/anchel/wechat-official-account-admin/mongodb"
+	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/**
+ * 回复内容中的模板变量，例如 "{{nickname}}你好，现在是{{time}}"
+ * 只做变量替换，不支持表达式和函数。替换只进行一次，变量的值里面即使有 {{xxx}} 也不会再被替换
+ * 没有的变量原样保留
+ *
+ * openid nickname remark tags subscribe_date scene date time datetime keyword
+ * keyword 为匹配到的关键词，不是整条消息；capture.1 capture.name 为关键词正则的分组
+ */
+
+type TemplateVars map[string]string
+
+// 需要调用微信接口获取的变量
+var remoteTemplateVars = []string{"remark", "tags"}
+
+// 获取需要调用微信接口的变量，由 modules/weixin 注册
+type TemplateVarsProvider func(ctx context.Context, appid, openid string, vars TemplateVars) error
+
+var templateVarsProvider TemplateVarsProvider
+
+func SetTemplateVarsProvider(provider TemplateVarsProvider) {
+	templateVarsProvider = provider
+}
+
+var templateVarRegexp = regexp.MustCompile(`\{\{\s*([\w.]+)\s*\}\}`)
+
+func RenderTemplate(s string, vars TemplateVars) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	return templateVarRegexp.ReplaceAllStringFunc(s, func(placeholder string) string {
+		name := templateVarRegexp.FindStringSubmatch(placeholder)[1]
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return placeholder
+	})
+}
+
+// 消息中用到的变量名
+func templateVarNames(msgList []*AutoReplyMessage) map[string]bool {
+	names := make(map[string]bool)
+	for _, msg := range msgList {
+		for _, s := range []string{msg.Content, msg.Title, msg.Description} {
+			for _, m := range templateVarRegexp.FindAllStringSubmatch(s, -1) {
+				names[m[1]] = true
+			}
+		}
+	}
+	return names
+}
+
+/**
+ * 准备模板变量，只查询消息中用到的
+ * @param msg 可以为nil，例如预览时
+ * @param keyword 匹配的关键词，可以为空，例如预览时填写的。关键词回复的消息上记录了匹配到的关键词，以消息上的为准
+ */
+func BuildTemplateVars(ctx context.Context, appid, openid string, msg msghandler.Message, keyword string, msgList []*AutoReplyMessage) TemplateVars {
+	names := templateVarNames(msgList)
+	vars := TemplateVars{}
+	if len(names) <= 0 {
+		return vars
+	}
+
+	vars["openid"] = openid
+	vars["keyword"] = keyword
+
+	loc, err := (&ReplySchedule{}).location()
+	if err != nil {
+		loc = time.Local
+	}
+	now := time.Now().In(loc)
+	vars["date"] = now.Format("2006-01-02")
+	vars["time"] = now.Format("15:04")
+	vars["datetime"] = now.Format("2006-01-02 15:04")
+
+	if names["nickname"] || names["subscribe_date"] || names["scene"] {
+		filter := bson.D{{Key: "appid", Value: appid}, {Key: "openid", Value: openid}}
+		user, err := mongodb.ModelWeixinUser.FindOne(ctx, filter)
+		if err != nil {
+			log.Println("BuildTemplateVars ModelWeixinUser.FindOne error", err)
+		}
+		if user != nil {
+			vars["nickname"] = user.Nickname
+			vars["scene"] = user.SceneID
+			if user.SubscribedAt != nil {
+				vars["subscribe_date"] = user.SubscribedAt.In(loc).Format("2006-01-02")
+			}
+		}
+	}
+
+	// 扫码事件以事件中的场景值为准
+	if e := msghandler.GetMessageEvent(msg); e != nil {
+		if e.Event == "SCAN" {
+			vars["scene"] = e.EventKey
+		} else if scene, ok := strings.CutPrefix(e.EventKey, "qrscene_"); ok && e.Event == "subscribe" {
+			vars["scene"] = scene
+		}
+	}
+
+	needRemote := false
+	for _, name := range remoteTemplateVars {
+		if names[name] {
+			needRemote = true
+		}
+	}
+	if needRemote && templateVarsProvider != nil {
+		err := templateVarsProvider(ctx, appid, openid, vars)
+		if err != nil {
+			log.Println("BuildTemplateVars templateVarsProvider error", err)
+		}
+	}
+
+	return vars
+}
+
+// 替换消息中的变量，返回新的消息，不修改原来的
+func RenderReplyMessages(msgList []*AutoReplyMessage, vars TemplateVars) []*AutoReplyMessage {
+	ret := make([]*AutoReplyMessage, len(msgList))
+	for i, msg := range msgList {
+		msgVars := vars
+		if len(msg.captures) > 0 || msg.keyword != "" {
+			msgVars = make(TemplateVars, len(vars)+len(msg.captures)+1)
+			for k, v := range vars {
+				msgVars[k] = v
+			}
+			for k, v := range msg.captures {
+				msgVars["capture."+k] = v
+			}
+			if msg.keyword != "" {
+				msgVars["keyword"] = msg.keyword
+			}
+		}
+		cp := *msg
+		cp.Content = RenderTemplate(cp.Content, msgVars)
+		cp.Title = RenderTemplate(cp.Title, msgVars)
+		cp.Description = RenderTemplate(cp.Description, msgVars)
+		ret[i] = &cp
+	}
+	return ret
+}
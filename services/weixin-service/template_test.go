@@ -0,0 +1,52 @@
+package weixinservice
+
+import (
+	"testing"
+)
+
+func TestRenderReplyMessagesKeyword(t *testing.T) {
+	msgList := []*AutoReplyMessage{{Content: "你问的是{{keyword}}，订单{{capture.1}}"}}
+	vars := TemplateVars{"keyword": "整条消息"}
+
+	// 包含匹配，keyword 为规则中的关键词，不是整条消息
+	def := &KeywordDef{Keyword: "价格"}
+	got := RenderReplyMessages(ExpandReplyMessages(msgList, def, MatchKeywordDef(def, nil, "请问价格多少")), vars)
+	if want := "你问的是价格，订单{{capture.1}}"; got[0].Content != want {
+		t.Errorf("Content = %q, want %q", got[0].Content, want)
+	}
+
+	def = &KeywordDef{Keyword: `订单(\d+)`, Regex: true}
+	re, err := CompileKeywordRegex(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = RenderReplyMessages(ExpandReplyMessages(msgList, def, MatchKeywordDef(def, re, "查询订单123")), vars)
+	if want := `你问的是订单(\d+)，订单123`; got[0].Content != want {
+		t.Errorf("Content = %q, want %q", got[0].Content, want)
+	}
+
+	// 不是关键词回复的消息使用传入的变量
+	got = RenderReplyMessages(msgList, vars)
+	if want := "你问的是整条消息，订单{{capture.1}}"; got[0].Content != want {
+		t.Errorf("Content = %q, want %q", got[0].Content, want)
+	}
+	if msgList[0].keyword != "" {
+		t.Error("ExpandReplyMessages should not modify the original messages")
+	}
+}
+
+func TestExpandReplyMessagesKeepsDollar(t *testing.T) {
+	def := &KeywordDef{Keyword: `(?P<item>会员)价格`, Regex: true}
+	re, err := CompileKeywordRegex(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgList := []*AutoReplyMessage{{Content: "{{capture.item}}价格 $1 / ${item} / $5 元", Title: "$1"}}
+	got := RenderReplyMessages(ExpandReplyMessages(msgList, def, MatchKeywordDef(def, re, "会员价格")), TemplateVars{})
+	if want := "会员价格 $1 / ${item} / $5 元"; got[0].Content != want {
+		t.Errorf("Content = %q, want %q", got[0].Content, want)
+	}
+	if got[0].Title != "$1" {
+		t.Errorf("Title = %q, want $1", got[0].Title)
+	}
+}
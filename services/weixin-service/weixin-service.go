@@ -3,16 +3,16 @@ package weixinservice
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 
-	"math/rand"
-
 	"github.com/anchel/wechat-official-account-admin/mongodb"
-	appidservice "github.com/anchel/wechat-official-account-admin/services/appid-service"
 	"github.com/anchel/wechat-official-account-admin/wxmp/msghandler"
+	"github.com/samber/lo"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -81,21 +81,67 @@ type AutoReplyMessage struct {
 	AppId        string                     `json:"appid,omitempty"`
 	PagePath     string                     `json:"pagepath,omitempty"`
 	CardId       string                     `json:"card_id,omitempty"`
+	Weight       int                        `json:"weight,omitempty"` // strategy=weighted时有效
+
+	captures map[string]string // 关键词正则匹配到的分组，模板变量用
+	keyword  string            // 匹配到的关键词，模板变量用
 }
 
 type AutoReplyData struct {
 	ReplyAll bool                `json:"reply_all"`
 	MsgList  []*AutoReplyMessage `json:"msg_list"`
+	Strategy string              `json:"strategy,omitempty"` // reply_all为false时选择消息的策略，random weighted round_robin no_repeat
+
+	Schedule *ReplySchedule   `json:"schedule,omitempty"` // 生效时间，为空表示一直生效
+	Variants []*AutoReplyData `json:"variants,omitempty"` // 按生效时间替换的回复，例如工作时间外的回复，排在前面的优先
+}
+
+// 获取 now 时生效的回复，优先取生效的 variants，都不生效时返回nil
+func (d *AutoReplyData) ActiveData(now time.Time) *AutoReplyData {
+	data, _ := d.activeVariant(now)
+	return data
+}
+
+// 返回生效的回复，以及是 variants 中的第几个，不是 variants 时为-1
+func (d *AutoReplyData) activeVariant(now time.Time) (*AutoReplyData, int) {
+	for i, v := range d.Variants {
+		if v.Schedule == nil || v.Schedule.Active(now) {
+			return v, i
+		}
+	}
+	if d.Schedule == nil || d.Schedule.Active(now) {
+		return d, -1
+	}
+	return nil, -1
+}
+
+// 检查生效时间的配置，保存时调用
+func (d *AutoReplyData) Validate() error {
+	if d.Schedule != nil {
+		if err := d.Schedule.Validate(); err != nil {
+			return err
+		}
+	}
+	if d.Strategy != "" && !lo.Contains([]string{ReplyStrategyRandom, ReplyStrategyWeighted, ReplyStrategyRoundRobin, ReplyStrategyNoRepeat}, d.Strategy) {
+		return errors.New("strategy error: " + d.Strategy)
+	}
+	for _, v := range d.Variants {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func GetReplyMessages(appid string, msg msghandler.Message) ([]*AutoReplyMessage, error) {
+// 消息对应的回复类型，不支持的返回空
+func GetReplyType(msg msghandler.Message) AutoReplyType {
 	msgType := msg.GetMsgType() // text image voice video shortvideo location link event
 
 	var replyType AutoReplyType
 
 	if msgType == "event" {
-		msg := msg.(*msghandler.MessageEvent)
-		if msg.Event == "subscribe" {
+		msg := msghandler.GetMessageEvent(msg)
+		if msg.Event == "subscribe" || msg.Event == "SCAN" { // 优先用二维码上配置的回复，没有再用关注回复
 			replyType = AutoReplyTypeSubscribe
 		} else if msg.Event == "CLICK" {
 			replyType = AutoReplyTypeMenuClick
@@ -108,43 +154,103 @@ func GetReplyMessages(appid string, msg msghandler.Message) ([]*AutoReplyMessage
 	}
 	// 其他的暂时不处理吧 shortvideo location link
 
+	return replyType
+}
+
+// dryRun 为模拟器的消息，回复和真实的一样，但不改变策略的状态，也不记录统计
+// ctx 带有被动回复的期限，调用外部回复时不会超过
+// trace 不为nil时记录判断的过程，见 ExplainReply，这时不调用外部回复
+func GetReplyMessages(ctx context.Context, appid string, msg msghandler.Message, dryRun bool, trace *ExplainResult) ([]*AutoReplyMessage, error) {
+	replyType := GetReplyType(msg)
 	if replyType == "" {
+		trace.step("消息类型 %s 不支持自动回复", msg.GetMsgType())
 		return nil, nil
 	}
+	trace.setReplyType(replyType)
 
 	var msgList []*AutoReplyMessage
 	var err error
-	if replyType == AutoReplyTypeMenuClick {
-		msgList, err = GetReplyMessagesForMenuClick(appid, replyType, msg.(*msghandler.MessageEvent).EventKey)
+	if replyType == AutoReplyTypeSubscribe {
+		msgList, err = GetReplyMessagesForScan(appid, msghandler.GetMessageEvent(msg), dryRun, trace)
+		if err != nil {
+			return msgList, err
+		}
+		if len(msgList) <= 0 {
+			msgList, err = GetReplyMessagesForCommon(appid, replyType, msg, dryRun, trace)
+		}
+	} else if replyType == AutoReplyTypeMenuClick {
+		msgList, err = GetReplyMessagesForMenuClick(appid, replyType, msghandler.GetMessageEvent(msg).EventKey, msg.GetFromUserName(), dryRun, trace)
 	} else if replyType == AutoReplyTypeKeyword {
-		msgList, err = GetReplyMessagesForKeyword(appid, replyType, msg.(*msghandler.MessageText).Content)
+		msgList, err = GetReplyMessagesForKeyword(appid, replyType, msg.(*msghandler.MessageText).Content, msg.GetFromUserName(), dryRun, trace)
 		if err != nil {
 			return msgList, err
 		}
 		if len(msgList) <= 0 {
 			log.Println("关键词回复为空，改为普通消息回复")
+			if !dryRun {
+				recordUnmatchedText(appid, msg.(*msghandler.MessageText).Content)
+			}
+			if trace == nil {
+				msgList = getFallbackReplyMessages(ctx, appid, msg)
+			} else if fallbackResponder != nil {
+				trace.step("关键词回复为空，实际回复时先调用外部回复，这里不调用")
+			}
+		}
+		if len(msgList) <= 0 {
 			replyType = AutoReplyTypeMessage // 改变获取类型
-			msgList, err = GetReplyMessagesForCommon(appid, replyType, msg)
+			trace.fallbackToMessage()
+			msgList, err = GetReplyMessagesForCommon(appid, replyType, msg, dryRun, trace)
 		}
 	} else {
-		msgList, err = GetReplyMessagesForCommon(appid, replyType, msg)
+		msgList, err = GetReplyMessagesForCommon(appid, replyType, msg, dryRun, trace)
 	}
-	return msgList, err
+	if err != nil || len(msgList) <= 0 {
+		return msgList, err
+	}
+
+	// 替换模板变量，关键词回复的 keyword 变量记录在消息上
+	vars := BuildTemplateVars(ctx, appid, msg.GetFromUserName(), msg, "", msgList)
+	return RenderReplyMessages(msgList, vars), nil
 }
 
 // 菜单点击回复
-func GetReplyMessagesForMenuClick(appid string, replyType AutoReplyType, key string) ([]*AutoReplyMessage, error) {
+func GetReplyMessagesForMenuClick(appid string, replyType AutoReplyType, key string, openid string, dryRun bool, trace *ExplainResult) ([]*AutoReplyMessage, error) {
 	log.Println("GetReplyMessagesForMenuClick", appid, replyType, key)
+	rd, ruleKey, err := findMenuReplyData(appid, replyType, key)
+	if err != nil {
+		return nil, err
+	}
+	if rd == nil {
+		trace.step("没有找到菜单 %s 的回复", key)
+		return nil, nil
+	}
+
+	rule := &ExplainRule{Source: "menu", RuleKey: ruleKey, RuleTitle: key}
+	msgList, err := trace.convert(rule, rd, &ReplyTarget{AppID: appid, OpenID: openid, RuleKey: ruleKey, ReplyType: replyType, DryRun: dryRun})
+	if err != nil {
+		return nil, err
+	}
+	if len(msgList) <= 0 {
+		rule.Reason = "不在生效时间内"
+		return nil, nil
+	}
+	rule.Winner = true
+	rule.Reason = "菜单 key 对应的回复"
+	return msgList, nil
+}
+
+// 查找菜单 key 对应的回复，以及 rule_key
+func findMenuReplyData(appid string, replyType AutoReplyType, key string) (*AutoReplyData, string, error) {
 	findOptions := options.Find()
 	filter := bson.D{{Key: "appid", Value: appid}, {Key: "reply_type", Value: string(replyType)}}
 	docs, err := mongodb.ModelWeixinAutoReply.FindMany(context.Background(), filter, findOptions)
 	if err != nil {
 		log.Println("Error GetReplyMessagesForMenuClick", err)
-		return nil, err
+		return nil, "", err
 	}
 	if len(docs) <= 0 {
 		log.Println("Error GetReplyMessagesForMenuClick", "docs is nil")
-		return nil, nil
+		return nil, "", nil
 	}
 
 	for _, doc := range docs {
@@ -157,132 +263,230 @@ func GetReplyMessagesForMenuClick(appid string, replyType AutoReplyType, key str
 		err = json.Unmarshal([]byte(doc.ReplyData), &replyDataMap)
 		if err != nil {
 			log.Println("Error json.Unmarshal", err)
-			return nil, err
+			return nil, "", err
 		}
 		rd, ok := replyDataMap[key]
 		if ok {
 			log.Println("GetReplyMessagesForMenuClick 找到key", key)
-			return ConvertReplyDataToMessages(rd)
+			return rd, "menu_" + doc.ExtId + "_" + key, nil
 		}
 	}
 
-	return nil, nil
+	return nil, "", nil
+}
+
+/**
+ * 带参数二维码的回复
+ * 未关注的用户扫码关注时 EventKey 为 qrscene_ 加场景值，已关注的用户扫码时 EventKey 为场景值
+ * 没有找到二维码或者二维码没有配置回复时返回空
+ */
+func GetReplyMessagesForScan(appid string, msg *msghandler.MessageEvent, dryRun bool, trace *ExplainResult) ([]*AutoReplyMessage, error) {
+	doc, err := findScanQrcode(appid, msg)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		trace.step("没有找到扫码的二维码")
+		return nil, nil
+	}
+	if doc.ReplyData == "" {
+		trace.step("二维码 %s 没有配置回复", doc.ID.Hex())
+		return nil, nil
+	}
+
+	ruleKey := "qrcode_" + doc.ID.Hex()
+	rule := &ExplainRule{Source: "qrcode", RuleID: doc.ID.Hex(), RuleKey: ruleKey, RuleTitle: doc.Title}
+	msgList, err := trace.convert(rule, doc.ReplyData, &ReplyTarget{AppID: appid, OpenID: msg.FromUserName, RuleKey: ruleKey, ReplyType: AutoReplyTypeSubscribe, DryRun: dryRun})
+	if err != nil {
+		return nil, err
+	}
+	if len(msgList) <= 0 {
+		rule.Reason = "二维码的回复不在生效时间内"
+		trace.step("二维码的回复为空，改为关注回复")
+		return nil, nil
+	}
+	rule.Winner = true
+	rule.Reason = "扫码优先使用二维码上配置的回复"
+	return msgList, nil
 }
 
-type KeywordDef struct {
-	Keyword string `json:"keyword"`
-	Exact   bool   `json:"exact"`
+// 查找扫码事件对应的二维码，不是扫码事件或者没有找到时返回nil
+func findScanQrcode(appid string, msg *msghandler.MessageEvent) (*mongodb.EntityWxQrcode, error) {
+	scene := msg.EventKey
+	if msg.Event == "subscribe" {
+		var ok bool
+		scene, ok = strings.CutPrefix(msg.EventKey, "qrscene_")
+		if !ok {
+			return nil, nil
+		}
+	}
+	if scene == "" {
+		return nil, nil
+	}
+	log.Println("GetReplyMessagesForScan", appid, msg.Event, scene)
+
+	// 场景值可能是 scene_str，也可能是 scene_id
+	or := bson.A{bson.D{{Key: "scene_str", Value: scene}}}
+	if sceneId, err := strconv.Atoi(scene); err == nil {
+		or = append(or, bson.D{{Key: "scene_id", Value: sceneId}})
+	}
+	filter := bson.D{{Key: "appid", Value: appid}, {Key: "$or", Value: or}}
+
+	// 同一个场景值可能生成过多个临时二维码，取最新的
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "created_at", Value: -1}})
+	findOptions.SetLimit(1)
+	docs, err := mongodb.ModelWxQrcode.FindMany(context.Background(), filter, findOptions)
+	if err != nil {
+		log.Println("Error GetReplyMessagesForScan", err)
+		return nil, err
+	}
+	if len(docs) <= 0 {
+		return nil, nil
+	}
+	return docs[0], nil
 }
 
 /**
  * 关键词回复
- * 先查出全部的规则，然后在进行匹配
+ * 用内存中编译好的匹配器，按优先级从高到低进行匹配
+ * 默认只取匹配到的第一个规则，公众号开启 keyword_match_all 时合并所有匹配到的规则的回复
  * @param keyword 关键词
  */
-func GetReplyMessagesForKeyword(appid string, replyType AutoReplyType, keyword string) ([]*AutoReplyMessage, error) {
+func GetReplyMessagesForKeyword(appid string, replyType AutoReplyType, keyword string, openid string, dryRun bool, trace *ExplainResult) ([]*AutoReplyMessage, error) {
 	log.Println("GetReplyMessagesForKeyword", appid, replyType, keyword)
 
 	// 检查回复的开关是否已经打开
-	enabled, err := appidservice.GetAppEnabledDataForReplyType(context.Background(), appid, string(replyType))
+	enabled, err := trace.checkEnabled(context.Background(), appid, string(replyType))
 	if err != nil {
-		log.Println("Error GetAppEnabledDataForReplyType", err)
 		return nil, err
 	}
 	if !enabled {
 		log.Println("GetReplyMessagesForKeyword", replyType, "reply is disabled")
+		trace.step("关键词回复没有开启")
 		return nil, nil
 	}
 
-	findOptions := options.Find()
-	filter := bson.D{{Key: "appid", Value: appid}, {Key: "reply_type", Value: string(replyType)}}
-	docs, err := mongodb.ModelWeixinAutoReply.FindMany(context.Background(), filter, findOptions)
+	matchAll, err := trace.checkEnabled(context.Background(), appid, "keyword_match_all")
 	if err != nil {
-		log.Println("Error GetReplyMessagesForKeyword", err)
 		return nil, err
 	}
-	if len(docs) <= 0 {
-		log.Println("Error GetReplyMessagesForKeyword", "docs is nil")
-		return nil, nil
+	if trace != nil {
+		trace.MatchAll = matchAll
 	}
-	log.Println("GetReplyMessagesForKeyword", "docs", len(docs))
 
-	for _, doc := range docs {
-		if doc.KeywordsDef == "" || doc.ReplyData == "" {
+	matcher, err := trace.keywordMatcher(context.Background(), appid)
+	if err != nil {
+		log.Println("Error GetKeywordMatcher", err)
+		return nil, err
+	}
+	matches := matcher.Match(keyword)
+	trace.step("匹配到 %d 条关键词规则", len(matches))
+
+	var ret []*AutoReplyMessage
+	for _, m := range matches {
+		rule := newKeywordExplainRule(m)
+		if len(ret) > 0 && !matchAll {
+			if trace == nil {
+				break
+			}
+			trace.skip(rule, "优先级更高的规则已经生效")
 			continue
 		}
-		keywordsDef := []KeywordDef{}
-		err = json.Unmarshal([]byte(doc.KeywordsDef), &keywordsDef)
+
+		log.Println("GetReplyMessagesForKeyword", "matched", m.Rule.RuleTitle)
+		msgList, err := trace.convert(rule, m.Rule.ReplyData, &ReplyTarget{AppID: appid, OpenID: openid, RuleKey: m.Rule.ID.Hex(), ReplyType: replyType, DryRun: dryRun})
 		if err != nil {
-			log.Println("Error json.Unmarshal", doc.RuleTitle, err)
-			continue
+			return nil, err
 		}
-
-		match := false
-		for _, def := range keywordsDef {
-			if def.Exact {
-				if def.Keyword == keyword {
-					match = true
-					break
-				}
-			} else {
-				if strings.Contains(keyword, def.Keyword) {
-					match = true
-					break
-				}
-			}
+		if len(msgList) <= 0 { // 不在生效时间内的规则，继续匹配下一个
+			rule.Reason = "不在生效时间内，继续匹配下一条"
+			continue
 		}
-
-		// 只取匹配到的第一个规则
-		if match {
-			log.Println("GetReplyMessagesForKeyword", "matched", doc.RuleTitle)
-			return ConvertReplyDataToMessages(doc.ReplyData)
+		rule.Winner = true
+		if matchAll {
+			rule.Reason = "开启了合并所有匹配到的规则"
+		} else {
+			rule.Reason = "生效的规则中优先级最高"
 		}
+		ret = append(ret, ExpandReplyMessages(msgList, m.Def, m.Match)...)
 	}
 
-	return nil, nil
+	return ret, nil
 }
 
 // 订阅和消息回复，都属于公共的
-func GetReplyMessagesForCommon(appid string, replyType AutoReplyType, msg msghandler.Message) ([]*AutoReplyMessage, error) {
+func GetReplyMessagesForCommon(appid string, replyType AutoReplyType, msg msghandler.Message, dryRun bool, trace *ExplainResult) ([]*AutoReplyMessage, error) {
 	log.Println("GetReplyMessagesForCommon", appid, replyType)
 
 	// 检查回复的开关是否已经打开
-	enabled, err := appidservice.GetAppEnabledDataForReplyType(context.Background(), appid, string(replyType))
+	enabled, err := trace.checkEnabled(context.Background(), appid, string(replyType))
 	if err != nil {
-		log.Println("Error GetAppEnabledDataForReplyType", err)
 		return nil, err
 	}
 	if !enabled {
 		log.Println("GetReplyMessagesForKeyword", replyType, "reply is disabled")
+		trace.step("%s 回复没有开启", replyType)
 		return nil, nil
 	}
 
-	filter := bson.D{{Key: "appid", Value: appid}, {Key: "reply_type", Value: string(replyType)}}
-	doc, err := mongodb.ModelWeixinAutoReply.FindOne(context.Background(), filter)
+	doc, err := trace.findCommonRule(context.Background(), appid, replyType)
 	if err != nil {
 		log.Println("Error ModelWeixinAutoReply.FindOne", err)
 		return nil, err
 	}
 	if doc == nil || doc.ReplyData == "" {
 		log.Println("Error ModelWeixinAutoReply.FindOne", "doc is nil or reply_data is empty", doc)
+		trace.step("没有配置 %s 回复", replyType)
 		return nil, nil
 	}
 
-	return ConvertReplyDataToMessages(doc.ReplyData)
+	rule := &ExplainRule{Source: "common", RuleID: doc.ID.Hex(), RuleKey: doc.ID.Hex()}
+	msgList, err := trace.convert(rule, doc.ReplyData, &ReplyTarget{AppID: appid, OpenID: msg.GetFromUserName(), RuleKey: doc.ID.Hex(), ReplyType: replyType, DryRun: dryRun})
+	if err != nil {
+		return nil, err
+	}
+	if len(msgList) <= 0 {
+		rule.Reason = "不在生效时间内"
+		return nil, nil
+	}
+	rule.Winner = true
+	rule.Reason = fmt.Sprintf("%s 回复只有一条", replyType)
+	return msgList, nil
 }
 
 /**
  * 将回复数据转换为消息列表
  * @param replyData { replay_all: true, msg_list: [{}, {}] }
+ * @param target 为nil时随机选择，也不记录发出的次数
  */
-func ConvertReplyDataToMessages(replyData any) ([]*AutoReplyMessage, error) {
+func ConvertReplyDataToMessages(replyData any, target *ReplyTarget) ([]*AutoReplyMessage, error) {
+	msgList, _, err := pickReplyMessages(replyData, target, false)
+	return msgList, err
+}
+
+// 选择回复的过程，用于解释回复是怎么来的
+type ReplyPick struct {
+	Active   bool   `json:"active"`   // 是否在生效时间内
+	Variant  int    `json:"variant"`  // 生效的是 variants 中的第几个，-1 表示不是 variants
+	RuleKey  string `json:"rule_key"` // 带上 variants 后缀的 rule_key
+	ReplyAll bool   `json:"reply_all"`
+	Strategy string `json:"strategy"`
+	Index    int    `json:"index"` // 选中的消息下标，reply_all 时为-1
+}
+
+// dryRun 时不改变轮流、不重复等策略的状态，也不记录次数
+func pickReplyMessages(replyData any, target *ReplyTarget, dryRun bool) ([]*AutoReplyMessage, *ReplyPick, error) {
+	if target != nil && target.DryRun {
+		dryRun = true
+	}
 	data := AutoReplyData{}
 
 	if str, ok := replyData.(string); ok {
 		err := json.Unmarshal([]byte(str), &data)
 		if err != nil {
 			log.Println("Error json.Unmarshal", err)
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
@@ -290,20 +494,44 @@ func ConvertReplyDataToMessages(replyData any) ([]*AutoReplyMessage, error) {
 		data = *d
 	}
 
+	pick := &ReplyPick{Variant: -1, Index: -1}
+	active, variantIdx := data.activeVariant(time.Now())
+	if active == nil {
+		log.Println("ConvertReplyDataToMessages", "not in schedule")
+		return nil, pick, nil
+	}
+	data = *active
+	pick.Active = true
+	pick.Variant = variantIdx
+	pick.ReplyAll = data.ReplyAll
+	pick.Strategy = data.Strategy
+	if target != nil {
+		target = target.variant(variantIdx)
+		pick.RuleKey = target.RuleKey
+	}
+
 	// log.Println("ConvertReplyDataToMessages", data)
 
 	if len(data.MsgList) <= 0 {
 		log.Println("Error ConvertReplyDataToMessages", "msg_list is empty")
-		return nil, nil
+		return nil, pick, nil
 	}
 
+	ctx := context.Background()
+
 	if data.ReplyAll {
 		log.Println("ConvertReplyDataToMessages", "reply all", len(data.MsgList))
-		return data.MsgList, nil
+		if !dryRun {
+			incrReplyHits(ctx, target, lo.Range(len(data.MsgList)))
+		}
+		return data.MsgList, pick, nil
 	}
 
-	// 生成一个 0 到 9 的随机整数（不包括 10）
-	randomNumber := rand.Intn(len(data.MsgList))
-	log.Println("ConvertReplyDataToMessages", "randomNumber", randomNumber)
-	return []*AutoReplyMessage{data.MsgList[randomNumber]}, nil
+	idx := selectReplyIndex(ctx, &data, target, dryRun)
+	log.Println("ConvertReplyDataToMessages", "strategy", data.Strategy, "index", idx)
+	pick.Index = idx
+	if !dryRun {
+		incrReplyHits(ctx, target, []int{idx})
+	}
+	return []*AutoReplyMessage{data.MsgList[idx]}, pick, nil
 }
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -60,19 +62,38 @@ func GetAccessToken(appid, appsecret string) (string, int64, error) {
 }
 
 /**
- * 这个不是单纯的解密，还涉及到解密后的数据处理，即提取指定区间的字节数据
+ * 微信消息加解密，对应官方 WXBizMsgCrypt 的格式
+ * 明文格式：random(16B) + msg_len(4B，网络字节序) + msg + appid
+ * 使用 AES-256-CBC，IV 取密钥的前 16 字节，PKCS#7 按 32 字节补位
  */
-func AesDecryptWechat(aesKey, encryptedMessage string) ([]byte, error) {
-	// Base64 解码 AES 密钥
+
+const wechatPkcs7BlockSize = 32
+
+func decodeWechatAesKey(aesKey string) ([]byte, error) {
 	aesKeyDecoded, err := base64.StdEncoding.DecodeString(aesKey + "=") // EncodingAESKey 加密需要补一个 '='
 	if err != nil {
 		return nil, fmt.Errorf("error decoding base64 key: %v", err)
 	}
+	if len(aesKeyDecoded) != 32 {
+		return nil, errors.New("aes key length is invalid")
+	}
+	return aesKeyDecoded, nil
+}
+
+/**
+ * 这个不是单纯的解密，还涉及到解密后的数据处理，即提取指定区间的字节数据
+ * 返回消息体和尾部的 AppID
+ */
+func AesDecryptWechat(aesKey, encryptedMessage string) ([]byte, string, error) {
+	aesKeyDecoded, err := decodeWechatAesKey(aesKey)
+	if err != nil {
+		return nil, "", err
+	}
 
 	// Base64 解码密文
 	ciphertext, err := base64.StdEncoding.DecodeString(encryptedMessage)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding base64 encrypted message: %v", err)
+		return nil, "", fmt.Errorf("error decoding base64 encrypted message: %v", err)
 	}
 
 	// 使用密钥的前 16 字节作为 IV
@@ -81,12 +102,12 @@ func AesDecryptWechat(aesKey, encryptedMessage string) ([]byte, error) {
 	// 创建 AES 解密器
 	block, err := aes.NewCipher(aesKeyDecoded)
 	if err != nil {
-		return nil, fmt.Errorf("error creating AES cipher: %v", err)
+		return nil, "", fmt.Errorf("error creating AES cipher: %v", err)
 	}
 
 	// 检查密文长度
 	if len(ciphertext) < aes.BlockSize || len(ciphertext)%aes.BlockSize != 0 {
-		return nil, errors.New("ciphertext length is invalid")
+		return nil, "", errors.New("ciphertext length is invalid")
 	}
 
 	mode := cipher.NewCBCDecrypter(block, iv)
@@ -94,25 +115,52 @@ func AesDecryptWechat(aesKey, encryptedMessage string) ([]byte, error) {
 	mode.CryptBlocks(decrypted, ciphertext)
 
 	// 去除 PKCS#7 填充
-	decrypted = pkcs7Unpad(decrypted)
+	decrypted, err = pkcs7Unpad(decrypted, wechatPkcs7BlockSize)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(decrypted) < 20 {
+		return nil, "", errors.New("decrypted message is too short")
+	}
 
-	// 去除前 16 字节长度的网络字节序，以及 AppID 后多余的字符
-	contentLength := int(decrypted[16])<<24 | int(decrypted[17])<<16 | int(decrypted[18])<<8 | int(decrypted[19])
-	// message := string(decrypted[20 : 20+contentLength])
+	// 去除前 16 字节的随机串，再读取 4 字节网络字节序的消息长度，剩余的是 AppID
+	contentLength := int(binary.BigEndian.Uint32(decrypted[16:20]))
+	if contentLength > len(decrypted)-20 {
+		return nil, "", errors.New("decrypted message length is invalid")
+	}
 
-	return decrypted[20 : 20+contentLength], nil
+	return decrypted[20 : 20+contentLength], string(decrypted[20+contentLength:]), nil
 }
 
 // PKCS#7 填充去除
-func pkcs7Unpad(p []byte) []byte {
+func pkcs7Unpad(p []byte, blockSize int) ([]byte, error) {
+	if len(p) == 0 {
+		return nil, errors.New("pkcs7 data is empty")
+	}
 	padding := int(p[len(p)-1])
-	return p[:len(p)-padding]
+	if padding < 1 || padding > blockSize || padding > len(p) {
+		return nil, errors.New("pkcs7 padding is invalid")
+	}
+	return p[:len(p)-padding], nil
 }
 
-func AesEncrypt(plainText []byte, aesKey string) (string, error) {
-	aesKeyDecoded, err := base64.StdEncoding.DecodeString(aesKey + "=") // EncodingAESKey 加密需要补一个 '='
+/**
+ * 加密回复给微信服务器的消息，和 AesDecryptWechat 互为逆操作
+ */
+func AesEncryptWechat(aesKey, appid string, plainText []byte) (string, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, randomBytes); err != nil {
+		return "", err
+	}
+	return aesEncryptWechatWithRandom(aesKey, appid, randomBytes, plainText)
+}
+
+// 指定开头的16字节随机串，测试时用来和官方的示例比较
+func aesEncryptWechatWithRandom(aesKey, appid string, randomBytes []byte, plainText []byte) (string, error) {
+	aesKeyDecoded, err := decodeWechatAesKey(aesKey)
 	if err != nil {
-		return "", fmt.Errorf("error decoding base64 key: %v", err)
+		return "", err
 	}
 
 	block, err := aes.NewCipher(aesKeyDecoded)
@@ -120,12 +168,21 @@ func AesEncrypt(plainText []byte, aesKey string) (string, error) {
 		return "", err
 	}
 
+	lengthBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(lengthBytes, uint32(len(plainText)))
+
+	var buf bytes.Buffer
+	buf.Write(randomBytes)
+	buf.Write(lengthBytes)
+	buf.Write(plainText)
+	buf.WriteString(appid)
+
 	// 使用AES加密
 	iv := aesKeyDecoded[:aes.BlockSize]
-	plainText = pkcs7Padding(plainText, aes.BlockSize)
-	cipherText := make([]byte, len(plainText))
+	data := pkcs7Padding(buf.Bytes(), wechatPkcs7BlockSize)
+	cipherText := make([]byte, len(data))
 	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(cipherText, plainText)
+	mode.CryptBlocks(cipherText, data)
 
 	return base64.StdEncoding.EncodeToString(cipherText), nil
 }
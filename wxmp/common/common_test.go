@@ -0,0 +1,152 @@
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"testing"
+)
+
+// 微信官方加解密示例（WXBizMsgCrypt）中的数据
+const (
+	sampleAesKey    = "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG"
+	sampleToken     = "spamtest"
+	sampleAppID     = "wx2c2769f8efd9abc2"
+	sampleTimestamp = "1409735669"
+	sampleNonce     = "1320562132"
+	sampleSignature = "5d197aaffba7e9b25a30732f161a50dee96bd5fa"
+	sampleEncrypt   = "hyzAe4OzmOMbd6TvGdIOO6uBmdJoD0Fk53REIHvxYtJlE2B655HuD0m8KUePWB3+LrPXo87wzQ1QLvbeUgmBM4x6F8PGHQHFVAFmOD2LdJF9FrXpbUAh0B5GIItb52sn896wVsMSHGuPE328HnRGBcrS7C41IzDWyWNlZkyyXwon8T332jisa+h6tEDYsVticbSnyU8dKOIbgU6ux5VTjg3yt+WGzjlpKn6NPhRjpA912xMezR4kw6KWwMrCVKSVCZciVGCgavjIQ6X8tCOp3yZbGpy0VxpAe+77TszTfRd5RJSVO/HTnifJpXgCSUdUue1v6h0EIBYYI1BD1DlD+C0CR8e6OewpusjZ4uBl9FyJvnhvQl+q5rv1ixrcpCumEPo5MJSgM9ehVsNPfUM669WuMyVWQLCzpu9GhglF2PE="
+	sampleMessage   = "<xml><ToUserName><![CDATA[gh_10f6c3c3ac5a]]></ToUserName>\n" +
+		"<FromUserName><![CDATA[oyORnuP8q7ou2gfYjqLzSIWZf0rs]]></FromUserName>\n" +
+		"<CreateTime>1409735668</CreateTime>\n" +
+		"<MsgType><![CDATA[text]]></MsgType>\n" +
+		"<Content><![CDATA[abcdteT]]></Content>\n" +
+		"<MsgId>6054768590064713728</MsgId>\n" +
+		"</xml>"
+)
+
+func TestGenerateSignatureSample(t *testing.T) {
+	if got := GenerateSignature(sampleToken, sampleTimestamp, sampleNonce, sampleEncrypt); got != sampleSignature {
+		t.Errorf("GenerateSignature() = %s, want %s", got, sampleSignature)
+	}
+}
+
+func TestAesDecryptWechatSample(t *testing.T) {
+	msg, appid, err := AesDecryptWechat(sampleAesKey, sampleEncrypt)
+	if err != nil {
+		t.Fatalf("AesDecryptWechat() error = %v", err)
+	}
+	if string(msg) != sampleMessage {
+		t.Errorf("AesDecryptWechat() msg = %q", msg)
+	}
+	if appid != sampleAppID {
+		t.Errorf("AesDecryptWechat() appid = %q, want %q", appid, sampleAppID)
+	}
+}
+
+// 用示例中的随机串重新加密，结果要和示例的密文一致
+func TestAesEncryptWechatSample(t *testing.T) {
+	randomBytes := decryptRaw(t, sampleAesKey, sampleEncrypt)[:16]
+	encrypted, err := aesEncryptWechatWithRandom(sampleAesKey, sampleAppID, randomBytes, []byte(sampleMessage))
+	if err != nil {
+		t.Fatalf("aesEncryptWechatWithRandom() error = %v", err)
+	}
+	if encrypted != sampleEncrypt {
+		t.Errorf("aesEncryptWechatWithRandom() = %s, want %s", encrypted, sampleEncrypt)
+	}
+}
+
+func TestAesEncryptWechatRoundTrip(t *testing.T) {
+	plain := []byte("<xml><Content><![CDATA[你好]]></Content></xml>")
+	encrypted, err := AesEncryptWechat(sampleAesKey, sampleAppID, plain)
+	if err != nil {
+		t.Fatalf("AesEncryptWechat() error = %v", err)
+	}
+	msg, appid, err := AesDecryptWechat(sampleAesKey, encrypted)
+	if err != nil {
+		t.Fatalf("AesDecryptWechat() error = %v", err)
+	}
+	if !bytes.Equal(msg, plain) || appid != sampleAppID {
+		t.Errorf("round trip = %q %q", msg, appid)
+	}
+}
+
+// 解密只返回尾部的 appid，和公众号的不一致时由调用方拒绝
+func TestAesDecryptWechatWrongAppID(t *testing.T) {
+	encrypted, err := AesEncryptWechat(sampleAesKey, "wx_other_appid", []byte(sampleMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, appid, err := AesDecryptWechat(sampleAesKey, encrypted)
+	if err != nil {
+		t.Fatalf("AesDecryptWechat() error = %v", err)
+	}
+	if appid == sampleAppID {
+		t.Errorf("AesDecryptWechat() appid = %q, should not match %q", appid, sampleAppID)
+	}
+}
+
+func TestAesDecryptWechatBadPadding(t *testing.T) {
+	key, err := decodeWechatAesKey(sampleAesKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 最后一个字节为补位长度，0 和大于32都不合法
+	for _, pad := range []byte{0, 33} {
+		plain := bytes.Repeat([]byte{'a'}, 32)
+		plain[len(plain)-1] = pad
+		if _, _, err := AesDecryptWechat(sampleAesKey, encryptRaw(t, key, plain)); err == nil {
+			t.Errorf("AesDecryptWechat() with padding %d should fail", pad)
+		}
+	}
+
+	// 密文长度不是16的倍数
+	short := base64.StdEncoding.EncodeToString([]byte("0123456789"))
+	if _, _, err := AesDecryptWechat(sampleAesKey, short); err == nil {
+		t.Error("AesDecryptWechat() with short ciphertext should fail")
+	}
+
+	// 补位正确，但消息长度超过实际的长度
+	plain := pkcs7Padding(append(bytes.Repeat([]byte{'a'}, 16), 0, 0, 1, 0), wechatPkcs7BlockSize)
+	if _, _, err := AesDecryptWechat(sampleAesKey, encryptRaw(t, key, plain)); err == nil {
+		t.Error("AesDecryptWechat() with invalid length should fail")
+	}
+}
+
+func TestAesKeyInvalid(t *testing.T) {
+	if _, _, err := AesDecryptWechat("short", sampleEncrypt); err == nil {
+		t.Error("AesDecryptWechat() with invalid key should fail")
+	}
+	if _, err := AesEncryptWechat("short", sampleAppID, []byte("x")); err == nil {
+		t.Error("AesEncryptWechat() with invalid key should fail")
+	}
+}
+
+func encryptRaw(t *testing.T, key, plain []byte) string {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, key[:aes.BlockSize]).CryptBlocks(out, plain)
+	return base64.StdEncoding.EncodeToString(out)
+}
+
+func decryptRaw(t *testing.T, aesKey, encrypted string) []byte {
+	key, err := decodeWechatAesKey(aesKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, key[:aes.BlockSize]).CryptBlocks(out, data)
+	return out
+}
@@ -0,0 +1,117 @@
+package msghandler
+
+/**
+ * 客服消息的请求体，不依赖请求上下文，可以在后台任务中使用
+ * 接收者 touser 由 WxApi.SendCustomMessage 填充
+ */
+
+// 客服消息-文本
+func NewCustomText(content string) map[string]any {
+	return map[string]any{
+		"msgtype": "text",
+		"text": map[string]string{
+			"content": content,
+		},
+	}
+}
+
+// 客服消息-图片
+func NewCustomImage(mediaId string) map[string]any {
+	return map[string]any{
+		"msgtype": "image",
+		"image": map[string]string{
+			"media_id": mediaId,
+		},
+	}
+}
+
+// 客服消息-语音
+func NewCustomVoice(mediaId string) map[string]any {
+	return map[string]any{
+		"msgtype": "voice",
+		"voice": map[string]string{
+			"media_id": mediaId,
+		},
+	}
+}
+
+// 客服消息-视频
+func NewCustomVideo(mediaId, thumbMediaId, title, description string) map[string]any {
+	return map[string]any{
+		"msgtype": "video",
+		"video": map[string]string{
+			"media_id":       mediaId,
+			"thumb_media_id": thumbMediaId,
+			"title":          title,
+			"description":    description,
+		},
+	}
+}
+
+// 客服消息-音乐
+func NewCustomMusic(title, description, musicUrl, hqMusicUrl, thumbMediaId string) map[string]any {
+	return map[string]any{
+		"msgtype": "music",
+		"music": map[string]string{
+			"title":          title,
+			"description":    description,
+			"musicurl":       musicUrl,
+			"hqmusicurl":     hqMusicUrl,
+			"thumb_media_id": thumbMediaId,
+		},
+	}
+}
+
+// 客服消息-图文(外链)
+func NewCustomNews(articles []*SendMessageArticle) map[string]any {
+	return map[string]any{
+		"msgtype": "news",
+		"news": map[string]any{
+			"articles": articles,
+		},
+	}
+}
+
+// 客服消息-微信图文
+// 这个方式，微信即将废弃
+func NewCustomMpNews(mediaId string) map[string]any {
+	return map[string]any{
+		"msgtype": "mpnews",
+		"mpnews": map[string]any{
+			"media_id": mediaId,
+		},
+	}
+}
+
+// 客服消息-微信图文(文章)
+func NewCustomMpNewsArticle(articleId string) map[string]any {
+	return map[string]any{
+		"msgtype": "mpnewsarticle",
+		"mpnewsarticle": map[string]any{
+			"article_id": articleId,
+		},
+	}
+}
+
+// 客服消息-卡券
+func NewCustomWxCard(cardId string) map[string]any {
+	return map[string]any{
+		"msgtype": "wxcard",
+		"wxcard": map[string]string{
+			"card_id": cardId,
+		},
+	}
+}
+
+// 客服消息-小程序卡片
+func NewCustomMiniProgramPage(title, appId, pagePath, thumbMediaId string) map[string]any {
+	return map[string]any{
+		"msgtype": "miniprogrampage",
+		"miniprogrampage": map[string]string{
+			"title":          title,
+			"appid":          appId,
+			"pagepath":       pagePath,
+			"thumb_media_id": thumbMediaId,
+		},
+	}
+}
@@ -0,0 +1,178 @@
+package msghandler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+/**
+ * 微信服务器在5秒内收不到响应会重试，最多重试三次
+ * 普通消息用 MsgId 排重，事件用 FromUserName + CreateTime + Event 排重
+ * 重试的请求直接返回第一次请求的回包，不再执行处理函数
+ */
+
+type CachedReply struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+}
+
+type Deduplicator interface {
+	Acquire(appid, fingerprint string) (bool, error)
+	GetReply(appid, fingerprint string) (*CachedReply, error)
+	SaveReply(appid, fingerprint string, reply *CachedReply) error
+}
+
+// 微信的重试间隔是5秒，共3次，保留60秒足够了
+const dedupExpire = 60 * time.Second
+
+type RedisDeduplicator struct {
+	rdb *redis.Client
+}
+
+func NewRedisDeduplicator(rdb *redis.Client) *RedisDeduplicator {
+	return &RedisDeduplicator{
+		rdb: rdb,
+	}
+}
+
+func (r *RedisDeduplicator) lockKey(appid, fingerprint string) string {
+	return appid + "_msg_dedup_lock_" + fingerprint
+}
+
+func (r *RedisDeduplicator) replyKey(appid, fingerprint string) string {
+	return appid + "_msg_dedup_reply_" + fingerprint
+}
+
+// 第一次收到这条消息返回true
+func (r *RedisDeduplicator) Acquire(appid, fingerprint string) (bool, error) {
+	return r.rdb.SetNX(context.TODO(), r.lockKey(appid, fingerprint), "1", dedupExpire).Result()
+}
+
+func (r *RedisDeduplicator) GetReply(appid, fingerprint string) (*CachedReply, error) {
+	str, err := r.rdb.Get(context.TODO(), r.replyKey(appid, fingerprint)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var reply CachedReply
+	err = json.Unmarshal([]byte(str), &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+func (r *RedisDeduplicator) SaveReply(appid, fingerprint string, reply *CachedReply) error {
+	bs, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return r.rdb.Set(context.TODO(), r.replyKey(appid, fingerprint), string(bs), dedupExpire).Err()
+}
+
+// 消息的排重标识，返回空字符串表示不需要排重
+func GetMsgFingerprint(msg Message) string {
+	if msg == nil {
+		return ""
+	}
+	if m, ok := msg.(MessageWithMsgId); ok && m.GetMsgId() != 0 {
+		return fmt.Sprint("msgid_", m.GetMsgId())
+	}
+	if m := GetMessageEvent(msg); m != nil {
+		return fmt.Sprint("event_", m.FromUserName, "_", m.CreateTime, "_", m.Event)
+	}
+	return ""
+}
+
+// 记录下写给微信服务器的回包，用于重试时直接返回
+type replyCaptureWriter struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *replyCaptureWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *replyCaptureWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// 重试的请求，等待第一次请求处理完成，然后返回同样的回包
+func waitCachedReply(c *gin.Context, deduplicator Deduplicator, appid, fingerprint string) {
+	count := 0
+	for {
+		reply, err := deduplicator.GetReply(appid, fingerprint)
+		if err != nil {
+			log.Println("waitCachedReply GetReply error", err)
+			break
+		}
+		if reply != nil {
+			log.Println("waitCachedReply hit cached reply", fingerprint)
+			c.Data(reply.Status, reply.ContentType, reply.Body)
+			return
+		}
+		count++
+		if count > 8 {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	log.Println("waitCachedReply no cached reply, return success", fingerprint)
+	c.String(200, "success")
+}
+
+// 排重中间件
+func DedupMiddleware(deduplicator Deduplicator) Middleware {
+	return func(next MsgHandlerFunc) MsgHandlerFunc {
+		return func(rc *ReplyCtrl, msg Message) {
+			fingerprint := GetMsgFingerprint(msg)
+			if fingerprint == "" {
+				next(rc, msg)
+				return
+			}
+
+			c := rc.c
+			appid := rc.msgHandler.mpoptions.AppId
+			ok, err := deduplicator.Acquire(appid, fingerprint)
+			if err != nil {
+				// redis 出错时不影响正常处理
+				log.Println("DedupMiddleware Acquire error", err)
+				next(rc, msg)
+				return
+			}
+			if !ok {
+				log.Println("DedupMiddleware duplicate message", fingerprint)
+				waitCachedReply(c, deduplicator, appid, fingerprint)
+				return
+			}
+
+			writer := &replyCaptureWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+			c.Writer = writer
+
+			next(rc, msg)
+
+			reply := &CachedReply{
+				Status:      writer.Status(),
+				ContentType: writer.Header().Get("Content-Type"),
+				Body:        writer.body.Bytes(),
+			}
+			err = deduplicator.SaveReply(appid, fingerprint, reply)
+			if err != nil {
+				log.Println("DedupMiddleware SaveReply error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package msghandler
+
+/**
+ * 事件推送
+ * 各类事件都内嵌了 MessageEvent，公共字段和方法直接使用即可
+ * subscribe unsubscribe SCAN CLICK 没有额外的字段，直接就是 MessageEvent
+ * parseMessage 根据 Event 字段从 eventDecoders 中找到对应的结构体进行解析
+ */
+
+type Event interface {
+	Message
+	GetMessageEvent() *MessageEvent
+}
+
+// 取得事件的公共部分，非事件返回nil
+func GetMessageEvent(msg Message) *MessageEvent {
+	if e, ok := msg.(Event); ok {
+		return e.GetMessageEvent()
+	}
+	return nil
+}
+
+type EventDecoder func() Event
+
+var eventDecoders = map[string]EventDecoder{
+	"LOCATION":                   func() Event { return &EventLocation{} },
+	"VIEW":                       func() Event { return &EventView{} },
+	"view_miniprogram":           func() Event { return &EventViewMiniprogram{} },
+	"scancode_push":              func() Event { return &EventScanCode{} },
+	"scancode_waitmsg":           func() Event { return &EventScanCode{} },
+	"pic_sysphoto":               func() Event { return &EventSendPics{} },
+	"pic_photo_or_album":         func() Event { return &EventSendPics{} },
+	"pic_weixin":                 func() Event { return &EventSendPics{} },
+	"location_select":            func() Event { return &EventLocationSelect{} },
+	"TEMPLATESENDJOBFINISH":      func() Event { return &EventTemplateSendJobFinish{} },
+	"MASSSENDJOBFINISH":          func() Event { return &EventMassSendJobFinish{} },
+	"PUBLISHJOBFINISH":           func() Event { return &EventPublishJobFinish{} },
+	"subscribe_msg_popup_event":  func() Event { return &EventSubscribeMsgPopup{} },
+	"subscribe_msg_change_event": func() Event { return &EventSubscribeMsgChange{} },
+	"subscribe_msg_sent_event":   func() Event { return &EventSubscribeMsgSent{} },
+}
+
+// 注册事件的解析结构体，可以覆盖默认的
+func RegisterEventDecoder(event string, decoder EventDecoder) {
+	eventDecoders[event] = decoder
+}
+
+func newEventByName(event string) Event {
+	if decoder, ok := eventDecoders[event]; ok {
+		return decoder()
+	}
+	return &MessageEvent{}
+}
+
+// 上报地理位置
+type EventLocation struct {
+	MessageEvent
+
+	Latitude  float64 `xml:"Latitude" json:"Latitude"`
+	Longitude float64 `xml:"Longitude" json:"Longitude"`
+	Precision float64 `xml:"Precision" json:"Precision"`
+}
+
+// 点击菜单跳转链接，EventKey 是跳转的url
+type EventView struct {
+	MessageEvent
+
+	MenuId string `xml:"MenuId" json:"MenuId"`
+}
+
+// 点击菜单跳转小程序，EventKey 是小程序的路径
+type EventViewMiniprogram struct {
+	MessageEvent
+
+	MenuId string `xml:"MenuId" json:"MenuId"`
+}
+
+type SubStructScanCodeInfo struct {
+	ScanType   string `xml:"ScanType" json:"ScanType"`
+	ScanResult string `xml:"ScanResult" json:"ScanResult"`
+}
+
+// 扫码推事件、扫码推事件且弹出“消息接收中”提示框
+type EventScanCode struct {
+	MessageEvent
+
+	ScanCodeInfo SubStructScanCodeInfo `xml:"ScanCodeInfo" json:"ScanCodeInfo"`
+}
+
+type SubStructPicItem struct {
+	PicMd5Sum string `xml:"PicMd5Sum" json:"PicMd5Sum"`
+}
+
+type SubStructPicList struct {
+	Item []*SubStructPicItem `xml:"item" json:"item"`
+}
+
+type SubStructSendPicsInfo struct {
+	Count   int              `xml:"Count" json:"Count"`
+	PicList SubStructPicList `xml:"PicList" json:"PicList"`
+}
+
+// 弹出系统拍照发图、拍照或者相册发图、微信相册发图器
+type EventSendPics struct {
+	MessageEvent
+
+	SendPicsInfo SubStructSendPicsInfo `xml:"SendPicsInfo" json:"SendPicsInfo"`
+}
+
+type SubStructSendLocationInfo struct {
+	LocationX string `xml:"Location_X" json:"Location_X"`
+	LocationY string `xml:"Location_Y" json:"Location_Y"`
+	Scale     string `xml:"Scale" json:"Scale"`
+	Label     string `xml:"Label" json:"Label"`
+	Poiname   string `xml:"Poiname" json:"Poiname"`
+}
+
+// 弹出地理位置选择器
+type EventLocationSelect struct {
+	MessageEvent
+
+	SendLocationInfo SubStructSendLocationInfo `xml:"SendLocationInfo" json:"SendLocationInfo"`
+}
+
+// 模板消息发送结果
+type EventTemplateSendJobFinish struct {
+	MessageEvent
+
+	MsgID  int64  `xml:"MsgID" json:"MsgID"`
+	Status string `xml:"Status" json:"Status"` // success, failed:user block, failed: system failed
+}
+
+type SubStructCopyrightCheckItem struct {
+	ArticleIdx            int    `xml:"ArticleIdx" json:"ArticleIdx"`
+	UserDeclareState      int    `xml:"UserDeclareState" json:"UserDeclareState"`
+	AuditState            int    `xml:"AuditState" json:"AuditState"`
+	OriginalArticleUrl    string `xml:"OriginalArticleUrl" json:"OriginalArticleUrl"`
+	OriginalArticleType   int    `xml:"OriginalArticleType" json:"OriginalArticleType"`
+	CanReprint            int    `xml:"CanReprint" json:"CanReprint"`
+	NeedReplaceContent    int    `xml:"NeedReplaceContent" json:"NeedReplaceContent"`
+	NeedShowReprintSource int    `xml:"NeedShowReprintSource" json:"NeedShowReprintSource"`
+}
+
+type SubStructCopyrightCheckResultList struct {
+	Item []*SubStructCopyrightCheckItem `xml:"item" json:"item"`
+}
+
+type SubStructCopyrightCheckResult struct {
+	Count      int                               `xml:"Count" json:"Count"`
+	ResultList SubStructCopyrightCheckResultList `xml:"ResultList" json:"ResultList"`
+	CheckState int                               `xml:"CheckState" json:"CheckState"`
+}
+
+type SubStructArticleUrlItem struct {
+	ArticleIdx int    `xml:"ArticleIdx" json:"ArticleIdx"`
+	ArticleUrl string `xml:"ArticleUrl" json:"ArticleUrl"`
+}
+
+type SubStructArticleUrlResultList struct {
+	Item []*SubStructArticleUrlItem `xml:"item" json:"item"`
+}
+
+type SubStructArticleUrlResult struct {
+	Count      int                           `xml:"Count" json:"Count"`
+	ResultList SubStructArticleUrlResultList `xml:"ResultList" json:"ResultList"`
+}
+
+// 群发结果
+type EventMassSendJobFinish struct {
+	MessageEvent
+
+	MsgID                int64                         `xml:"MsgID" json:"MsgID"`
+	Status               string                        `xml:"Status" json:"Status"`
+	TotalCount           int                           `xml:"TotalCount" json:"TotalCount"`
+	FilterCount          int                           `xml:"FilterCount" json:"FilterCount"`
+	SentCount            int                           `xml:"SentCount" json:"SentCount"`
+	ErrorCount           int                           `xml:"ErrorCount" json:"ErrorCount"`
+	CopyrightCheckResult SubStructCopyrightCheckResult `xml:"CopyrightCheckResult" json:"CopyrightCheckResult"`
+	ArticleUrlResult     SubStructArticleUrlResult     `xml:"ArticleUrlResult" json:"ArticleUrlResult"`
+}
+
+type SubStructPublishArticleItem struct {
+	Idx        int    `xml:"idx" json:"idx"`
+	ArticleUrl string `xml:"article_url" json:"article_url"`
+}
+
+type SubStructPublishArticleDetail struct {
+	Count int                            `xml:"count" json:"count"`
+	Item  []*SubStructPublishArticleItem `xml:"item" json:"item"`
+}
+
+type SubStructPublishEventInfo struct {
+	PublishId     string                        `xml:"publish_id" json:"publish_id"`
+	PublishStatus int                           `xml:"publish_status" json:"publish_status"` // 0-成功 1-发布中 2-原创失败 3-常规失败 4-平台审核不通过 5-成功后用户删除所有文章 6-成功后系统封禁所有文章
+	ArticleId     string                        `xml:"article_id" json:"article_id"`
+	ArticleDetail SubStructPublishArticleDetail `xml:"article_detail" json:"article_detail"`
+	FailIdx       []int                         `xml:"fail_idx" json:"fail_idx"`
+}
+
+// 发布结果
+type EventPublishJobFinish struct {
+	MessageEvent
+
+	PublishEventInfo SubStructPublishEventInfo `xml:"PublishEventInfo" json:"PublishEventInfo"`
+}
+
+type SubStructSubscribeMsgPopupItem struct {
+	TemplateId            string `xml:"TemplateId" json:"TemplateId"`
+	SubscribeStatusString string `xml:"SubscribeStatusString" json:"SubscribeStatusString"` // accept, reject
+	PopupScene            string `xml:"PopupScene" json:"PopupScene"`                       // 1-弹窗来自H5页面 2-弹窗来自图文消息
+}
+
+type SubStructSubscribeMsgPopupEvent struct {
+	List []*SubStructSubscribeMsgPopupItem `xml:"List" json:"List"`
+}
+
+// 用户操作订阅通知弹窗
+type EventSubscribeMsgPopup struct {
+	MessageEvent
+
+	SubscribeMsgPopupEvent SubStructSubscribeMsgPopupEvent `xml:"SubscribeMsgPopupEvent" json:"SubscribeMsgPopupEvent"`
+}
+
+type SubStructSubscribeMsgChangeItem struct {
+	TemplateId            string `xml:"TemplateId" json:"TemplateId"`
+	SubscribeStatusString string `xml:"SubscribeStatusString" json:"SubscribeStatusString"` // reject
+}
+
+type SubStructSubscribeMsgChangeEvent struct {
+	List []*SubStructSubscribeMsgChangeItem `xml:"List" json:"List"`
+}
+
+// 用户管理订阅通知
+type EventSubscribeMsgChange struct {
+	MessageEvent
+
+	SubscribeMsgChangeEvent SubStructSubscribeMsgChangeEvent `xml:"SubscribeMsgChangeEvent" json:"SubscribeMsgChangeEvent"`
+}
+
+type SubStructSubscribeMsgSentItem struct {
+	TemplateId  string `xml:"TemplateId" json:"TemplateId"`
+	MsgID       string `xml:"MsgID" json:"MsgID"`
+	ErrorCode   int    `xml:"ErrorCode" json:"ErrorCode"`
+	ErrorStatus string `xml:"ErrorStatus" json:"ErrorStatus"`
+}
+
+type SubStructSubscribeMsgSentEvent struct {
+	List []*SubStructSubscribeMsgSentItem `xml:"List" json:"List"`
+}
+
+// 发送订阅通知结果
+type EventSubscribeMsgSent struct {
+	MessageEvent
+
+	SubscribeMsgSentEvent SubStructSubscribeMsgSentEvent `xml:"SubscribeMsgSentEvent" json:"SubscribeMsgSentEvent"`
+}
@@ -0,0 +1,137 @@
+package msghandler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func parseTestXML(t *testing.T, body string) Message {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "text/xml")
+	msg, err := NewMsgHandler(nil, nil).parseMessage(c)
+	if err != nil {
+		t.Fatalf("parseMessage error: %v", err)
+	}
+	if msg == nil {
+		t.Fatal("parseMessage returned nil")
+	}
+	return msg
+}
+
+func eventXML(event, extra string) string {
+	return `<xml><ToUserName><![CDATA[gh_test]]></ToUserName><FromUserName><![CDATA[openid1]]></FromUserName>` +
+		`<CreateTime>1700000000</CreateTime><MsgType><![CDATA[event]]></MsgType><Event><![CDATA[` + event + `]]></Event>` +
+		extra + `</xml>`
+}
+
+func TestParseMessageEvents(t *testing.T) {
+	cases := []struct {
+		name  string
+		body  string
+		check func(t *testing.T, msg Message)
+	}{
+		{"LOCATION", eventXML("LOCATION", `<Latitude>23.137466</Latitude><Longitude>113.352425</Longitude><Precision>119.385040</Precision>`), func(t *testing.T, msg Message) {
+			e, ok := msg.(*EventLocation)
+			if !ok || e.Latitude != 23.137466 || e.Longitude != 113.352425 || e.Precision != 119.38504 {
+				t.Errorf("got %#v", msg)
+			}
+		}},
+		{"scancode_push", eventXML("scancode_push", `<EventKey><![CDATA[6]]></EventKey><ScanCodeInfo><ScanType><![CDATA[qrcode]]></ScanType><ScanResult><![CDATA[1]]></ScanResult></ScanCodeInfo>`), func(t *testing.T, msg Message) {
+			e, ok := msg.(*EventScanCode)
+			if !ok || e.EventKey != "6" || e.ScanCodeInfo.ScanType != "qrcode" || e.ScanCodeInfo.ScanResult != "1" {
+				t.Errorf("got %#v", msg)
+			}
+		}},
+		{"scancode_waitmsg", eventXML("scancode_waitmsg", `<EventKey><![CDATA[6]]></EventKey><ScanCodeInfo><ScanType><![CDATA[barcode]]></ScanType><ScanResult><![CDATA[EAN_13,6901234567892]]></ScanResult></ScanCodeInfo>`), func(t *testing.T, msg Message) {
+			e, ok := msg.(*EventScanCode)
+			if !ok || e.Event != "scancode_waitmsg" || e.ScanCodeInfo.ScanType != "barcode" || e.ScanCodeInfo.ScanResult != "EAN_13,6901234567892" {
+				t.Errorf("got %#v", msg)
+			}
+		}},
+		{"pic_sysphoto", eventXML("pic_sysphoto", `<EventKey><![CDATA[6]]></EventKey><SendPicsInfo><Count>1</Count><PicList><item><PicMd5Sum><![CDATA[1b5f7c23b5bf75682a53e7b6d163e185]]></PicMd5Sum></item></PicList></SendPicsInfo>`), func(t *testing.T, msg Message) {
+			e, ok := msg.(*EventSendPics)
+			if !ok || e.SendPicsInfo.Count != 1 || len(e.SendPicsInfo.PicList.Item) != 1 || e.SendPicsInfo.PicList.Item[0].PicMd5Sum != "1b5f7c23b5bf75682a53e7b6d163e185" {
+				t.Errorf("got %#v", msg)
+			}
+		}},
+		{"pic_photo_or_album", eventXML("pic_photo_or_album", `<SendPicsInfo><Count>2</Count><PicList><item><PicMd5Sum><![CDATA[a]]></PicMd5Sum></item><item><PicMd5Sum><![CDATA[b]]></PicMd5Sum></item></PicList></SendPicsInfo>`), func(t *testing.T, msg Message) {
+			e, ok := msg.(*EventSendPics)
+			if !ok || e.SendPicsInfo.Count != 2 || len(e.SendPicsInfo.PicList.Item) != 2 || e.SendPicsInfo.PicList.Item[1].PicMd5Sum != "b" {
+				t.Errorf("got %#v", msg)
+			}
+		}},
+		{"pic_weixin", eventXML("pic_weixin", `<SendPicsInfo><Count>1</Count><PicList><item><PicMd5Sum><![CDATA[c]]></PicMd5Sum></item></PicList></SendPicsInfo>`), func(t *testing.T, msg Message) {
+			if _, ok := msg.(*EventSendPics); !ok {
+				t.Errorf("got %#v", msg)
+			}
+		}},
+		{"location_select", eventXML("location_select", `<EventKey><![CDATA[6]]></EventKey><SendLocationInfo><Location_X><![CDATA[23]]></Location_X><Location_Y><![CDATA[113]]></Location_Y><Scale><![CDATA[15]]></Scale><Label><![CDATA[广州市海珠区]]></Label><Poiname><![CDATA[]]></Poiname></SendLocationInfo>`), func(t *testing.T, msg Message) {
+			e, ok := msg.(*EventLocationSelect)
+			if !ok || e.SendLocationInfo.LocationX != "23" || e.SendLocationInfo.LocationY != "113" || e.SendLocationInfo.Scale != "15" || e.SendLocationInfo.Label != "广州市海珠区" {
+				t.Errorf("got %#v", msg)
+			}
+		}},
+		{"MASSSENDJOBFINISH", eventXML("MASSSENDJOBFINISH", `<MsgID>1988</MsgID><Status><![CDATA[sendsuccess]]></Status><TotalCount>100</TotalCount><FilterCount>80</FilterCount><SentCount>75</SentCount><ErrorCount>5</ErrorCount>`+
+			`<CopyrightCheckResult><Count>1</Count><ResultList><item><ArticleIdx>1</ArticleIdx><UserDeclareState>0</UserDeclareState><AuditState>2</AuditState><OriginalArticleUrl><![CDATA[Url_1]]></OriginalArticleUrl><OriginalArticleType>1</OriginalArticleType><CanReprint>1</CanReprint><NeedReplaceContent>1</NeedReplaceContent><NeedShowReprintSource>1</NeedShowReprintSource></item></ResultList><CheckState>2</CheckState></CopyrightCheckResult>`+
+			`<ArticleUrlResult><Count>1</Count><ResultList><item><ArticleIdx>1</ArticleIdx><ArticleUrl><![CDATA[Url]]></ArticleUrl></item></ResultList></ArticleUrlResult>`), func(t *testing.T, msg Message) {
+			e, ok := msg.(*EventMassSendJobFinish)
+			if !ok || e.MsgID != 1988 || e.Status != "sendsuccess" || e.TotalCount != 100 || e.FilterCount != 80 || e.SentCount != 75 || e.ErrorCount != 5 {
+				t.Fatalf("got %#v", msg)
+			}
+			cr := e.CopyrightCheckResult
+			if cr.Count != 1 || cr.CheckState != 2 || len(cr.ResultList.Item) != 1 || cr.ResultList.Item[0].OriginalArticleUrl != "Url_1" || cr.ResultList.Item[0].AuditState != 2 {
+				t.Errorf("CopyrightCheckResult = %#v", cr)
+			}
+			if len(e.ArticleUrlResult.ResultList.Item) != 1 || e.ArticleUrlResult.ResultList.Item[0].ArticleUrl != "Url" {
+				t.Errorf("ArticleUrlResult = %#v", e.ArticleUrlResult)
+			}
+		}},
+		{"PUBLISHJOBFINISH", eventXML("PUBLISHJOBFINISH", `<PublishEventInfo><publish_id>2247503051</publish_id><publish_status>0</publish_status><article_id><![CDATA[b5O2OUs25HBxRceL7hfReg-U9QGeq9zQjiDvy]]></article_id>`+
+			`<article_detail><count>1</count><item><idx>1</idx><article_url><![CDATA[ARTICLE_URL]]></article_url></item></article_detail></PublishEventInfo>`), func(t *testing.T, msg Message) {
+			e, ok := msg.(*EventPublishJobFinish)
+			info := e.PublishEventInfo
+			if !ok || info.PublishId != "2247503051" || info.PublishStatus != 0 || info.ArticleId != "b5O2OUs25HBxRceL7hfReg-U9QGeq9zQjiDvy" {
+				t.Fatalf("got %#v", msg)
+			}
+			if info.ArticleDetail.Count != 1 || len(info.ArticleDetail.Item) != 1 || info.ArticleDetail.Item[0].Idx != 1 || info.ArticleDetail.Item[0].ArticleUrl != "ARTICLE_URL" {
+				t.Errorf("ArticleDetail = %#v", info.ArticleDetail)
+			}
+		}},
+		{"subscribe_msg_popup_event", eventXML("subscribe_msg_popup_event", `<SubscribeMsgPopupEvent><List><TemplateId><![CDATA[VRR0UEO9VJOLs0MHlU0OilqX6MVFDwH3_3gz3Oc0NIc]]></TemplateId><SubscribeStatusString><![CDATA[accept]]></SubscribeStatusString><PopupScene>2</PopupScene></List>`+
+			`<List><TemplateId><![CDATA[9nLIlbOQZC5Y89AZteFEux3WCXRRRG5Wfzkpssu4bLI]]></TemplateId><SubscribeStatusString><![CDATA[reject]]></SubscribeStatusString><PopupScene>2</PopupScene></List></SubscribeMsgPopupEvent>`), func(t *testing.T, msg Message) {
+			e, ok := msg.(*EventSubscribeMsgPopup)
+			if !ok || len(e.SubscribeMsgPopupEvent.List) != 2 {
+				t.Fatalf("got %#v", msg)
+			}
+			first, second := e.SubscribeMsgPopupEvent.List[0], e.SubscribeMsgPopupEvent.List[1]
+			if first.TemplateId != "VRR0UEO9VJOLs0MHlU0OilqX6MVFDwH3_3gz3Oc0NIc" || first.SubscribeStatusString != "accept" || first.PopupScene != "2" {
+				t.Errorf("List[0] = %#v", first)
+			}
+			if second.SubscribeStatusString != "reject" {
+				t.Errorf("List[1] = %#v", second)
+			}
+		}},
+		{"unknown event falls back to MessageEvent", eventXML("some_new_event", `<EventKey><![CDATA[k]]></EventKey>`), func(t *testing.T, msg Message) {
+			e, ok := msg.(*MessageEvent)
+			if !ok || e.Event != "some_new_event" || e.EventKey != "k" {
+				t.Errorf("got %#v", msg)
+			}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg := parseTestXML(t, c.body)
+			if e := GetMessageEvent(msg); e == nil || e.FromUserName != "openid1" || e.CreateTime != 1700000000 {
+				t.Fatalf("common fields = %#v", e)
+			}
+			c.check(t, msg)
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package msghandler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 捕获处理函数的 panic，避免微信服务器收不到回包
+func RecoveryMiddleware() Middleware {
+	return func(next MsgHandlerFunc) MsgHandlerFunc {
+		return func(rc *ReplyCtrl, msg Message) {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Println("RecoveryMiddleware panic", err, string(debug.Stack()))
+					if !rc.Replied() {
+						rc.c.String(200, "success")
+					}
+				}
+			}()
+			next(rc, msg)
+		}
+	}
+}
+
+// 记录消息类型和处理耗时
+func LoggingMiddleware() Middleware {
+	return func(next MsgHandlerFunc) MsgHandlerFunc {
+		return func(rc *ReplyCtrl, msg Message) {
+			start := time.Now()
+			next(rc, msg)
+			if msg == nil {
+				log.Println("LoggingMiddleware nil message", time.Since(start))
+				return
+			}
+			event := ""
+			if e := GetMessageEvent(msg); e != nil {
+				event = e.Event
+			}
+			log.Println("LoggingMiddleware", rc.msgHandler.mpoptions.AppId, msg.GetFromUserName(), msg.GetMsgType(), event, time.Since(start))
+		}
+	}
+}
+
+type RateLimiter interface {
+	Allow(appid, openid string) (bool, error)
+}
+
+// 固定窗口计数的限流，每个用户在 window 时间内最多 limit 条消息
+type RedisRateLimiter struct {
+	rdb    *redis.Client
+	limit  int64
+	window time.Duration
+}
+
+func NewRedisRateLimiter(rdb *redis.Client, limit int64, window time.Duration) *RedisRateLimiter {
+	return &RedisRateLimiter{
+		rdb:    rdb,
+		limit:  limit,
+		window: window,
+	}
+}
+
+// 计数和设置过期时间在一个脚本中完成，避免 INCR 之后 EXPIRE 失败留下永不过期的 key
+// 不用 EXPIRE NX，兼容 redis 7.0 之前的版本
+var rateLimitScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+func (r *RedisRateLimiter) Allow(appid, openid string) (bool, error) {
+	slot := time.Now().UnixNano() / int64(r.window)
+	key := fmt.Sprint(appid, "_msg_ratelimit_", openid, "_", slot)
+	count, err := rateLimitScript.Run(context.TODO(), r.rdb, []string{key}, r.window.Milliseconds()).Int64()
+	if err != nil {
+		return false, err
+	}
+	return count <= r.limit, nil
+}
+
+// 限流中间件，超过频率的消息直接回复 success，不再处理
+func RateLimitMiddleware(limiter RateLimiter) Middleware {
+	return func(next MsgHandlerFunc) MsgHandlerFunc {
+		return func(rc *ReplyCtrl, msg Message) {
+			if msg == nil {
+				next(rc, msg)
+				return
+			}
+			ok, err := limiter.Allow(rc.msgHandler.mpoptions.AppId, msg.GetFromUserName())
+			if err != nil {
+				// redis 出错时不影响正常处理
+				log.Println("RateLimitMiddleware Allow error", err)
+				next(rc, msg)
+				return
+			}
+			if !ok {
+				log.Println("RateLimitMiddleware too many messages", msg.GetFromUserName())
+				rc.c.String(200, "success")
+				return
+			}
+			next(rc, msg)
+		}
+	}
+}
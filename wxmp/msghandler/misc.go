@@ -3,7 +3,7 @@ package msghandler
 import "encoding/xml"
 
 type MessageText struct {
-	XMLName xml.Name `xml:"xml"`
+	XMLName xml.Name `xml:"xml" json:"-"`
 
 	ToUserName   string `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string `xml:"FromUserName" json:"FromUserName"`
@@ -24,9 +24,15 @@ func (m *MessageText) GetToUserName() string {
 func (m *MessageText) GetFromUserName() string {
 	return m.FromUserName
 }
+func (m *MessageText) GetCreateTime() int64 {
+	return m.CreateTime
+}
+func (m *MessageText) GetMsgId() int64 {
+	return m.MsgId
+}
 
 type MessageImage struct {
-	XMLName xml.Name `xml:"xml"`
+	XMLName xml.Name `xml:"xml" json:"-"`
 
 	ToUserName   string `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string `xml:"FromUserName" json:"FromUserName"`
@@ -48,9 +54,15 @@ func (m *MessageImage) GetToUserName() string {
 func (m *MessageImage) GetFromUserName() string {
 	return m.FromUserName
 }
+func (m *MessageImage) GetCreateTime() int64 {
+	return m.CreateTime
+}
+func (m *MessageImage) GetMsgId() int64 {
+	return m.MsgId
+}
 
 type MessageVoice struct {
-	XMLName xml.Name `xml:"xml"`
+	XMLName xml.Name `xml:"xml" json:"-"`
 
 	ToUserName   string `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string `xml:"FromUserName" json:"FromUserName"`
@@ -73,9 +85,15 @@ func (m *MessageVoice) GetToUserName() string {
 func (m *MessageVoice) GetFromUserName() string {
 	return m.FromUserName
 }
+func (m *MessageVoice) GetCreateTime() int64 {
+	return m.CreateTime
+}
+func (m *MessageVoice) GetMsgId() int64 {
+	return m.MsgId
+}
 
 type MessageVideo struct {
-	XMLName xml.Name `xml:"xml"`
+	XMLName xml.Name `xml:"xml" json:"-"`
 
 	ToUserName   string `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string `xml:"FromUserName" json:"FromUserName"`
@@ -97,9 +115,15 @@ func (m *MessageVideo) GetToUserName() string {
 func (m *MessageVideo) GetFromUserName() string {
 	return m.FromUserName
 }
+func (m *MessageVideo) GetCreateTime() int64 {
+	return m.CreateTime
+}
+func (m *MessageVideo) GetMsgId() int64 {
+	return m.MsgId
+}
 
 type MessageShortVideo struct {
-	XMLName xml.Name `xml:"xml"`
+	XMLName xml.Name `xml:"xml" json:"-"`
 
 	ToUserName   string `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string `xml:"FromUserName" json:"FromUserName"`
@@ -121,9 +145,15 @@ func (m *MessageShortVideo) GetToUserName() string {
 func (m *MessageShortVideo) GetFromUserName() string {
 	return m.FromUserName
 }
+func (m *MessageShortVideo) GetCreateTime() int64 {
+	return m.CreateTime
+}
+func (m *MessageShortVideo) GetMsgId() int64 {
+	return m.MsgId
+}
 
 type MessageLocation struct {
-	XMLName xml.Name `xml:"xml"`
+	XMLName xml.Name `xml:"xml" json:"-"`
 
 	ToUserName   string `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string `xml:"FromUserName" json:"FromUserName"`
@@ -147,9 +177,15 @@ func (m *MessageLocation) GetToUserName() string {
 func (m *MessageLocation) GetFromUserName() string {
 	return m.FromUserName
 }
+func (m *MessageLocation) GetCreateTime() int64 {
+	return m.CreateTime
+}
+func (m *MessageLocation) GetMsgId() int64 {
+	return m.MsgId
+}
 
 type MessageLink struct {
-	XMLName xml.Name `xml:"xml"`
+	XMLName xml.Name `xml:"xml" json:"-"`
 
 	ToUserName   string `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string `xml:"FromUserName" json:"FromUserName"`
@@ -172,9 +208,15 @@ func (m *MessageLink) GetToUserName() string {
 func (m *MessageLink) GetFromUserName() string {
 	return m.FromUserName
 }
+func (m *MessageLink) GetCreateTime() int64 {
+	return m.CreateTime
+}
+func (m *MessageLink) GetMsgId() int64 {
+	return m.MsgId
+}
 
 type MessageEvent struct {
-	XMLName xml.Name `xml:"xml"`
+	XMLName xml.Name `xml:"xml" json:"-"`
 
 	ToUserName   string `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string `xml:"FromUserName" json:"FromUserName"`
@@ -194,6 +236,12 @@ func (m *MessageEvent) GetToUserName() string {
 func (m *MessageEvent) GetFromUserName() string {
 	return m.FromUserName
 }
+func (m *MessageEvent) GetCreateTime() int64 {
+	return m.CreateTime
+}
+func (m *MessageEvent) GetMessageEvent() *MessageEvent {
+	return m
+}
 
 /**
  * 回复微信服务器的相关消息结构体
@@ -218,7 +266,7 @@ type SubStructMedia3 struct {
 }
 
 type ReplyMessageText struct {
-	XMLName      xml.Name `xml:"xml"`
+	XMLName      xml.Name `xml:"xml" json:"-"`
 	ToUserName   string   `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string   `xml:"FromUserName" json:"FromUserName"`
 	CreateTime   int64    `xml:"CreateTime" json:"CreateTime"`
@@ -227,7 +275,7 @@ type ReplyMessageText struct {
 }
 
 type ReplyMessageImage struct {
-	XMLName      xml.Name       `xml:"xml"`
+	XMLName      xml.Name       `xml:"xml" json:"-"`
 	ToUserName   string         `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string         `xml:"FromUserName" json:"FromUserName"`
 	CreateTime   int64          `xml:"CreateTime" json:"CreateTime"`
@@ -236,7 +284,7 @@ type ReplyMessageImage struct {
 }
 
 type ReplyMessageVoice struct {
-	XMLName      xml.Name       `xml:"xml"`
+	XMLName      xml.Name       `xml:"xml" json:"-"`
 	ToUserName   string         `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string         `xml:"FromUserName" json:"FromUserName"`
 	CreateTime   int64          `xml:"CreateTime" json:"CreateTime"`
@@ -245,7 +293,7 @@ type ReplyMessageVoice struct {
 }
 
 type ReplyMessageVideo struct {
-	XMLName      xml.Name        `xml:"xml"`
+	XMLName      xml.Name        `xml:"xml" json:"-"`
 	ToUserName   string          `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string          `xml:"FromUserName" json:"FromUserName"`
 	CreateTime   int64           `xml:"CreateTime" json:"CreateTime"`
@@ -254,7 +302,7 @@ type ReplyMessageVideo struct {
 }
 
 type ReplyMessageMusic struct {
-	XMLName      xml.Name        `xml:"xml"`
+	XMLName      xml.Name        `xml:"xml" json:"-"`
 	ToUserName   string          `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string          `xml:"FromUserName" json:"FromUserName"`
 	CreateTime   int64           `xml:"CreateTime" json:"CreateTime"`
@@ -274,7 +322,7 @@ type SubStructArticles struct {
 }
 
 type ReplyMessageNews struct {
-	XMLName      xml.Name          `xml:"xml"`
+	XMLName      xml.Name          `xml:"xml" json:"-"`
 	ToUserName   string            `xml:"ToUserName" json:"ToUserName"`
 	FromUserName string            `xml:"FromUserName" json:"FromUserName"`
 	CreateTime   int64             `xml:"CreateTime" json:"CreateTime"`
@@ -23,15 +23,29 @@ type Message interface {
 	GetMsgType() string
 	GetToUserName() string
 	GetFromUserName() string
+	GetCreateTime() int64
+}
+
+// 普通消息带有 MsgId，事件没有
+type MessageWithMsgId interface {
+	GetMsgId() int64
 }
 
 type MsgHandlerFunc func(rc *ReplyCtrl, msg Message)
 
+// 回复消息成功后的回调，replyMode: passive-被动回复，custom-客服消息
+type ReplyHookFunc func(rc *ReplyCtrl, replyMode string, data any)
+
+// 自定义客服消息的发送方式，设置后不再调用微信接口
+type CustomSenderFunc func(rc *ReplyCtrl, data map[string]any) error
+
 type ReplyCtrl struct {
 	c          *gin.Context
 	msgHandler *MsgHandler
 
 	msg Message
+
+	values map[string]any // 中间件和处理函数之间传递数据
 }
 
 func (rc *ReplyCtrl) GetGinContext() *gin.Context {
@@ -50,33 +64,55 @@ func (rc *ReplyCtrl) GetMsg() Message {
 	return rc.msg
 }
 
+func (rc *ReplyCtrl) Set(key string, value any) {
+	if rc.values == nil {
+		rc.values = make(map[string]any)
+	}
+	rc.values[key] = value
+}
+
+func (rc *ReplyCtrl) Get(key string) (any, bool) {
+	value, ok := rc.values[key]
+	return value, ok
+}
+
+// 是否已经给微信服务器回包
+func (rc *ReplyCtrl) Replied() bool {
+	return rc.c.Writer.Written()
+}
+
+// 安全模式下，回包需要加密。加密格式和微信推送过来的格式一致
+type EncryptReplyMessage struct {
+	XMLName      xml.Name `xml:"xml" json:"-"`
+	Encrypt      string   `xml:"Encrypt" json:"Encrypt"`
+	MsgSignature string   `xml:"MsgSignature" json:"MsgSignature"`
+	TimeStamp    int64    `xml:"TimeStamp" json:"TimeStamp"`
+	Nonce        string   `xml:"Nonce" json:"Nonce"`
+}
+
 func (rc *ReplyCtrl) GetEncryptBytes(rawBytes []byte) ([]byte, error) {
-	encryptedMsg, err := common.AesEncrypt(rawBytes, rc.msgHandler.mpoptions.AesKey)
+	mpoptions := rc.msgHandler.mpoptions
+	encryptedMsg, err := common.AesEncryptWechat(mpoptions.AesKey, mpoptions.AppId, rawBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	timestamp := fmt.Sprint(time.Now().Unix())
+	timestamp := time.Now().Unix()
 	nonce := rc.c.Query("nonce")
-	token := rc.msgHandler.mpoptions.Token
-	msgSignature := common.GenerateSignature(token, timestamp, nonce, encryptedMsg)
+	msgSignature := common.GenerateSignature(mpoptions.Token, fmt.Sprint(timestamp), nonce, encryptedMsg)
 
-	var response string
+	reply := &EncryptReplyMessage{
+		Encrypt:      encryptedMsg,
+		MsgSignature: msgSignature,
+		TimeStamp:    timestamp,
+		Nonce:        nonce,
+	}
 
 	contentType := rc.c.GetHeader("Content-Type")
 	if strings.Contains(contentType, "text/xml") {
-		response = fmt.Sprintf(`<xml>
-        <Encrypt><![CDATA[%s]]></Encrypt>
-        <MsgSignature><![CDATA[%s]]></MsgSignature>
-        <TimeStamp>%s</TimeStamp>
-        <Nonce><![CDATA[%s]]></Nonce>
-    </xml>`, encryptedMsg, msgSignature, timestamp, nonce)
-	} else {
-		// todo 这里需要转义
-		response = fmt.Sprintf(`{"Encrypt":"%s","MsgSignature":"%s","TimeStamp":%s,"Nonce":"%s"}`, encryptedMsg, msgSignature, timestamp, nonce)
+		return xml.Marshal(reply)
 	}
-
-	return []byte(response), nil
+	return json.Marshal(reply)
 }
 
 func (rc *ReplyCtrl) reply(data any) {
@@ -99,24 +135,25 @@ func (rc *ReplyCtrl) reply(data any) {
 		}
 	}
 
-	// log.Println("replyBytes---111", string(replyBytes))
-
-	// 微信居然不支持回包是加密的，只能回包是明文的，是我搞错了么？
-	// if rc.c.Query("encrypt_type") == "aes" {
-	// 	replyBytes, err = rc.getEncryptBytes(replyBytes)
-	// 	if err != nil {
-	// 		rc.c.String(200, "success")
-	// 		return
-	// 	}
-	// }
-
-	// log.Println("replyBytes---222", string(replyBytes))
+	// 请求是加密的，回包也要加密
+	if rc.c.Query("encrypt_type") == "aes" {
+		replyBytes, err = rc.GetEncryptBytes(replyBytes)
+		if err != nil {
+			log.Println("ReplyCtrl.reply, GetEncryptBytes error", err)
+			rc.c.String(200, "success")
+			return
+		}
+	}
 
 	if strings.Contains(contentType, "text/xml") {
 		rc.c.Data(200, "application/xml", replyBytes)
 	} else {
 		rc.c.Data(200, "application/json", replyBytes)
 	}
+
+	if rc.msgHandler.replyHook != nil {
+		rc.msgHandler.replyHook(rc, "passive", data)
+	}
 }
 
 // 回复文本消息
@@ -208,8 +245,16 @@ func (rc *ReplyCtrl) ReplyNews(articles []*ReplyMessageArticle) {
 	rc.reply(reply)
 }
 
-// 调用客服接口发送消息
+// 调用客服接口发送消息，data 由 NewCustomXXX 系列函数构造
+func (rc *ReplyCtrl) SendCustom(data map[string]any) error {
+	return rc.send(data)
+}
+
 func (rc *ReplyCtrl) send(data map[string]any) error {
+	if rc.msgHandler.customSender != nil {
+		return rc.msgHandler.customSender(rc, data)
+	}
+
 	wxApiClient := rc.GetWxApiClient()
 	if wxApiClient == nil {
 		log.Println("ReplyCtrl.send, wxApiClient is nil, do nothing")
@@ -221,134 +266,71 @@ func (rc *ReplyCtrl) send(data map[string]any) error {
 		log.Println("ReplyCtrl.send, wxApiClient.SendCustomMessage error", err)
 		return err
 	}
+	if rc.msgHandler.replyHook != nil {
+		rc.msgHandler.replyHook(rc, "custom", data)
+	}
 	return nil
 }
 
 // 发送文本
 func (rc *ReplyCtrl) SendText(content string) error {
-	data := map[string]any{
-		"msgtype": "text",
-		"text": map[string]string{
-			"content": content,
-		},
-	}
-	return rc.send(data)
+	return rc.send(NewCustomText(content))
 }
 
 // 发送图片
 func (rc *ReplyCtrl) SendImage(mediaId string) error {
-	data := map[string]any{
-		"msgtype": "image",
-		"image": map[string]string{
-			"media_id": mediaId,
-		},
-	}
-	return rc.send(data)
+	return rc.send(NewCustomImage(mediaId))
 }
 
 // 发送语音
 func (rc *ReplyCtrl) SendVoice(mediaId string) error {
-	data := map[string]any{
-		"msgtype": "voice",
-		"voice": map[string]string{
-			"media_id": mediaId,
-		},
-	}
-	return rc.send(data)
+	return rc.send(NewCustomVoice(mediaId))
 }
 
 // 发送视频
 func (rc *ReplyCtrl) SendVideo(mediaId, thumbMediaId, title, description string) error {
-	data := map[string]any{
-		"msgtype": "video",
-		"video": map[string]string{
-			"media_id":       mediaId,
-			"thumb_media_id": thumbMediaId,
-			"title":          title,
-			"description":    description,
-		},
-	}
-	return rc.send(data)
+	return rc.send(NewCustomVideo(mediaId, thumbMediaId, title, description))
 }
 
 // 发送音乐
 func (rc *ReplyCtrl) SendMusic(title, description, musicUrl, hqMusicUrl, thumbMediaId string) error {
-	data := map[string]any{
-		"msgtype": "music",
-		"music": map[string]string{
-			"title":          title,
-			"description":    description,
-			"musicurl":       musicUrl,
-			"hqmusicurl":     hqMusicUrl,
-			"thumb_media_id": thumbMediaId,
-		},
-	}
-	return rc.send(data)
+	return rc.send(NewCustomMusic(title, description, musicUrl, hqMusicUrl, thumbMediaId))
 }
 
 // 发送图文(外链)
 func (rc *ReplyCtrl) SendNews(articles []*SendMessageArticle) error {
-	data := map[string]any{
-		"msgtype": "news",
-		"news": map[string]any{
-			"articles": articles,
-		},
-	}
-	return rc.send(data)
+	return rc.send(NewCustomNews(articles))
 }
 
 // 发送微信图文
 // 这个方式，微信即将废弃
 func (rc *ReplyCtrl) SendMpNews(mediaId string) error {
-	data := map[string]any{
-		"msgtype": "mpnews",
-		"mpnews": map[string]any{
-			"media_id": mediaId,
-		},
-	}
-	return rc.send(data)
+	return rc.send(NewCustomMpNews(mediaId))
 }
 
 // 发送微信图文(文章)
 func (rc *ReplyCtrl) SendMpNewsArticle(articleId string) error {
-	data := map[string]any{
-		"msgtype": "mpnewsarticle",
-		"mpnewsarticle": map[string]any{
-			"article_id": articleId,
-		},
-	}
-	return rc.send(data)
+	return rc.send(NewCustomMpNewsArticle(articleId))
 }
 
 // 发送卡券
 func (rc *ReplyCtrl) SendWxCard(cardId string) error {
-	data := map[string]any{
-		"msgtype": "wxcard",
-		"wxcard": map[string]string{
-			"card_id": cardId,
-		},
-	}
-	return rc.send(data)
+	return rc.send(NewCustomWxCard(cardId))
 }
 
 // 发送小程序卡片
 func (rc *ReplyCtrl) SendMiniProgramPage(title, appId, pagePath, thumbMediaId string) error {
-	data := map[string]any{
-		"msgtype": "miniprogrampage",
-		"miniprogrampage": map[string]string{
-			"title":          title,
-			"appid":          appId,
-			"pagepath":       pagePath,
-			"thumb_media_id": thumbMediaId,
-		},
-	}
-	return rc.send(data)
+	return rc.send(NewCustomMiniProgramPage(title, appId, pagePath, thumbMediaId))
 }
 
 type MsgHandler struct {
 	mpoptions   *mpoptions.MpOptions
 	wxApiClient *wxapi.WxApi
 	handler     MsgHandlerFunc
+	replyHook   ReplyHookFunc
+
+	customSender CustomSenderFunc
+	replayGuard  *ReplayGuard
 }
 
 func defaultMsgHandlerFunc(rc *ReplyCtrl, msg Message) {
@@ -379,6 +361,18 @@ func (m *MsgHandler) SetHandler(handler MsgHandlerFunc) {
 	m.handler = handler
 }
 
+func (m *MsgHandler) SetReplyHook(hook ReplyHookFunc) {
+	m.replyHook = hook
+}
+
+func (m *MsgHandler) SetCustomSender(sender CustomSenderFunc) {
+	m.customSender = sender
+}
+
+func (m *MsgHandler) SetReplayGuard(guard *ReplayGuard) {
+	m.replayGuard = guard
+}
+
 func (m *MsgHandler) returnFail(c *gin.Context, code int, msg string) {
 	c.JSON(http.StatusOK, gin.H{
 		"code":    code,
@@ -436,12 +430,16 @@ func (m *MsgHandler) getBody(c *gin.Context) ([]byte, error) {
 			return nil, fmt.Errorf("msg_signature error")
 		}
 
-		retBody, err := common.AesDecryptWechat(m.mpoptions.AesKey, encrypt)
-
+		retBody, receiveId, err := common.AesDecryptWechat(m.mpoptions.AesKey, encrypt)
 		if err != nil {
 			return nil, err
 		}
 
+		// 尾部的 AppID 必须是当前公众号的
+		if receiveId != m.mpoptions.AppId {
+			return nil, fmt.Errorf("appid mismatch")
+		}
+
 		body = retBody
 	}
 
@@ -454,6 +452,7 @@ func (m *MsgHandler) parseMessage(c *gin.Context) (Message, error) {
 	tmpMsg := struct {
 		XMLName xml.Name `xml:"xml"`
 		MsgType string   `xml:"MsgType" json:"MsgType"`
+		Event   string   `xml:"Event" json:"Event"`
 	}{}
 	switch c.Request.Method {
 	case "POST":
@@ -496,7 +495,7 @@ func (m *MsgHandler) parseMessage(c *gin.Context) (Message, error) {
 		case "link":
 			msg = &MessageLink{}
 		case "event":
-			msg = &MessageEvent{}
+			msg = newEventByName(tmpMsg.Event) // 根据事件类型解析成对应的结构体
 		default:
 			return nil, nil
 		}
@@ -546,6 +545,16 @@ func (m *MsgHandler) Serve(c *gin.Context) {
 		return
 	}
 
+	// 签名通过后再校验重放，避免伪造的请求占用 nonce
+	if m.replayGuard != nil {
+		reason := m.replayGuard.Check(c.Request.Context(), m.mpoptions.AppId, c.Query("timestamp"), c.Query("nonce"))
+		if reason != "" {
+			log.Println("msghandler replay rejected", m.mpoptions.AppId, reason, c.ClientIP(), c.Query("timestamp"), c.Query("nonce"))
+			m.returnFail(c, 1, reason)
+			return
+		}
+	}
+
 	switch c.Request.Method {
 	case "POST":
 		msg, err = m.parseMessage(c)
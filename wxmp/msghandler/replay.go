@@ -0,0 +1,103 @@
+package msghandler
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/**
+ * 防重放：签名只校验 token+timestamp+nonce，截获的请求可以被无限次重放
+ * 1. timestamp 和服务器时间相差超过窗口的拒绝
+ * 2. 窗口内出现过的 nonce 拒绝
+ * 明文模式的 signature 和安全模式的 msg_signature 用的是同一组 timestamp、nonce，所以两种模式都会被覆盖
+ */
+
+// 拒绝的原因
+const (
+	ReplayRejectTimestampInvalid = "timestamp invalid"
+	ReplayRejectTimestampExpired = "timestamp expired"
+	ReplayRejectNonceEmpty       = "nonce empty"
+	ReplayRejectNonceReplayed    = "nonce replayed"
+)
+
+// 拒绝时调用，用于按原因统计次数
+type ReplayRejectHookFunc func(appid, reason string)
+
+type NonceStore interface {
+	// 窗口内第一次出现返回true
+	MarkNonce(ctx context.Context, appid, nonce string, expire time.Duration) (bool, error)
+}
+
+type RedisNonceStore struct {
+	rdb *redis.Client
+}
+
+func NewRedisNonceStore(rdb *redis.Client) *RedisNonceStore {
+	return &RedisNonceStore{
+		rdb: rdb,
+	}
+}
+
+func (r *RedisNonceStore) MarkNonce(ctx context.Context, appid, nonce string, expire time.Duration) (bool, error) {
+	return r.rdb.SetNX(ctx, appid+"_msg_nonce_"+nonce, "1", expire).Result()
+}
+
+type ReplayGuard struct {
+	window     time.Duration
+	nonceStore NonceStore
+	rejectHook ReplayRejectHookFunc
+}
+
+// window 为允许的时间偏差，nonceStore 为 nil 时只校验时间
+func NewReplayGuard(window time.Duration, nonceStore NonceStore) *ReplayGuard {
+	return &ReplayGuard{
+		window:     window,
+		nonceStore: nonceStore,
+	}
+}
+
+func (g *ReplayGuard) SetRejectHook(hook ReplayRejectHookFunc) {
+	g.rejectHook = hook
+}
+
+// 校验通过返回空字符串，否则返回拒绝的原因
+func (g *ReplayGuard) Check(ctx context.Context, appid, timestamp, nonce string) string {
+	reason := g.check(ctx, appid, timestamp, nonce)
+	if reason != "" && g.rejectHook != nil {
+		g.rejectHook(appid, reason)
+	}
+	return reason
+}
+
+func (g *ReplayGuard) check(ctx context.Context, appid, timestamp, nonce string) string {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ReplayRejectTimestampInvalid
+	}
+	diff := time.Since(time.Unix(ts, 0))
+	if diff > g.window || diff < -g.window {
+		return ReplayRejectTimestampExpired
+	}
+
+	if g.nonceStore == nil {
+		return ""
+	}
+	if nonce == "" {
+		return ReplayRejectNonceEmpty
+	}
+	// nonce 要保留到时间窗口的两端都过去
+	ok, err := g.nonceStore.MarkNonce(ctx, appid, nonce, 2*g.window)
+	if err != nil {
+		// redis 出错时放行，只靠时间窗口
+		log.Println("ReplayGuard MarkNonce error", err)
+		return ""
+	}
+	if !ok {
+		return ReplayRejectNonceReplayed
+	}
+	return ""
+}
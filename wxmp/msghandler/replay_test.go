@@ -0,0 +1,59 @@
+package msghandler
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type memoryNonceStore map[string]bool
+
+func (s memoryNonceStore) MarkNonce(ctx context.Context, appid, nonce string, expire time.Duration) (bool, error) {
+	key := appid + "_" + nonce
+	if s[key] {
+		return false, nil
+	}
+	s[key] = true
+	return true, nil
+}
+
+func TestReplayGuardRejectHook(t *testing.T) {
+	guard := NewReplayGuard(5*time.Minute, memoryNonceStore{})
+	counts := make(map[string]int)
+	guard.SetRejectHook(func(appid, reason string) {
+		counts[reason]++
+	})
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	cases := []struct {
+		timestamp string
+		nonce     string
+		want      string
+	}{
+		{now, "n1", ""},
+		{now, "n1", ReplayRejectNonceReplayed},
+		{now, "n2", ""},
+		{stale, "n3", ReplayRejectTimestampExpired},
+		{"abc", "n4", ReplayRejectTimestampInvalid},
+		{now, "", ReplayRejectNonceEmpty},
+		{now, "n1", ReplayRejectNonceReplayed},
+	}
+	for _, c := range cases {
+		if got := guard.Check(context.Background(), "wx_appid", c.timestamp, c.nonce); got != c.want {
+			t.Errorf("Check(%s, %s) = %q, want %q", c.timestamp, c.nonce, got, c.want)
+		}
+	}
+
+	want := map[string]int{
+		ReplayRejectNonceReplayed:    2,
+		ReplayRejectTimestampExpired: 1,
+		ReplayRejectTimestampInvalid: 1,
+		ReplayRejectNonceEmpty:       1,
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("reject counts = %v, want %v", counts, want)
+	}
+}
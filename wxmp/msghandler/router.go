@@ -0,0 +1,131 @@
+package msghandler
+
+import "log"
+
+/**
+ * 消息路由
+ * 按消息类型、事件类型、菜单key分发到不同的处理函数，并支持中间件
+ * 匹配顺序：菜单点击key > 事件类型 > 消息类型 > Fallback
+ * 都没匹配上并且也没有回包，就回复 success
+ */
+
+// 中间件，不调用 next 就是拦截
+type Middleware func(next MsgHandlerFunc) MsgHandlerFunc
+
+type Router struct {
+	middlewares     []Middleware
+	msgTypeRoutes   map[string]MsgHandlerFunc
+	eventRoutes     map[string]MsgHandlerFunc
+	menuClickRoutes map[string]MsgHandlerFunc
+	fallback        MsgHandlerFunc
+}
+
+func NewRouter() *Router {
+	return &Router{
+		middlewares:     make([]Middleware, 0),
+		msgTypeRoutes:   make(map[string]MsgHandlerFunc),
+		eventRoutes:     make(map[string]MsgHandlerFunc),
+		menuClickRoutes: make(map[string]MsgHandlerFunc),
+	}
+}
+
+// 添加中间件，先添加的在外层
+func (r *Router) Use(middlewares ...Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// msgType: text image voice video shortvideo location link event
+func (r *Router) On(msgType string, handler MsgHandlerFunc) {
+	r.msgTypeRoutes[msgType] = handler
+}
+
+func (r *Router) OnText(handler MsgHandlerFunc) {
+	r.On("text", handler)
+}
+
+func (r *Router) OnImage(handler MsgHandlerFunc) {
+	r.On("image", handler)
+}
+
+func (r *Router) OnVoice(handler MsgHandlerFunc) {
+	r.On("voice", handler)
+}
+
+func (r *Router) OnVideo(handler MsgHandlerFunc) {
+	r.On("video", handler)
+}
+
+func (r *Router) OnShortVideo(handler MsgHandlerFunc) {
+	r.On("shortvideo", handler)
+}
+
+func (r *Router) OnLocation(handler MsgHandlerFunc) {
+	r.On("location", handler)
+}
+
+func (r *Router) OnLink(handler MsgHandlerFunc) {
+	r.On("link", handler)
+}
+
+// event: subscribe unsubscribe SCAN CLICK VIEW LOCATION 等
+func (r *Router) OnEvent(event string, handler MsgHandlerFunc) {
+	r.eventRoutes[event] = handler
+}
+
+// 菜单点击，key 是菜单的 EventKey
+func (r *Router) OnMenuClick(key string, handler MsgHandlerFunc) {
+	r.menuClickRoutes[key] = handler
+}
+
+// 都没匹配上的时候调用
+func (r *Router) Fallback(handler MsgHandlerFunc) {
+	r.fallback = handler
+}
+
+func (r *Router) match(msg Message) MsgHandlerFunc {
+	if msg == nil {
+		return r.fallback
+	}
+
+	if e := GetMessageEvent(msg); e != nil {
+		if e.Event == "CLICK" {
+			if handler, ok := r.menuClickRoutes[e.EventKey]; ok {
+				return handler
+			}
+		}
+		if handler, ok := r.eventRoutes[e.Event]; ok {
+			return handler
+		}
+	}
+
+	if handler, ok := r.msgTypeRoutes[msg.GetMsgType()]; ok {
+		return handler
+	}
+
+	return r.fallback
+}
+
+func (r *Router) dispatch(rc *ReplyCtrl, msg Message) {
+	handler := r.match(msg)
+	if handler != nil {
+		handler(rc, msg)
+	}
+	if !rc.Replied() {
+		rc.c.String(200, "success")
+	}
+}
+
+// 组装好中间件的处理函数，给 MsgHandler.SetHandler 使用
+func (r *Router) Handler() MsgHandlerFunc {
+	handler := r.dispatch
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		handler = r.middlewares[i](handler)
+	}
+	return func(rc *ReplyCtrl, msg Message) {
+		handler(rc, msg)
+		if !rc.Replied() {
+			log.Println("Router.Handler no reply, return success")
+			rc.c.String(200, "success")
+		}
+	}
+}